@@ -13,6 +13,9 @@ import (
 )
 
 func main() {
+	// the commands with rlimits are executed through the logfilter binary
+	logfilter.RunRlimitHelper()
+
 	baseLogger := logrus.StandardLogger()
 	baseLogger.SetFormatter(&logfilter.JSONFormatter{
 		JSONFormatter: &logrus.JSONFormatter{
@@ -41,6 +44,9 @@ func main() {
 		if len(config.Cmd) > 0 {
 			logger.WithError(err).Fatal("Cannot specify both LOGFILTER_CMD and process arguments")
 		}
+		if len(config.Procs) > 0 {
+			logger.Fatal("Cannot specify both LOGFILTER_PROCS and process arguments")
+		}
 
 		config.Cmd = os.Args[1:]
 
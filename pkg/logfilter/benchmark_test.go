@@ -0,0 +1,75 @@
+package logfilter_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+// benchmarkLogFilter measures the end-to-end throughput of filtering b.N
+// lines from stdin to stdout.
+func benchmarkLogFilter(b *testing.B, configure func(config *Config)) {
+	line := []byte(`{"Timestamp":"2020-08-18T17:16:36.9975268+00:00","Level":"Information","MessageTemplate":"Test message","Properties":{"DurationMs":1}}` + "\n")
+
+	input := bytes.Repeat(line, b.N)
+
+	config := &Config{}
+	config.DebugDisabled = true
+	config.MaxScanLineSize = 1024 * 1024
+	config.BufferLines = 1000
+	configure(config)
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.Level = logrus.WarnLevel
+
+	logFilter := NewLogFilter(config, bytes.NewReader(input), ioutil.Discard, logger.WithFields(logrus.Fields{}))
+	if err := logFilter.Init(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	defer logFilter.Close()
+
+	b.SetBytes(int64(len(line)))
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	// stdin EOF always stops the logfilter
+	_ = logFilter.Start()
+}
+
+func BenchmarkLogFilterNoFilter(b *testing.B) {
+	benchmarkLogFilter(b, func(config *Config) {})
+}
+
+func BenchmarkLogFilterJQ(b *testing.B) {
+	benchmarkLogFilter(b, func(config *Config) {
+		config.FilterQuery = `select(.Level != "Debug") | select(.MessageTemplate != "Test")`
+	})
+}
+
+func BenchmarkLogFilterTemplate(b *testing.B) {
+	benchmarkLogFilter(b, func(config *Config) {
+		config.ExcludeTemplate = `{{with .Level}}{{eq . "Debug"}}{{end}}{{with .MessageTemplate}}{{eq . "Test"}}{{end}}`
+	})
+}
+
+func BenchmarkLogFilterBufferedOutput(b *testing.B) {
+	benchmarkLogFilter(b, func(config *Config) {
+		config.FilterQuery = `select(.Level != "Debug") | select(.MessageTemplate != "Test")`
+		config.OutputBufferSize = 64 * 1024
+		config.OutputFlushInterval = time.Second
+	})
+}
+
+func BenchmarkLogFilterJQWorkers(b *testing.B) {
+	benchmarkLogFilter(b, func(config *Config) {
+		config.FilterQuery = `select(.Level != "Debug") | select(.MessageTemplate != "Test")`
+		config.FilterWorkers = 4
+	})
+}
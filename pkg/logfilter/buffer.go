@@ -0,0 +1,188 @@
+package logfilter
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	BufferPolicyBlock        = "block"
+	BufferPolicyDropNewest   = "drop-newest"
+	BufferPolicyDropOldest   = "drop-oldest"
+	BufferPolicyDropExcluded = "drop-excluded"
+)
+
+// ValidateBufferPolicy checks if the buffer policy is known.
+func ValidateBufferPolicy(policy string) error {
+	switch policy {
+	case "", BufferPolicyBlock, BufferPolicyDropNewest, BufferPolicyDropOldest, BufferPolicyDropExcluded:
+		return nil
+	}
+	return xerrors.Errorf("invalid buffer policy: %s", policy)
+}
+
+// lineBuffer is the bounded buffer between the scanners and the writer. It is
+// capped by the number of lines and by the number of bytes. The policy
+// determines what happens when it is full.
+type lineBuffer struct {
+	// bytes is accessed atomically and must be 64-bit aligned
+	bytes int64
+
+	lines    chan line
+	freed    chan struct{}
+	maxBytes int64
+	policy   string
+
+	isExcluded func(l line) bool
+	onDrop     func(l line)
+
+	// writerDone is closed when the writer stopped taking the lines
+	writerDone <-chan struct{}
+}
+
+func newLineBuffer(maxLines int, maxBytes int64, policy string, isExcluded func(l line) bool, onDrop func(l line), writerDone <-chan struct{}) *lineBuffer {
+	if maxBytes <= 0 {
+		maxBytes = math.MaxInt64
+	}
+
+	return &lineBuffer{
+		lines:      make(chan line, maxLines),
+		freed:      make(chan struct{}, 1),
+		maxBytes:   maxBytes,
+		policy:     policy,
+		isExcluded: isExcluded,
+		onDrop:     onDrop,
+		writerDone: writerDone,
+	}
+}
+
+// put adds the line to the buffer. If the buffer is full the line is either
+// dropped or put blocks according to the policy. The line is discarded if the
+// writer stopped.
+func (b *lineBuffer) put(l line) {
+	size := int64(len(l.b))
+
+	for {
+		if b.reserve(size) {
+			select {
+			case b.lines <- l:
+				return
+			default:
+				b.release(size)
+			}
+		}
+
+		switch b.policy {
+		case BufferPolicyDropNewest:
+			b.onDrop(l)
+			return
+
+		case BufferPolicyDropOldest:
+			select {
+			case old := <-b.lines:
+				b.release(int64(len(old.b)))
+				b.onDrop(old)
+				continue
+			default:
+				// the writer took the lines but it did not write them yet,
+				// wait for the space
+			}
+
+		case BufferPolicyDropExcluded:
+			if !l.filtered {
+				// the writer and the filter workers reuse the result
+				l.included = !b.isExcluded(l)
+				l.filtered = true
+			}
+			if !l.included {
+				b.onDrop(l)
+				return
+			}
+		}
+
+		if b.reserve(size) {
+			// only the number of lines is over the limit
+			select {
+			case b.lines <- l:
+			case <-b.writerDone:
+				b.release(size)
+			}
+			return
+		}
+
+		select {
+		case <-b.freed:
+		case <-b.writerDone:
+			return
+		}
+	}
+}
+
+// done must be called after the line was taken from the buffer.
+func (b *lineBuffer) done(l line) {
+	b.release(int64(len(l.b)))
+}
+
+// reserve reserves the space for the line. A line bigger than maxBytes can be
+// reserved when the buffer is empty.
+func (b *lineBuffer) reserve(size int64) bool {
+	for {
+		current := atomic.LoadInt64(&b.bytes)
+		if current > 0 && current+size > b.maxBytes {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.bytes, current, current+size) {
+			return true
+		}
+	}
+}
+
+func (b *lineBuffer) release(size int64) {
+	atomic.AddInt64(&b.bytes, -size)
+
+	select {
+	case b.freed <- struct{}{}:
+	default:
+	}
+}
+
+// BufferStatus is the state of the buffer between reading and writing.
+type BufferStatus struct {
+	Policy   string `json:"policy"`
+	Lines    int    `json:"lines"`
+	MaxLines int    `json:"maxLines"`
+	Bytes    int64  `json:"bytes"`
+	MaxBytes int64  `json:"maxBytes"`
+}
+
+func (b *lineBuffer) status() BufferStatus {
+	return BufferStatus{
+		Policy:   b.policy,
+		Lines:    len(b.lines),
+		MaxLines: cap(b.lines),
+		Bytes:    atomic.LoadInt64(&b.bytes),
+		MaxBytes: b.maxBytes,
+	}
+}
+
+// lockedJSONFilter makes a JSONFilter safe for concurrent use. It is used when
+// the scanners evaluate the filter for the drop-excluded buffer policy.
+type lockedJSONFilter struct {
+	mu         sync.Mutex
+	jsonFilter JSONFilter
+}
+
+func (f *lockedJSONFilter) IsIncluded(b []byte) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.jsonFilter.IsIncluded(b)
+}
+
+func (f *lockedJSONFilter) process(e *event) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return filterEvent(f.jsonFilter, e)
+}
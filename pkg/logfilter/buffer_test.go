@@ -0,0 +1,129 @@
+package logfilter_test
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Buffer", func() {
+	DescribeTable("should apply the policy when the buffer is full",
+		func(configure func(config *Config), lines []string, expectedOutput []string, expectedDropped int) {
+			config := &Config{}
+			config.MaxScanLineSize = 1024
+			config.BufferBytes = 1024
+			configure(config)
+
+			inputReader, inputWriter := io.Pipe()
+
+			writeStarted := make(chan struct{})
+			writeRelease := make(chan struct{})
+			var writeOnce sync.Once
+
+			output := &syncBuffer{}
+			writer := funcWriter(func(b []byte) (int, error) {
+				writeOnce.Do(func() {
+					close(writeStarted)
+					<-writeRelease
+				})
+				return output.Write(b)
+			})
+
+			logFilter := NewLogFilter(config, inputReader, writer, Logger)
+			Expect(logFilter.Init(TestCtx)).To(Succeed())
+			defer logFilter.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- logFilter.Start()
+			}()
+
+			_, err := inputWriter.Write([]byte(lines[0] + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+
+			// the writer is blocked writing the first line
+			Eventually(writeStarted).Should(BeClosed())
+
+			for _, l := range lines[1:] {
+				_, err := inputWriter.Write([]byte(l + "\n"))
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			Eventually(func() uint64 {
+				return logFilter.Status().Streams[0].Dropped
+			}).Should(BeEquivalentTo(expectedDropped))
+
+			inputWriter.Close()
+			close(writeRelease)
+
+			Eventually(done).Should(Receive(MatchError("reading stdin: EOF")))
+
+			Expect(output.String()).To(Equal(strings.Join(expectedOutput, "\n") + "\n"))
+			Expect(logFilter.Status().Streams[0].Dropped).To(BeEquivalentTo(expectedDropped))
+		},
+		Entry("drop-newest",
+			func(config *Config) {
+				config.BufferLines = 2
+				config.BufferPolicy = BufferPolicyDropNewest
+			},
+			[]string{"line1", "line2", "line3", "line4", "line5"},
+			[]string{"line1", "line2", "line3"},
+			2,
+		),
+		Entry("drop-oldest",
+			func(config *Config) {
+				config.BufferLines = 2
+				config.BufferPolicy = BufferPolicyDropOldest
+			},
+			[]string{"line1", "line2", "line3", "line4", "line5"},
+			[]string{"line1", "line4", "line5"},
+			2,
+		),
+		Entry("drop-newest capped by bytes",
+			func(config *Config) {
+				config.BufferLines = 100
+				config.BufferBytes = 12
+				config.BufferPolicy = BufferPolicyDropNewest
+			},
+			[]string{"line1", "line2", "line3", "line4", "line5"},
+			[]string{"line1", "line2", "line3"},
+			2,
+		),
+		Entry("drop-excluded",
+			func(config *Config) {
+				config.BufferLines = 2
+				config.BufferPolicy = BufferPolicyDropExcluded
+				config.FilterQuery = `select(.Level != "Debug")`
+			},
+			[]string{
+				`{"Level":"Info","Message":"1"}`,
+				`{"Level":"Info","Message":"2"}`,
+				`{"Level":"Info","Message":"3"}`,
+				`{"Level":"Debug","Message":"4"}`,
+				`{"Level":"Debug","Message":"5"}`,
+			},
+			[]string{
+				`{"Level":"Info","Message":"1"}`,
+				`{"Level":"Info","Message":"2"}`,
+				`{"Level":"Info","Message":"3"}`,
+			},
+			2,
+		),
+	)
+
+	It("should fail for an invalid buffer policy", func() {
+		config := &Config{}
+		config.BufferPolicy = "drop-everything"
+
+		logFilter := NewLogFilter(config, strings.NewReader(""), &syncBuffer{}, Logger)
+		defer logFilter.Close()
+
+		Expect(logFilter.Init(TestCtx)).To(MatchError("invalid buffer policy: drop-everything"))
+	})
+})
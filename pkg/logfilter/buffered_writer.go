@@ -0,0 +1,32 @@
+package logfilter
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// bufferedWriter batches the writes to an output. The data is written when the
+// buffer is full or on Flush. It is safe for concurrent use.
+type bufferedWriter struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func newBufferedWriter(w io.Writer, size int) *bufferedWriter {
+	return &bufferedWriter{
+		w: bufio.NewWriterSize(w, size),
+	}
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(b)
+}
+
+func (w *bufferedWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Flush()
+}
@@ -0,0 +1,124 @@
+package logfilter_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Output", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logfilter-test-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	input := "line1\nline2\nline3\n"
+
+	It("should write each line with a single write", func() {
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.ProcLabelField = "proc"
+		config.Procs = Procs{
+			{Name: "web", Cmd: []string{"bash", "-c", `printf 'line1\nline2\n{"msg":"line3"}\n'`}},
+		}
+
+		var mu sync.Mutex
+		writes := []string{}
+		writer := funcWriter(func(b []byte) (int, error) {
+			mu.Lock()
+			writes = append(writes, string(b))
+			mu.Unlock()
+			return len(b), nil
+		})
+
+		logFilter := NewLogFilter(config, nil, writer, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(HaveOccurred())
+
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(writes).To(Equal([]string{
+			"[web] line1\n",
+			"[web] line2\n",
+			`{"proc":"web","msg":"line3"}` + "\n",
+		}))
+	})
+
+	It("should buffer the output and flush it after the lines are written", func() {
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.OutputBufferSize = 4096
+		config.OutputFlushInterval = time.Hour
+		config.FullOutputFilename = filepath.Join(tmpDir, "logfilter.log")
+
+		var mu sync.Mutex
+		writes := []string{}
+		writer := funcWriter(func(b []byte) (int, error) {
+			mu.Lock()
+			writes = append(writes, string(b))
+			mu.Unlock()
+			return len(b), nil
+		})
+
+		logFilter := NewLogFilter(config, strings.NewReader(input), writer, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("reading stdin: EOF"))
+
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(writes).To(Equal([]string{input}))
+
+		fullOutput, err := ioutil.ReadFile(config.FullOutputFilename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(fullOutput)).To(Equal(input))
+	})
+
+	It("should flush the buffered output every flush interval", func() {
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.OutputBufferSize = 4096
+		config.OutputFlushInterval = 10 * time.Millisecond
+
+		inputReader, inputWriter := io.Pipe()
+
+		output := &syncBuffer{}
+
+		logFilter := NewLogFilter(config, inputReader, output, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		_, err := inputWriter.Write([]byte(input))
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(output.String).Should(Equal(input))
+
+		inputWriter.Close()
+
+		Eventually(done).Should(Receive(MatchError("reading stdin: EOF")))
+	})
+})
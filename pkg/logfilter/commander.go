@@ -6,12 +6,75 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
 )
 
+// CommanderOptions contains the optional settings of the command process.
+type CommanderOptions struct {
+	// Stdin is connected to the command stdin. If nil the command reads from
+	// the null device.
+	Stdin io.Reader
+
+	// Env contains KEY=VALUE pairs that are added to the inherited environment
+	// and override the inherited variables with the same key.
+	Env []string
+
+	// StripEnvPrefix removes the inherited environment variables starting with
+	// the prefix (e.g. LOGFILTER_). Env is applied after the stripping.
+	StripEnvPrefix string
+
+	// Dir is the working directory of the command. If empty the command runs in
+	// the current directory.
+	Dir string
+
+	// User is the user name or uid the command runs as.
+	User string
+
+	// Group is the group name or gid the command runs as. If empty and User is
+	// set, the primary group of the user is used.
+	Group string
+
+	// Rlimits are the resource limits applied to the command (Linux only).
+	Rlimits Rlimits
+
+	// ExtraFiles are additional open files inherited by the command. Entry i
+	// becomes file descriptor 3+i.
+	ExtraFiles []*os.File
+
+	// RestartPolicy determines if the command is restarted after it exits. It
+	// can be RestartNever (default), RestartOnFailure or RestartAlways.
+	RestartPolicy string
+
+	// RestartDelay is the delay before the command is restarted.
+	RestartDelay time.Duration
+
+	// OnExit is called after each run of the command with the state after the
+	// exit. stopped is true if the command was stopped by the commander
+	// (shutdown or restart).
+	OnExit func(state CommanderState, stopped bool)
+}
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// ValidateRestartPolicy checks if the restart policy is known.
+func ValidateRestartPolicy(policy string) error {
+	switch policy {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+		return nil
+	}
+	return xerrors.Errorf("invalid restart policy: %s", policy)
+}
+
 // Commander starts the command.
 // It handles graceful shutdown with a timeout after which the command
 // is forcefully killed.
@@ -20,14 +83,46 @@ type Commander struct {
 	cmdShutdownTimeout time.Duration
 	stdout             io.Writer
 	stderr             io.Writer
+	options            CommanderOptions
 	logger             *logrus.Entry
+
+	mu               sync.Mutex
+	process          *os.Process
+	stop             chan struct{}
+	restartRequested bool
+	state            CommanderState
 }
 
+// CommanderState is a snapshot of the command process state.
+type CommanderState struct {
+	// Running is true while the command process is running.
+	Running bool
+	// PID is the process id of the running or the last process.
+	PID int
+	// StartedAt is the start time of the running or the last process.
+	StartedAt time.Time
+	// Restarts is the number of times the command was restarted.
+	Restarts int
+	// Exited is true if at least one process exited.
+	Exited bool
+	// ExitedAt is the exit time of the last exited process.
+	ExitedAt time.Time
+	// ExitCode is the exit code of the last exited process or -1 if it was
+	// terminated by a signal.
+	ExitCode int
+	// ExitError is the error of the last exited process.
+	ExitError string
+}
+
+// ErrCommandNotRunning is returned when the command process is not running.
+var ErrCommandNotRunning = xerrors.New("command is not running")
+
 func NewCommander(
 	cmd []string,
 	cmdShutdownTimeout time.Duration,
 	stdout io.Writer,
 	stderr io.Writer,
+	options CommanderOptions,
 	logger *logrus.Entry,
 ) *Commander {
 	logger = logger.WithFields(logrus.Fields{
@@ -39,11 +134,66 @@ func NewCommander(
 		cmdShutdownTimeout: cmdShutdownTimeout,
 		stdout:             stdout,
 		stderr:             stderr,
+		options:            options,
 		logger:             logger,
 	}
 }
 
+// Start starts the command and restarts it according to the restart policy.
+// It returns after the command exits and is not restarted or after the ctx is
+// done and the command is shut down.
 func (c *Commander) Start(ctx context.Context) error {
+	for {
+		started, err := c.run(ctx)
+		if !started || ctx.Err() != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		restartRequested := c.restartRequested
+		c.restartRequested = false
+		c.mu.Unlock()
+
+		if restartRequested {
+			c.logger.Info("Commander restarting command on request")
+			c.incRestarts()
+			continue
+		}
+
+		if !c.shouldRestart(err) {
+			return err
+		}
+
+		c.incRestarts()
+
+		c.logger.WithFields(logrus.Fields{
+			"restartDelay": c.options.RestartDelay,
+		}).Info("Commander restarting command")
+
+		timer := time.NewTimer(c.options.RestartDelay)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+func (c *Commander) shouldRestart(err error) bool {
+	switch c.options.RestartPolicy {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return err != nil
+	}
+	return false
+}
+
+// run runs the command once. started is false if the command could not be
+// started.
+func (c *Commander) run(ctx context.Context) (started bool, err error) {
 	cmdCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -52,39 +202,104 @@ func (c *Commander) Start(ctx context.Context) error {
 	c.logger.Info("Commander starting command")
 
 	cmd := exec.CommandContext(cmdCtx, c.cmd[0], c.cmd[1:]...)
-	cmd.Env = os.Environ()
+	cmd.Env = c.env()
+	cmd.Dir = c.options.Dir
+	cmd.Stdin = c.options.Stdin
 	cmd.Stdout = c.stdout
 	cmd.Stderr = c.stderr
+	cmd.ExtraFiles = c.options.ExtraFiles
+
+	if c.options.User != "" || c.options.Group != "" {
+		if err := setCmdCredential(cmd, c.options.User, c.options.Group); err != nil {
+			return false, xerrors.Errorf("failed to set command credential: %w", err)
+		}
+	}
+
+	var helper *rlimitHelper
+	if len(c.options.Rlimits) > 0 {
+		helper, err = newRlimitHelper(cmd, c.options.Rlimits)
+		if err != nil {
+			return false, xerrors.Errorf("failed to set command rlimits: %w", err)
+		}
+		defer helper.close()
+	}
 
 	if err := cmd.Start(); err != nil {
-		return err
+		return false, err
 	}
 
 	process := cmd.Process
+	stop := make(chan struct{})
+	stopped := int32(0)
+
+	c.mu.Lock()
+	c.process = process
+	c.stop = stop
+	c.state.Running = true
+	c.state.PID = process.Pid
+	c.state.StartedAt = time.Now()
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.process = nil
+		c.stop = nil
+		c.state.Running = false
+		c.state.Exited = true
+		c.state.ExitedAt = time.Now()
+		c.state.ExitCode = -1
+		if cmd.ProcessState != nil {
+			c.state.ExitCode = cmd.ProcessState.ExitCode()
+		}
+		c.state.ExitError = ""
+		if err != nil {
+			c.state.ExitError = err.Error()
+		}
+		state := c.state
+		c.mu.Unlock()
+
+		if c.options.OnExit != nil {
+			c.options.OnExit(state, atomic.LoadInt32(&stopped) == 1)
+		}
+	}()
+
+	if helper != nil {
+		// the helper executes the command after the limits are in place
+		if err := helper.start(process.Pid); err != nil {
+			_ = process.Kill()
+			_ = cmd.Wait()
+			return false, xerrors.Errorf("failed to set command rlimits: %w", err)
+		}
+	}
 
 	go func() {
 		select {
 		case <-ctx.Done():
-			c.logger.WithFields(logrus.Fields{
-				"cmdShutdownTimeout": c.cmdShutdownTimeout,
-			}).Info("Commander gracefully shutting down")
+		case <-stop:
+		case <-cmdExited:
+			return
+		}
+
+		atomic.StoreInt32(&stopped, 1)
 
-			_ = process.Signal(syscall.SIGINT)
+		c.logger.WithFields(logrus.Fields{
+			"cmdShutdownTimeout": c.cmdShutdownTimeout,
+		}).Info("Commander gracefully shutting down")
 
-			timer := time.NewTimer(c.cmdShutdownTimeout)
+		_ = process.Signal(syscall.SIGINT)
 
-			select {
-			case <-timer.C:
-				c.logger.Warn("Commander forcefully shutting down")
-				cancel()
-			case <-cmdExited:
-				timer.Stop()
-			}
+		timer := time.NewTimer(c.cmdShutdownTimeout)
+
+		select {
+		case <-timer.C:
+			c.logger.Warn("Commander forcefully shutting down")
+			cancel()
 		case <-cmdExited:
+			timer.Stop()
 		}
 	}()
 
-	err := cmd.Wait()
+	err = cmd.Wait()
 
 	cmdExited <- struct{}{}
 
@@ -94,5 +309,81 @@ func (c *Commander) Start(ctx context.Context) error {
 		c.logger.WithError(err).Info("Commander command exited with error")
 	}
 
-	return err
+	return true, err
+}
+
+// State returns a snapshot of the command process state.
+func (c *Commander) State() CommanderState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
+}
+
+func (c *Commander) incRestarts() {
+	c.mu.Lock()
+	c.state.Restarts++
+	c.mu.Unlock()
+}
+
+// Restart gracefully stops the running command and starts it again regardless
+// of the restart policy.
+func (c *Commander) Restart() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stop == nil {
+		return ErrCommandNotRunning
+	}
+
+	c.restartRequested = true
+	close(c.stop)
+	c.stop = nil
+
+	return nil
+}
+
+// Signal sends the signal to the running command.
+func (c *Commander) Signal(sig os.Signal) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.process == nil {
+		return ErrCommandNotRunning
+	}
+
+	return c.process.Signal(sig)
+}
+
+// env builds the command environment from the inherited environment and the
+// options.
+func (c *Commander) env() []string {
+	env := []string{}
+	indexes := map[string]int{}
+
+	add := func(kv string) {
+		key := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			key = kv[:i]
+		}
+		if i, ok := indexes[key]; ok {
+			env[i] = kv
+			return
+		}
+		indexes[key] = len(env)
+		env = append(env, kv)
+	}
+
+	for _, kv := range os.Environ() {
+		if c.options.StripEnvPrefix != "" && strings.HasPrefix(kv, c.options.StripEnvPrefix) {
+			continue
+		}
+		add(kv)
+	}
+
+	for _, kv := range c.options.Env {
+		add(kv)
+	}
+
+	return env
 }
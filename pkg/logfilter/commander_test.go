@@ -1,8 +1,13 @@
 package logfilter_test
 
 import (
+	"bytes"
 	"context"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -23,7 +28,7 @@ var _ = Describe("Commander", func() {
 
 	Describe("Start", func() {
 		It("should start the command", func() {
-			c := NewCommander([]string{"/bin/sh", "-c", defaultScript}, 500*time.Millisecond, ioutil.Discard, ioutil.Discard, Logger)
+			c := NewCommander([]string{"/bin/sh", "-c", defaultScript}, 500*time.Millisecond, ioutil.Discard, ioutil.Discard, CommanderOptions{}, Logger)
 			ctx, cancel := context.WithTimeout(TestCtx, 1*time.Second)
 			defer cancel()
 
@@ -40,7 +45,7 @@ var _ = Describe("Commander", func() {
 				done
 			`
 
-			c := NewCommander([]string{"/bin/sh", "-c", script}, 1200*time.Millisecond, ioutil.Discard, ioutil.Discard, Logger)
+			c := NewCommander([]string{"/bin/sh", "-c", script}, 1200*time.Millisecond, ioutil.Discard, ioutil.Discard, CommanderOptions{}, Logger)
 			ctx, cancel := context.WithTimeout(TestCtx, 500*time.Millisecond)
 			defer cancel()
 
@@ -48,5 +53,102 @@ var _ = Describe("Commander", func() {
 			Expect(c.Start(ctx)).To(HaveOccurred())
 			Expect(time.Since(start)).To(BeNumerically(">", 600*time.Millisecond))
 		})
+
+		It("should restart the command on failure", func() {
+			tmpDir, err := ioutil.TempDir("", "logfilter-test-")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			counterPath := filepath.Join(tmpDir, "counter")
+			script := `echo x >> "$0"; [ "$(wc -l < "$0")" -ge 3 ]`
+
+			c := NewCommander([]string{"/bin/sh", "-c", script, counterPath}, 500*time.Millisecond, ioutil.Discard, ioutil.Discard, CommanderOptions{
+				RestartPolicy: RestartOnFailure,
+				RestartDelay:  10 * time.Millisecond,
+			}, Logger)
+
+			Expect(c.Start(TestCtx)).NotTo(HaveOccurred())
+
+			counter, err := ioutil.ReadFile(counterPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(counter)).To(Equal("x\nx\nx\n"))
+		})
+
+		It("should override and strip the environment variables", func() {
+			os.Setenv("LOGFILTERTEST_STRIPPED", "stripped")
+			defer os.Unsetenv("LOGFILTERTEST_STRIPPED")
+			os.Setenv("LOGFILTERTESTKEPT", "kept")
+			defer os.Unsetenv("LOGFILTERTESTKEPT")
+
+			stdout := bytes.NewBuffer(nil)
+
+			c := NewCommander([]string{"/bin/sh", "-c", "env"}, 500*time.Millisecond, stdout, ioutil.Discard, CommanderOptions{
+				Env:            []string{"LOGFILTERTEST_ADDED=added", "LOGFILTERTESTKEPT=overridden"},
+				StripEnvPrefix: "LOGFILTERTEST_",
+			}, Logger)
+
+			Expect(c.Start(TestCtx)).NotTo(HaveOccurred())
+
+			env := strings.Split(stdout.String(), "\n")
+			Expect(env).NotTo(ContainElement("LOGFILTERTEST_STRIPPED=stripped"))
+			Expect(env).NotTo(ContainElement("LOGFILTERTESTKEPT=kept"))
+			Expect(env).To(ContainElement("LOGFILTERTESTKEPT=overridden"))
+			Expect(env).To(ContainElement("LOGFILTERTEST_ADDED=added"))
+		})
+
+		It("should forward stdin and run in the working directory", func() {
+			tmpDir, err := ioutil.TempDir("", "logfilter-test-")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			stdout := bytes.NewBuffer(nil)
+
+			c := NewCommander([]string{"/bin/sh", "-c", "cat; pwd"}, 500*time.Millisecond, stdout, ioutil.Discard, CommanderOptions{
+				Stdin: strings.NewReader("input\n"),
+				Dir:   tmpDir,
+			}, Logger)
+
+			Expect(c.Start(TestCtx)).NotTo(HaveOccurred())
+
+			realTmpDir, err := filepath.EvalSymlinks(tmpDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stdout.String()).To(Equal("input\n" + realTmpDir + "\n"))
+		})
+
+		It("should set the command rlimits", func() {
+			if runtime.GOOS != "linux" {
+				Skip("rlimits are only supported on linux")
+			}
+
+			stdout := bytes.NewBuffer(nil)
+
+			c := NewCommander([]string{"/bin/sh", "-c", "ulimit -n; ulimit -Hn; echo ${LOGFILTER_RLIMIT_HELPER:-unset}"}, 500*time.Millisecond, stdout, ioutil.Discard, CommanderOptions{
+				Rlimits: Rlimits{{Resource: "nofile", Soft: 123, Hard: 456}},
+			}, Logger)
+
+			Expect(c.Start(TestCtx)).NotTo(HaveOccurred())
+
+			Expect(stdout.String()).To(Equal("123\n456\nunset\n"))
+		})
+
+		It("should fail for an unknown user", func() {
+			c := NewCommander([]string{"/bin/sh", "-c", "true"}, 500*time.Millisecond, ioutil.Discard, ioutil.Discard, CommanderOptions{
+				User: "logfilter-nonexistent-user",
+			}, Logger)
+
+			err := c.Start(TestCtx)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("failed to lookup user"))
+		})
+
+		It("should require a group for a uid without a passwd entry", func() {
+			c := NewCommander([]string{"/bin/sh", "-c", "true"}, 500*time.Millisecond, ioutil.Discard, ioutil.Discard, CommanderOptions{
+				User: "3999999",
+			}, Logger)
+
+			err := c.Start(TestCtx)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("group must be set for a user without a passwd entry: 3999999"))
+		})
 	})
 })
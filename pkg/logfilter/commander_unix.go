@@ -0,0 +1,94 @@
+//go:build !windows
+// +build !windows
+
+package logfilter
+
+import (
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/xerrors"
+)
+
+func setCmdCredential(cmd *exec.Cmd, userName string, groupName string) error {
+	credential := &syscall.Credential{
+		Uid: uint32(syscall.Getuid()),
+		Gid: uint32(syscall.Getgid()),
+	}
+
+	if userName != "" {
+		u, err := lookupUser(userName)
+		if err != nil {
+			return err
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return xerrors.Errorf("invalid uid: %s: %w", u.Uid, err)
+		}
+		credential.Uid = uint32(uid)
+
+		if u.Gid == "" {
+			// the group of logfilter must not be used for the user
+			if groupName == "" {
+				return xerrors.Errorf("group must be set for a user without a passwd entry: %s", userName)
+			}
+		} else {
+			gid, err := strconv.ParseUint(u.Gid, 10, 32)
+			if err != nil {
+				return xerrors.Errorf("invalid gid: %s: %w", u.Gid, err)
+			}
+			credential.Gid = uint32(gid)
+		}
+	}
+
+	if groupName != "" {
+		g, err := lookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.ParseUint(g.Gid, 10, 32)
+		if err != nil {
+			return xerrors.Errorf("invalid gid: %s: %w", g.Gid, err)
+		}
+		credential.Gid = uint32(gid)
+	}
+
+	// drop the supplementary groups of logfilter
+	credential.Groups = []uint32{}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = credential
+
+	return nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		u, err := user.LookupId(name)
+		if err == nil {
+			return u, nil
+		}
+		// numeric uid without a passwd entry has no primary group
+		return &user.User{Uid: name}, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to lookup user: %s: %w", name, err)
+	}
+	return u, nil
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return &user.Group{Gid: name}, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to lookup group: %s: %w", name, err)
+	}
+	return g, nil
+}
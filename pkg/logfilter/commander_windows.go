@@ -0,0 +1,11 @@
+package logfilter
+
+import (
+	"os/exec"
+
+	"golang.org/x/xerrors"
+)
+
+func setCmdCredential(cmd *exec.Cmd, userName string, groupName string) error {
+	return xerrors.Errorf("running the command as a different user is not supported on windows")
+}
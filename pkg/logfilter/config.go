@@ -1,9 +1,27 @@
 package logfilter
 
 import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kballard/go-shellquote"
+	"golang.org/x/xerrors"
+)
+
+// EnvPrefix is the prefix of the logfilter environment variables.
+const EnvPrefix = "LOGFILTER_"
+
+const (
+	FDOutputStdout = "stdout"
+	FDOutputFull   = "full"
+)
+
+const (
+	ProcsExitShutdown = "shutdown"
+	ProcsExitContinue = "continue"
 )
 
 // Config contains the configuration for the logfilter
@@ -20,6 +38,235 @@ type Config struct {
 	// (LOGFILTER_CMDSHUTDOWNTIMEOUT)
 	CmdShutdownTimeout time.Duration `default:"10s"`
 
+	// CmdRestartPolicy determines if the command is restarted after it exits.
+	// It can be "never", "on-failure" or "always".
+	// (LOGFILTER_CMDRESTARTPOLICY)
+	CmdRestartPolicy string `default:"never"`
+
+	// CmdRestartDelay is the delay before the command is restarted.
+	// (LOGFILTER_CMDRESTARTDELAY)
+	CmdRestartDelay time.Duration `default:"1s"`
+
+	// Procs are multiple commands that logfilter runs concurrently instead of
+	// Cmd. It is a JSON array of objects with the fields "name", "cmd", "env",
+	// "dir", "excludeTemplate", "filterQuery", "restartPolicy" and
+	// "restartDelay". If a process has no filter the global ExcludeTemplate or
+	// FilterQuery is used. The other Cmd* settings apply to all processes.
+	// (LOGFILTER_PROCS)
+	Procs Procs
+
+	// ProcsExitPolicy determines what happens when one of the Procs exits and is
+	// not restarted. "shutdown" stops the other processes and logfilter,
+	// "continue" keeps the other processes running until all of them exit.
+	// (LOGFILTER_PROCSEXITPOLICY)
+	ProcsExitPolicy string `default:"shutdown"`
+
+	// ProcLabelField is the name of the field with the process name that is
+	// added to the JSON lines of the Procs. Plaintext lines are prefixed with
+	// "[name] ". If empty the lines are not labeled.
+	// (LOGFILTER_PROCLABELFIELD)
+	ProcLabelField string `default:"process"`
+
+	// CmdStdin forwards the logfilter stdin to the command. It is ignored if no
+	// command is specified.
+	// (LOGFILTER_CMDSTDIN)
+	CmdStdin bool
+
+	// CmdEnv contains additional environment variables for the command as
+	// KEY=VALUE pairs separated using spaces. Pairs can be quoted. The variables
+	// override the inherited environment variables.
+	// (LOGFILTER_CMDENV)
+	CmdEnv CmdEnv
+
+	// CmdStripEnv removes logfilter's own LOGFILTER_* environment variables from
+	// the command environment. CmdEnv variables are still added.
+	// (LOGFILTER_CMDSTRIPENV)
+	CmdStripEnv bool
+
+	// CmdDir is the working directory of the command. If empty the command runs
+	// in the logfilter working directory.
+	// (LOGFILTER_CMDDIR)
+	CmdDir string
+
+	// CmdUser is the user name or uid the command runs as. Logfilter must have
+	// the permissions to change the user. CmdGroup is required for a uid
+	// without a passwd entry.
+	// (LOGFILTER_CMDUSER)
+	CmdUser string
+
+	// CmdGroup is the group name or gid the command runs as. If empty and
+	// CmdUser is set, the primary group of the user is used.
+	// (LOGFILTER_CMDGROUP)
+	CmdGroup string
+
+	// CmdRlimits are the resource limits of the command (Linux only). Limits are
+	// specified as `resource=soft[:hard]` separated using spaces, e.g.
+	// `nofile=1024:4096 core=0`. Values can be `unlimited`. The command is
+	// started through the logfilter binary which executes the command after the
+	// limits are applied, so the binary must be executable by CmdUser and it
+	// must call RunRlimitHelper at the start of main.
+	// (LOGFILTER_CMDRLIMITS)
+	CmdRlimits Rlimits
+
+	// FD is the file descriptor number (3 or greater) of an additional pipe
+	// passed to the command for structured logs. The lines written to the pipe
+	// are filtered separately from stdout and stderr. If 0 no pipe is created.
+	// (LOGFILTER_FD)
+	FD int
+
+	// FDEnv is the name of the environment variable that announces the FD
+	// number to the command. If empty the variable is not set.
+	// (LOGFILTER_FDENV)
+	FDEnv string `default:"LOGFILTER_FD"`
+
+	// FDExcludeTemplate is the ExcludeTemplate for the FD lines.
+	// (LOGFILTER_FDEXCLUDETEMPLATE)
+	FDExcludeTemplate string
+
+	// FDFilterQuery is the FilterQuery for the FD lines.
+	// (LOGFILTER_FDFILTERQUERY)
+	FDFilterQuery string
+
+	// FDOutput is the output of the included FD lines. It can be "stdout" or
+	// "full" (full output file only).
+	// (LOGFILTER_FDOUTPUT)
+	FDOutput string `default:"stdout"`
+
+	// Triggers are rules that perform an action when a line matches a condition
+	// a number of times within a window. It is a JSON array of objects with the
+	// fields:
+	//   "name": name of the trigger (required)
+	//   "matchTemplate": Go text/template, the line matches if it renders "true"
+	//   "matchQuery": JQ query, the line matches if it outputs a value
+	//   "threshold": number of matches needed to fire (default 1)
+	//   "window": duration in which the threshold must be reached (e.g. "1m"),
+	//     if empty all matches since the last firing are counted
+	//   "cooldown": minimum duration between two firings
+	//   "action": "hook", "signal", "restart" or "unhealthy"
+	//   "hook": command for the "hook" action, the matching lines are written to
+	//     its stdin
+	//   "hookTimeout": timeout of the hook command (default "30s")
+	//   "signal": signal name for the "signal" action (e.g. "SIGUSR1")
+	//   "proc": name of the proc to signal or restart, defaults to the proc that
+	//     wrote the line
+	//   "unhealthyDuration": how long the "unhealthy" action marks logfilter
+	//     unhealthy, if empty until logfilter exits
+	// Triggers evaluate both included and excluded lines.
+	// (LOGFILTER_TRIGGERS)
+	Triggers Triggers
+
+	// StallTimeout is the duration without any lines from the command (or
+	// stdin) after which the watchdog reports a stall. A stall is logged, marks
+	// logfilter unhealthy until the lines resume and optionally emits a JSON line
+	// to stdout and restarts the command. If 0 stalls are not detected.
+	// (LOGFILTER_STALLTIMEOUT)
+	StallTimeout time.Duration
+
+	// StallStreams are the comma separated streams ("stdin", "stdout", "stderr"
+	// or "fd") that are watched for stalls. Each listed stream is watched
+	// separately so a chatty stream does not hide the stall of another stream.
+	// If empty all streams of a command are watched together and a stall is
+	// reported only when none of them writes any lines.
+	// (LOGFILTER_STALLSTREAMS)
+	StallStreams []string
+
+	// StallLine emits a JSON line to stdout when a stall is detected.
+	// (LOGFILTER_STALLLINE)
+	StallLine bool `default:"true"`
+
+	// StallRestart restarts the command when a stall is detected.
+	// (LOGFILTER_STALLRESTART)
+	StallRestart bool
+
+	// HeartbeatInterval is the interval of the heartbeat JSON lines emitted to
+	// stdout with the time since the last line of each stream. If 0 no heartbeat
+	// lines are emitted.
+	// (LOGFILTER_HEARTBEATINTERVAL)
+	HeartbeatInterval time.Duration
+
+	// ReadyTemplate is a Go text/template. The /readyz endpoint of the debug
+	// server reports ready after the first line for which the template renders
+	// "true". The line is required again after the command exits.
+	// (LOGFILTER_READYTEMPLATE)
+	ReadyTemplate string
+
+	// ReadyQuery is a JQ query. The /readyz endpoint of the debug server reports
+	// ready after the first line for which the query outputs a value. The line
+	// is required again after the command exits.
+	// (LOGFILTER_READYQUERY)
+	ReadyQuery string
+
+	// ReadyOnExit makes the /readyz endpoint report ready only after the command
+	// exited successfully. It is useful for one-off commands that are restarted
+	// or run together with other Procs.
+	// (LOGFILTER_READYONEXIT)
+	ReadyOnExit bool
+
+	// ContextTemplate is a Go text/template. If it renders "true" for an
+	// included line (e.g. an error) the recently excluded lines of the same
+	// command are written before it as context (flight recorder).
+	// (LOGFILTER_CONTEXTTEMPLATE)
+	ContextTemplate string
+
+	// ContextQuery is a JQ query. If it outputs a value for an included line the
+	// recently excluded lines of the same command are written before it as
+	// context.
+	// (LOGFILTER_CONTEXTQUERY)
+	ContextQuery string
+
+	// ContextBefore is the number of the excluded lines kept in memory and
+	// written before the matching line (like grep -B).
+	// (LOGFILTER_CONTEXTBEFORE)
+	ContextBefore int `default:"10"`
+
+	// ContextAfter is the number of the lines after the matching line for which
+	// the excluded lines are written (like grep -A).
+	// (LOGFILTER_CONTEXTAFTER)
+	ContextAfter int
+
+	// ContextField is the field added to the JSON context lines with the value
+	// "before" or "after". Other context lines are prefixed with "[context] ".
+	// (LOGFILTER_CONTEXTFIELD)
+	ContextField string `default:"logfilterContext"`
+
+	// CorrelationField is a JQ path of the correlation ID (e.g.
+	// .Properties.RequestId or .trace_id). If set the excluded lines with a
+	// correlation ID are buffered by the ID and all the buffered lines of the ID
+	// are written as context when a line of the ID matches the context condition
+	// (ContextTemplate or ContextQuery). The following excluded lines of the ID
+	// are written until the ID expires.
+	// (LOGFILTER_CORRELATIONFIELD)
+	CorrelationField string
+
+	// CorrelationTTL is the duration since the last line of a correlation ID
+	// after which its buffered lines are discarded.
+	// (LOGFILTER_CORRELATIONTTL)
+	CorrelationTTL time.Duration `default:"1m"`
+
+	// CorrelationMaxBytes is the maximum size of the buffered lines of all the
+	// correlation IDs. The least recently active IDs are discarded first.
+	// (LOGFILTER_CORRELATIONMAXBYTES)
+	CorrelationMaxBytes int `default:"16777216"`
+
+	// CrashDumpLines is the number of the last lines (both included and
+	// excluded) of each command stream kept in memory. After the command exits
+	// with an error (and it was not stopped by the logfilter) the lines are
+	// written as a JSON crash report together with the exit status. If 0 no
+	// lines are kept.
+	// (LOGFILTER_CRASHDUMPLINES)
+	CrashDumpLines int
+
+	// CrashDumpFile is the file the crash reports are appended to. If empty the
+	// crash reports are written to stderr.
+	// (LOGFILTER_CRASHDUMPFILE)
+	CrashDumpFile string
+
+	// WriterStuckTimeout is the duration of a single write to stdout or to the
+	// full output file after which the /healthz endpoint reports the writer as
+	// stuck.
+	// (LOGFILTER_WRITERSTUCKTIMEOUT)
+	WriterStuckTimeout time.Duration `default:"30s"`
+
 	// ExcludeTemplate is a Go text/template. If it renders a value "true" the
 	// following JSON will be excluded from the stdout. The template can render
 	// multiple "true" values to simplify the exclusion logic.
@@ -31,10 +278,67 @@ type Config struct {
 	// (LOGFILTER_FILTER_QUERY)
 	FilterQuery string
 
-	// DebugListenAddr is the address of the HTTP debug (pprof) server
+	// DebugListenAddr is the address of the HTTP debug server. It serves pprof
+	// and the /healthz, /readyz, /status and /tail endpoints. Use port 0 (e.g.
+	// localhost:0) for an ephemeral port (the actual address is logged) or
+	// unix:/path/to/socket for a Unix socket. An existing socket is replaced
+	// only if no process is listening on it.
 	// (LOGFILTER_DEBUGLISTENADDR).
 	DebugListenAddr string `default:"localhost:4083"`
 
+	// DebugDisabled disables the HTTP debug server.
+	// (LOGFILTER_DEBUGDISABLED)
+	DebugDisabled bool
+
+	// DebugToken protects all the debug server endpoints with a bearer token.
+	// The requests must contain the header `Authorization: Bearer <token>`.
+	// (LOGFILTER_DEBUGTOKEN)
+	DebugToken string
+
+	// BufferLines is the maximum number of lines buffered between reading the
+	// lines and writing them. A slow output blocks reading the command output
+	// only after the buffer is full.
+	// (LOGFILTER_BUFFERLINES)
+	BufferLines int `default:"1000"`
+
+	// BufferBytes is the maximum size of the lines in the buffer. If 0 the size
+	// is not limited.
+	// (LOGFILTER_BUFFERBYTES)
+	BufferBytes int64 `default:"16777216"`
+
+	// BufferPolicy determines what happens when the buffer is full. It can be
+	// block (wait for the output, default), drop-newest, drop-oldest or
+	// drop-excluded (drop the new lines that would be excluded by the filter and
+	// wait for the others). The dropped lines are not written to the full
+	// output either and they are counted in the /status endpoint.
+	// (LOGFILTER_BUFFERPOLICY)
+	BufferPolicy string `default:"block"`
+
+	// SpoolDir enables the disk spool in front of stdout. When the writes to
+	// stdout cannot keep up the lines are appended to a spool file in the
+	// directory and written to stdout in order once stdout drains. The spool
+	// size and lag are reported in the /status endpoint.
+	// (LOGFILTER_SPOOLDIR)
+	SpoolDir string
+
+	// SpoolMaxBytes is the maximum size of the spool file. The space of the
+	// replayed data is reused. When the spool file is full the writing blocks
+	// until enough data is replayed (see BufferPolicy).
+	// (LOGFILTER_SPOOLMAXBYTES)
+	SpoolMaxBytes int64 `default:"1073741824"`
+
+	// DrainTimeout is the deadline for writing the in-flight lines after the
+	// shutdown started. It includes the command shutdown so it should be longer
+	// than CmdShutdownTimeout. After the deadline the remaining lines are lost.
+	// If 0 there is no deadline.
+	// (LOGFILTER_DRAINTIMEOUT)
+	DrainTimeout time.Duration `default:"30s"`
+
+	// TailBufferSize is the number of lines buffered for each /tail subscriber.
+	// The lines are dropped for the subscribers that are too slow.
+	// (LOGFILTER_TAILBUFFERSIZE)
+	TailBufferSize int `default:"1000"`
+
 	// FullOutputFilename is file to write the full logs to. Backup log files will
 	// be retained in the same directory. If empty the full output will be
 	// discarded.
@@ -65,10 +369,129 @@ type Config struct {
 	// (LOGFILTER_FULLOUTPUTCOMPRESS)
 	FullOutputCompress bool
 
+	// FullOutputRotateInterval rotates the full output file also every hour
+	// ("hourly") or day ("daily") at the wall-clock boundaries in
+	// FullOutputTimeZone. The period is added to the file name (e.g.
+	// logfilter-2020-08-18.log) and the file of a period is still rotated by
+	// FullOutputMaxSizeMB. If empty the file is rotated only by size.
+	// (LOGFILTER_FULLOUTPUTROTATEINTERVAL)
+	FullOutputRotateInterval string
+
+	// FullOutputTimeZone is the time zone of the rotation periods, e.g.
+	// "Europe/Ljubljana" or "Local".
+	// (LOGFILTER_FULLOUTPUTTIMEZONE)
+	FullOutputTimeZone string `default:"UTC"`
+
+	// FullOutputMaxTotalSizeMB is the maximum total size in megabytes of the
+	// full output file and its backups. The oldest backups are removed first
+	// when the total size is exceeded, the file being written is never removed.
+	// It must not be less than FullOutputMaxSizeMB. The default is no limit.
+	// (LOGFILTER_FULLOUTPUTMAXTOTALSIZEMB)
+	FullOutputMaxTotalSizeMB int
+
+	// FullOutputMinFreeMB is the minimum free space in megabytes of the
+	// filesystem of the full output file. The full output lines are skipped
+	// (and counted in /status) while the free space is below the minimum or
+	// after a write failed because the filesystem is full, and the writing is
+	// resumed once there is enough free space. Only supported on linux. The
+	// default is not to check the free space.
+	// (LOGFILTER_FULLOUTPUTMINFREEMB)
+	FullOutputMinFreeMB int
+
+	// OutputReopenSignal is the signal that reopens or rotates (see
+	// OutputReopenAction) the full output file and the file Outputs, e.g. for
+	// logrotate. If empty SIGUSR1 is used (except on Windows), "none" disables
+	// the signal. The files can also be reopened using the /outputs/reopen and
+	// /outputs/rotate endpoints of the debug server.
+	// (LOGFILTER_OUTPUTREOPENSIGNAL)
+	OutputReopenSignal string
+
+	// OutputReopenAction is the action of OutputReopenSignal. "reopen" closes
+	// the files and opens them again on the next write (for the logrotate
+	// "create" and "copytruncate" modes) and "rotate" rotates the files like
+	// when they reach the maximum size.
+	// (LOGFILTER_OUTPUTREOPENACTION)
+	OutputReopenAction string `default:"reopen"`
+
+	// FullOutputExcludeTemplate is the ExcludeTemplate for the full output
+	// file. It is independent of the stdout filter.
+	// (LOGFILTER_FULLOUTPUTEXCLUDETEMPLATE)
+	FullOutputExcludeTemplate string
+
+	// FullOutputFilterQuery is the FilterQuery for the full output file.
+	// (LOGFILTER_FULLOUTPUTFILTERQUERY)
+	FullOutputFilterQuery string
+
+	// FullOutputExcludeRegex is a regular expression matching the lines that
+	// are not written to the full output file. It cannot be used together with
+	// FullOutputExcludeTemplate or FullOutputFilterQuery. If all are empty all
+	// lines are written to the full output file.
+	// (LOGFILTER_FULLOUTPUTEXCLUDEREGEX)
+	FullOutputExcludeRegex string
+
+	// Outputs are the named outputs the included lines can be routed to. It is
+	// a JSON array of objects with the fields:
+	//   "name": name of the output (required, "stdout" and "full" are the
+	//     built-in outputs)
+	//   "type": "stdout", "stderr" or "file"
+	//   "filename": file to write the lines to for the "file" type
+	//   "maxSizeMB": size in megabytes of the file before it gets rotated
+	//     (default 100)
+	//   "maxAgeDays": maximum number of days to retain the rotated files
+	//   "maxBackups": maximum number of the rotated files to retain
+	//   "compress": compress the rotated files using gzip
+	//   "rotateInterval": "hourly" or "daily" to also rotate by time (see
+	//     FullOutputRotateInterval)
+	//   "timeZone": time zone of the rotation periods (default "UTC")
+	// (LOGFILTER_OUTPUTS)
+	Outputs Outputs
+
+	// Routes are the rules that write the included lines to the outputs. It is
+	// a JSON array of objects with the fields:
+	//   "matchTemplate": Go text/template, the line matches if it renders "true"
+	//   "matchQuery": JQ query, the line matches if it outputs a value
+	//   "matchRegex": regular expression, the line matches if it matches
+	//   "outputs": names of the outputs (required)
+	// A route without a condition matches all lines. The included lines that
+	// do not match any route are written to stdout. The routes cannot write to
+	// the full output, its lines are selected by FullOutputExcludeTemplate,
+	// FullOutputFilterQuery or FullOutputExcludeRegex.
+	// (LOGFILTER_ROUTES)
+	Routes Routes
+
+	// RouteMode determines which routes are used for a line. It can be "first"
+	// (the first matching route) or "all" (all matching routes).
+	// (LOGFILTER_ROUTEMODE)
+	RouteMode string `default:"first"`
+
+	// FilterWorkers is the number of goroutines evaluating the filters, the
+	// full output filter and the route conditions concurrently. The lines are
+	// still written in their original order. It must not be negative.
+	// (LOGFILTER_FILTERWORKERS)
+	FilterWorkers int `default:"1"`
+
+	// OutputBufferSize is the size of the buffer in front of stdout and the
+	// full output file. The buffered lines are written when the buffer is full
+	// and every OutputFlushInterval. The output is not buffered if 0.
+	// (LOGFILTER_OUTPUTBUFFERSIZE)
+	OutputBufferSize int
+
+	// OutputFlushInterval is the interval of writing the buffered lines.
+	// (LOGFILTER_OUTPUTFLUSHINTERVAL)
+	OutputFlushInterval time.Duration `default:"100ms"`
+
 	// MaxScanLineSize is the maximum size used to buffer lines.
 	// (LOGFILTER_MAXSCANLINESIZE)
 	MaxScanLineSize int `default:"52428800"`
 
+	// OversizedLinePolicy determines what happens with the lines longer than
+	// MaxScanLineSize. "truncate" writes the first MaxScanLineSize bytes of
+	// the line followed by a marker, "split" writes the line in chunks of
+	// MaxScanLineSize bytes as separate lines, "full" writes the line only to
+	// the full output and "fail" stops the logfilter.
+	// (LOGFILTER_OVERSIZEDLINEPOLICY)
+	OversizedLinePolicy string `default:"truncate"`
+
 	// LogLevel is the log level of the logfilter.
 	// (LOGFILTER_LOGLEVEL)
 	LogLevel string `default:"info"`
@@ -84,3 +507,360 @@ func (c *Cmd) Decode(value string) error {
 	*c = cmd
 	return nil
 }
+
+// UnmarshalJSON decodes the command either from a string or from an array of
+// arguments.
+func (c *Cmd) UnmarshalJSON(b []byte) error {
+	var value string
+	if err := json.Unmarshal(b, &value); err == nil {
+		return c.Decode(value)
+	}
+	var args []string
+	if err := json.Unmarshal(b, &args); err != nil {
+		return xerrors.Errorf("cmd must be a string or an array of strings: %w", err)
+	}
+	*c = args
+	return nil
+}
+
+// Duration is a time.Duration that is decoded from a JSON string like "1s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value string
+	if err := json.Unmarshal(b, &value); err != nil {
+		return xerrors.Errorf("duration must be a string: %w", err)
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Proc is one of multiple commands run by logfilter.
+type Proc struct {
+	Name            string   `json:"name"`
+	Cmd             Cmd      `json:"cmd"`
+	Env             []string `json:"env"`
+	Dir             string   `json:"dir"`
+	ExcludeTemplate string   `json:"excludeTemplate"`
+	FilterQuery     string   `json:"filterQuery"`
+	RestartPolicy   string   `json:"restartPolicy"`
+	RestartDelay    Duration `json:"restartDelay"`
+}
+
+// Procs are decoded from a JSON array.
+type Procs []Proc
+
+func (p *Procs) Decode(value string) error {
+	procs := Procs{}
+	if err := json.Unmarshal([]byte(value), &procs); err != nil {
+		return xerrors.Errorf("failed to parse procs: %w", err)
+	}
+
+	names := map[string]bool{}
+
+	for _, proc := range procs {
+		if proc.Name == "" {
+			return xerrors.Errorf("proc name must not be empty")
+		}
+		if names[proc.Name] {
+			return xerrors.Errorf("duplicate proc name: %s", proc.Name)
+		}
+		names[proc.Name] = true
+
+		if len(proc.Cmd) == 0 {
+			return xerrors.Errorf("proc cmd must not be empty: %s", proc.Name)
+		}
+		if err := ValidateRestartPolicy(proc.RestartPolicy); err != nil {
+			return xerrors.Errorf("proc %s: %w", proc.Name, err)
+		}
+	}
+
+	*p = procs
+	return nil
+}
+
+// CmdEnv contains KEY=VALUE environment variable pairs. Pairs are separated
+// using spaces and can be quoted.
+type CmdEnv []string
+
+func (e *CmdEnv) Decode(value string) error {
+	pairs, err := shellquote.Split(value)
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		if strings.IndexByte(pair, '=') <= 0 {
+			return xerrors.Errorf("invalid environment variable, expected KEY=VALUE: %s", pair)
+		}
+	}
+	*e = pairs
+	return nil
+}
+
+// RlimitInfinity is the value of an unlimited resource limit.
+const RlimitInfinity = ^uint64(0)
+
+// Rlimit is a resource limit of the command.
+type Rlimit struct {
+	Resource string
+	Soft     uint64
+	Hard     uint64
+}
+
+// Rlimits are resource limits in the format `resource=soft[:hard]` separated
+// using spaces (e.g. `nofile=1024:4096 core=0`). Values can be `unlimited`. If
+// the hard limit is omitted it is the same as the soft limit.
+type Rlimits []Rlimit
+
+func (r *Rlimits) Decode(value string) error {
+	rlimits := Rlimits{}
+
+	for _, field := range strings.Fields(value) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return xerrors.Errorf("invalid rlimit, expected resource=soft[:hard]: %s", field)
+		}
+
+		if rlimitResources == nil {
+			return xerrors.Errorf("rlimits are only supported on linux")
+		}
+
+		resource := strings.ToLower(parts[0])
+		if _, ok := rlimitResources[resource]; !ok {
+			return xerrors.Errorf("unknown rlimit resource: %s", parts[0])
+		}
+
+		limits := strings.SplitN(parts[1], ":", 2)
+
+		soft, err := parseRlimitValue(limits[0])
+		if err != nil {
+			return xerrors.Errorf("invalid rlimit soft limit: %s: %w", field, err)
+		}
+
+		hard := soft
+		if len(limits) == 2 {
+			hard, err = parseRlimitValue(limits[1])
+			if err != nil {
+				return xerrors.Errorf("invalid rlimit hard limit: %s: %w", field, err)
+			}
+		}
+
+		if soft > hard {
+			return xerrors.Errorf("rlimit soft limit is greater than hard limit: %s", field)
+		}
+
+		rlimits = append(rlimits, Rlimit{
+			Resource: resource,
+			Soft:     soft,
+			Hard:     hard,
+		})
+	}
+
+	*r = rlimits
+	return nil
+}
+
+func parseRlimitValue(value string) (uint64, error) {
+	if value == "unlimited" || value == "infinity" {
+		return RlimitInfinity, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+const (
+	TriggerActionHook      = "hook"
+	TriggerActionSignal    = "signal"
+	TriggerActionRestart   = "restart"
+	TriggerActionUnhealthy = "unhealthy"
+)
+
+// Trigger is a rule that performs an action when lines match a condition.
+type Trigger struct {
+	Name              string   `json:"name"`
+	MatchTemplate     string   `json:"matchTemplate"`
+	MatchQuery        string   `json:"matchQuery"`
+	Threshold         int      `json:"threshold"`
+	Window            Duration `json:"window"`
+	Cooldown          Duration `json:"cooldown"`
+	Action            string   `json:"action"`
+	Hook              Cmd      `json:"hook"`
+	HookTimeout       Duration `json:"hookTimeout"`
+	Signal            string   `json:"signal"`
+	Proc              string   `json:"proc"`
+	UnhealthyDuration Duration `json:"unhealthyDuration"`
+}
+
+// Triggers are decoded from a JSON array.
+type Triggers []Trigger
+
+func (t *Triggers) Decode(value string) error {
+	triggers := Triggers{}
+	if err := json.Unmarshal([]byte(value), &triggers); err != nil {
+		return xerrors.Errorf("failed to parse triggers: %w", err)
+	}
+
+	names := map[string]bool{}
+
+	for i := range triggers {
+		trigger := &triggers[i]
+
+		if trigger.Name == "" {
+			return xerrors.Errorf("trigger name must not be empty")
+		}
+		if names[trigger.Name] {
+			return xerrors.Errorf("duplicate trigger name: %s", trigger.Name)
+		}
+		names[trigger.Name] = true
+
+		if (trigger.MatchTemplate == "") == (trigger.MatchQuery == "") {
+			return xerrors.Errorf("trigger must have either matchTemplate or matchQuery: %s", trigger.Name)
+		}
+
+		if trigger.Threshold == 0 {
+			trigger.Threshold = 1
+		}
+		if trigger.Threshold < 0 {
+			return xerrors.Errorf("trigger threshold must be positive: %s", trigger.Name)
+		}
+
+		switch trigger.Action {
+		case TriggerActionHook:
+			if len(trigger.Hook) == 0 {
+				return xerrors.Errorf("trigger hook must not be empty: %s", trigger.Name)
+			}
+			if trigger.HookTimeout == 0 {
+				trigger.HookTimeout = Duration(30 * time.Second)
+			}
+		case TriggerActionSignal:
+			if _, err := ParseSignal(trigger.Signal); err != nil {
+				return xerrors.Errorf("trigger %s: %w", trigger.Name, err)
+			}
+		case TriggerActionRestart, TriggerActionUnhealthy:
+		default:
+			return xerrors.Errorf("invalid trigger action: %s: %s", trigger.Name, trigger.Action)
+		}
+	}
+
+	*t = triggers
+	return nil
+}
+
+const (
+	OutputTypeStdout = "stdout"
+	OutputTypeStderr = "stderr"
+	OutputTypeFile   = "file"
+)
+
+// Output is a named output the lines can be routed to.
+type Output struct {
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	Filename       string `json:"filename"`
+	MaxSizeMB      int    `json:"maxSizeMB"`
+	MaxAgeDays     int    `json:"maxAgeDays"`
+	MaxBackups     int    `json:"maxBackups"`
+	Compress       bool   `json:"compress"`
+	RotateInterval string `json:"rotateInterval"`
+	TimeZone       string `json:"timeZone"`
+	MaxTotalSizeMB int    `json:"maxTotalSizeMB"`
+	MinFreeMB      int    `json:"minFreeMB"`
+}
+
+// Outputs are decoded from a JSON array.
+type Outputs []Output
+
+func (o *Outputs) Decode(value string) error {
+	outputs := Outputs{}
+	if err := json.Unmarshal([]byte(value), &outputs); err != nil {
+		return xerrors.Errorf("failed to parse outputs: %w", err)
+	}
+
+	names := map[string]bool{}
+
+	for i := range outputs {
+		output := &outputs[i]
+
+		if output.Name == "" {
+			return xerrors.Errorf("output name must not be empty")
+		}
+		if output.Name == OutputStdout || output.Name == OutputFull {
+			return xerrors.Errorf("output name is reserved: %s", output.Name)
+		}
+		if names[output.Name] {
+			return xerrors.Errorf("duplicate output name: %s", output.Name)
+		}
+		names[output.Name] = true
+
+		switch output.Type {
+		case OutputTypeStdout, OutputTypeStderr:
+		case OutputTypeFile:
+			if output.Filename == "" {
+				return xerrors.Errorf("output filename must not be empty: %s", output.Name)
+			}
+			if output.MaxSizeMB == 0 {
+				output.MaxSizeMB = 100
+			}
+			if err := ValidateRotateInterval(output.RotateInterval); err != nil {
+				return xerrors.Errorf("output %s: %w", output.Name, err)
+			}
+			if err := ValidateMaxTotalSize(output.MaxTotalSizeMB, output.MaxSizeMB); err != nil {
+				return xerrors.Errorf("output %s: %w", output.Name, err)
+			}
+		default:
+			return xerrors.Errorf("invalid output type: %s: %s", output.Name, output.Type)
+		}
+	}
+
+	*o = outputs
+	return nil
+}
+
+// Route writes the included lines matching a condition to the outputs.
+type Route struct {
+	MatchTemplate string   `json:"matchTemplate"`
+	MatchQuery    string   `json:"matchQuery"`
+	MatchRegex    string   `json:"matchRegex"`
+	Outputs       []string `json:"outputs"`
+}
+
+// Routes are decoded from a JSON array.
+type Routes []Route
+
+func (r *Routes) Decode(value string) error {
+	routes := Routes{}
+	if err := json.Unmarshal([]byte(value), &routes); err != nil {
+		return xerrors.Errorf("failed to parse routes: %w", err)
+	}
+
+	for i, route := range routes {
+		conditions := 0
+		for _, condition := range []string{route.MatchTemplate, route.MatchQuery, route.MatchRegex} {
+			if condition != "" {
+				conditions++
+			}
+		}
+		if conditions > 1 {
+			return xerrors.Errorf("route must have at most one of matchTemplate, matchQuery or matchRegex: %d", i)
+		}
+		if len(route.Outputs) == 0 {
+			return xerrors.Errorf("route outputs must not be empty: %d", i)
+		}
+	}
+
+	*r = routes
+	return nil
+}
+
+// ParseSignal parses a signal name with or without the SIG prefix (e.g.
+// SIGUSR1 or USR1).
+func ParseSignal(name string) (os.Signal, error) {
+	sig, ok := signalsByName[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return nil, xerrors.Errorf("unknown signal: %s", name)
+	}
+	return sig, nil
+}
@@ -0,0 +1,144 @@
+package logfilter
+
+import (
+	"container/list"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/itchyny/gojq"
+	"golang.org/x/xerrors"
+)
+
+// correlationGroup are the buffered excluded lines with the same correlation
+// ID.
+type correlationGroup struct {
+	id       string
+	lines    []line
+	bytes    int
+	lastSeen time.Time
+	released bool
+	elem     *list.Element
+}
+
+// correlationBuffer buffers the excluded lines grouped by the correlation ID.
+// The groups expire after the TTL since their last line and the least
+// recently active groups are discarded when the buffered lines exceed the
+// memory cap. It is not safe for concurrent use.
+type correlationBuffer struct {
+	code *gojq.Code
+	// fields are the top-level fields used by the correlation field query or
+	// nil if the query needs the whole document
+	fields   map[string]struct{}
+	ttl      time.Duration
+	maxBytes int
+
+	bytes  int
+	groups map[string]*correlationGroup
+	// order contains the groups from the least to the most recently active
+	order *list.List
+}
+
+func newCorrelationBuffer(field string, ttl time.Duration, maxBytes int) (*correlationBuffer, error) {
+	query, err := gojq.Parse(field)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse correlation field: %s: %w", field, err)
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to compile correlation field: %s: %w", field, err)
+	}
+
+	fields, _ := queryFields(query)
+
+	return &correlationBuffer{
+		code:     code,
+		fields:   fields,
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		groups:   map[string]*correlationGroup{},
+		order:    list.New(),
+	}, nil
+}
+
+// id returns the correlation ID of the line or false if the line is not JSON
+// or it has no correlation ID.
+func (c *correlationBuffer) id(e *event) (string, bool) {
+	input, err := e.json().object(c.fields)
+	if err != nil {
+		return "", false
+	}
+
+	v, ok := c.code.Run(input).Next()
+	if !ok {
+		return "", false
+	}
+
+	switch v := v.(type) {
+	case nil, error:
+		return "", false
+	case string:
+		return v, v != ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	default:
+		id, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return string(id), true
+	}
+}
+
+// group returns the group of the ID and marks it as the most recently active.
+func (c *correlationBuffer) group(id string, now time.Time) *correlationGroup {
+	g, ok := c.groups[id]
+	if !ok {
+		g = &correlationGroup{id: id}
+		g.elem = c.order.PushBack(g)
+		c.groups[id] = g
+		c.bytes += len(id)
+	} else {
+		c.order.MoveToBack(g.elem)
+	}
+	g.lastSeen = now
+	return g
+}
+
+func (c *correlationBuffer) add(g *correlationGroup, l line) {
+	g.lines = append(g.lines, l)
+	g.bytes += len(l.b)
+	c.bytes += len(l.b)
+
+	for c.bytes > c.maxBytes && c.order.Len() > 0 {
+		c.remove(c.order.Front().Value.(*correlationGroup))
+	}
+}
+
+// release returns the buffered lines of the group. The following excluded
+// lines of the group are not buffered anymore.
+func (c *correlationBuffer) release(g *correlationGroup) []line {
+	lines := g.lines
+	c.bytes -= g.bytes
+	g.lines = nil
+	g.bytes = 0
+	g.released = true
+	return lines
+}
+
+// expire removes the groups without lines for the TTL.
+func (c *correlationBuffer) expire(now time.Time) {
+	for c.order.Len() > 0 {
+		g := c.order.Front().Value.(*correlationGroup)
+		if now.Sub(g.lastSeen) < c.ttl {
+			return
+		}
+		c.remove(g)
+	}
+}
+
+func (c *correlationBuffer) remove(g *correlationGroup) {
+	c.order.Remove(g.elem)
+	delete(c.groups, g.id)
+	c.bytes -= g.bytes + len(g.id)
+}
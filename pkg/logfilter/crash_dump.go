@@ -0,0 +1,223 @@
+package logfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// crashDumpScanTimeout is the maximum time the crash dump waits for the
+// scanners to scan the last lines of the exited command, e.g. if a scanner is
+// blocked by a full buffer.
+const crashDumpScanTimeout = time.Second
+
+// CrashReport is written to the crash dump file or to stderr after the
+// command exits abnormally.
+type CrashReport struct {
+	Time      string              `json:"time"`
+	Level     string              `json:"level"`
+	Msg       string              `json:"msg"`
+	Service   string              `json:"service"`
+	Proc      string              `json:"proc,omitempty"`
+	Cmd       []string            `json:"cmd"`
+	PID       int                 `json:"pid"`
+	ExitCode  int                 `json:"exitCode"`
+	ExitError string              `json:"exitError"`
+	Streams   []CrashReportStream `json:"streams"`
+}
+
+// CrashReportStream contains the last lines of a stream, both included and
+// excluded.
+type CrashReportStream struct {
+	Name  string   `json:"name"`
+	Lines []string `json:"lines"`
+}
+
+// recentLines keeps the last lines of a stream. It is safe for concurrent use.
+type recentLines struct {
+	mu   sync.Mutex
+	ring *lineRing
+}
+
+func newRecentLines(capacity int) *recentLines {
+	return &recentLines{
+		ring: newLineRing(capacity),
+	}
+}
+
+func (r *recentLines) push(l line) {
+	r.mu.Lock()
+	r.ring.push(l)
+	r.mu.Unlock()
+}
+
+func (r *recentLines) drain() []line {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ring.drain()
+}
+
+// crashDump writes the last lines of the proc streams together with the exit
+// status.
+func (f *LogFilter) crashDump(p *proc, state CommanderState) {
+	deadline := time.Now().Add(crashDumpScanTimeout)
+	for _, s := range p.streams {
+		if !s.progress.wait(deadline) {
+			f.logger.WithField("stream", s.name).Warn("Crash dump timed out waiting for the last lines")
+		}
+	}
+
+	report := CrashReport{
+		Time:      state.ExitedAt.Format(RFC3339Milli),
+		Level:     "error",
+		Msg:       "Logfilter command crashed",
+		Service:   "logfilter",
+		Proc:      p.name,
+		Cmd:       redactArgs(p.config.Cmd),
+		PID:       state.PID,
+		ExitCode:  state.ExitCode,
+		ExitError: state.ExitError,
+		Streams:   []CrashReportStream{},
+	}
+
+	for _, s := range p.streams {
+		recent := s.recent.drain()
+
+		lines := make([]string, len(recent))
+		for i, l := range recent {
+			lines[i] = string(l.b)
+		}
+
+		report.Streams = append(report.Streams, CrashReportStream{
+			Name:  s.name,
+			Lines: lines,
+		})
+	}
+
+	b, _ := json.Marshal(report)
+	b = append(b, '\n')
+
+	logger := f.logger.WithField("crashDumpFile", f.config.CrashDumpFile)
+	if p.name != "" {
+		logger = logger.WithField("proc", p.name)
+	}
+
+	var w io.Writer = os.Stderr
+
+	if f.config.CrashDumpFile != "" {
+		file, err := os.OpenFile(f.config.CrashDumpFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to open crash dump file")
+			return
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if _, err := w.Write(b); err != nil {
+		logger.WithError(err).Warn("Failed to write crash dump")
+		return
+	}
+
+	logger.Info("Crash dump written")
+}
+
+// scanProgress tracks the bytes of a stream written by the command and the
+// bytes of the lines scanned from them so that the crash dump can wait until
+// the lines written by the exited command are scanned.
+type scanProgress struct {
+	// pipe is the read end of the OS pipe the command writes to directly or
+	// nil if the command output is written through the writer
+	pipe *os.File
+
+	mu    sync.Mutex
+	total int64
+	// lineEnd is the offset after the last newline written
+	lineEnd int64
+	// scanned is the offset after the last scanned line
+	scanned int64
+	// changed is closed on the next progress if there is a waiter
+	changed chan struct{}
+}
+
+func newScanProgress() *scanProgress {
+	return &scanProgress{}
+}
+
+// writer records the bytes written to w. The writes to an io.Pipe return after
+// the bytes are read so the bytes are recorded before the command exits.
+func (p *scanProgress) writer(w io.Writer) io.Writer {
+	return &progressWriter{
+		w: w,
+		p: p,
+	}
+}
+
+// written records the bytes written by the command. p.mu must be held.
+func (p *scanProgress) written(b []byte) {
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+		p.lineEnd = p.total + int64(i) + 1
+	}
+	p.total += int64(len(b))
+	p.notify()
+}
+
+// scan records the offset after the scanned line.
+func (p *scanProgress) scan(offset int64) {
+	p.mu.Lock()
+	p.scanned = offset
+	p.notify()
+	p.mu.Unlock()
+}
+
+func (p *scanProgress) notify() {
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+}
+
+// wait waits until all complete lines written by the command (and still in
+// the pipe) are scanned. It returns false if the deadline is reached first.
+func (p *scanProgress) wait(deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for {
+		p.mu.Lock()
+		if p.scanned >= p.lineEnd && (p.pipe == nil || pipeBuffered(p.pipe) == 0) {
+			p.mu.Unlock()
+			return true
+		}
+		if p.changed == nil {
+			p.changed = make(chan struct{})
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// progressWriter records the bytes written in the scan progress.
+type progressWriter struct {
+	w io.Writer
+	p *scanProgress
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+
+	w.p.mu.Lock()
+	w.p.written(b[:n])
+	w.p.mu.Unlock()
+
+	return n, err
+}
@@ -0,0 +1,121 @@
+package logfilter_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("CrashDump", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logfilter-test-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should write the last lines after the command crashed", func() {
+		crashDumpFile := filepath.Join(tmpDir, "crash.log")
+
+		script := `
+			echo '{"Level":"Debug","Message":"d1"}'
+			echo '{"Level":"Debug","Message":"d2"}'
+			echo '{"Level":"Information","Message":"i1"}'
+			echo 'e1' >&2
+			exit 3
+		`
+
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", script, "--token", "secret"}
+		config.ExcludeTemplate = `{{eq .Level "Debug"}}`
+		config.CrashDumpLines = 2
+		config.CrashDumpFile = crashDumpFile
+
+		output := bytes.NewBuffer(nil)
+
+		logFilter := NewLogFilter(config, nil, output, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("exit status 3"))
+
+		// stdout and stderr are not ordered
+		Expect(output.String()).To(ContainSubstring("{\"Level\":\"Information\",\"Message\":\"i1\"}\n"))
+		Expect(output.String()).To(ContainSubstring("e1\n"))
+		Expect(output.String()).NotTo(ContainSubstring("Debug"))
+
+		b, err := ioutil.ReadFile(crashDumpFile)
+		Expect(err).NotTo(HaveOccurred())
+
+		report := CrashReport{}
+		Expect(json.Unmarshal(b, &report)).To(Succeed())
+
+		Expect(report.Msg).To(Equal("Logfilter command crashed"))
+		Expect(report.Cmd).To(Equal([]string{"bash", "-c", script, "--token", "<redacted>"}))
+		Expect(report.PID).To(BeNumerically(">", 0))
+		Expect(report.ExitCode).To(Equal(3))
+		Expect(report.ExitError).To(Equal("exit status 3"))
+		Expect(report.Streams).To(Equal([]CrashReportStream{
+			{Name: "stdout", Lines: []string{`{"Level":"Debug","Message":"d2"}`, `{"Level":"Information","Message":"i1"}`}},
+			{Name: "stderr", Lines: []string{"e1"}},
+		}))
+	})
+
+	It("should wait for the last lines of all streams", func() {
+		crashDumpFile := filepath.Join(tmpDir, "crash.log")
+
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", "seq 1 5000; seq 1 5000 >&3; exit 1"}
+		config.FD = 3
+		config.CrashDumpLines = 2
+		config.CrashDumpFile = crashDumpFile
+
+		logFilter := NewLogFilter(config, nil, ioutil.Discard, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("exit status 1"))
+
+		b, err := ioutil.ReadFile(crashDumpFile)
+		Expect(err).NotTo(HaveOccurred())
+
+		report := CrashReport{}
+		Expect(json.Unmarshal(b, &report)).To(Succeed())
+
+		Expect(report.Streams).To(Equal([]CrashReportStream{
+			{Name: "stdout", Lines: []string{"4999", "5000"}},
+			{Name: "stderr", Lines: []string{}},
+			{Name: "fd", Lines: []string{"4999", "5000"}},
+		}))
+	})
+
+	It("should not write the crash dump after the command succeeded", func() {
+		crashDumpFile := filepath.Join(tmpDir, "crash.log")
+
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", "echo ok"}
+		config.CrashDumpLines = 2
+		config.CrashDumpFile = crashDumpFile
+
+		logFilter := NewLogFilter(config, nil, bytes.NewBuffer(nil), Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("command exited"))
+
+		_, err := os.Stat(crashDumpFile)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
@@ -1,10 +1,98 @@
 package logfilter
 
 import (
+	"crypto/subtle"
+	"net"
 	"net/http"
-	_ "net/http/pprof" // register pprof http handlers
+	"net/http/pprof"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/xerrors"
 )
 
-func NewDebugServer() *http.Server {
-	return &http.Server{Handler: nil}
+// DebugUnixPrefix is the DebugListenAddr prefix of the Unix socket paths.
+const DebugUnixPrefix = "unix:"
+
+func NewDebugServer(handler http.Handler) *http.Server {
+	return &http.Server{Handler: handler}
+}
+
+// NewDebugMux returns a mux with the pprof handlers mounted under
+// /debug/pprof/. It does not serve http.DefaultServeMux so the handlers
+// registered by the imported packages are not exposed.
+func NewDebugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
+
+// ListenDebug listens on a TCP address (e.g. localhost:4083 or localhost:0 for
+// an ephemeral port) or on a Unix socket path prefixed with "unix:". A stale
+// Unix socket file is removed before listening.
+func ListenDebug(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, DebugUnixPrefix) {
+		path := strings.TrimPrefix(addr, DebugUnixPrefix)
+
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+
+		return net.Listen("unix", path)
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// removeStaleSocket removes the Unix socket file if no process is listening on
+// it. The sockets of the running processes and the other files are kept.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to stat debug socket: %s: %w", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return xerrors.Errorf("debug socket path is not a socket: %s", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return xerrors.Errorf("debug socket is in use: %s", path)
+	}
+	if !xerrors.Is(err, syscall.ECONNREFUSED) {
+		return xerrors.Errorf("failed to check debug socket: %s: %w", path, err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return xerrors.Errorf("failed to remove stale debug socket: %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// bearerTokenHandler rejects the requests without the bearer token in the
+// Authorization header.
+func bearerTokenHandler(token string, handler http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
 }
@@ -0,0 +1,169 @@
+package logfilter_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("DebugServer", func() {
+	start := func(config *Config) (*LogFilter, func()) {
+		inputWait := make(chan struct{})
+
+		reader := funcReader(func(b []byte) (int, error) {
+			<-inputWait
+			return 0, context.Canceled
+		})
+
+		logFilter := NewLogFilter(config, reader, ioutil.Discard, Logger)
+
+		ctx, cancel := context.WithCancel(TestCtx)
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		return logFilter, func() {
+			cancel()
+			Eventually(done).Should(Receive())
+			close(inputWait)
+			logFilter.Close()
+		}
+	}
+
+	get := func(client *http.Client, url string, token string) int {
+		req, err := http.NewRequest("GET", url, nil)
+		Expect(err).NotTo(HaveOccurred())
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		var resp *http.Response
+		Eventually(func() error {
+			resp, err = client.Do(req)
+			return err
+		}).Should(Succeed())
+		defer resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	It("should listen on an ephemeral port and serve only the mounted handlers", func() {
+		http.HandleFunc("/logfilter-test-"+Rand(), func(w http.ResponseWriter, r *http.Request) {})
+
+		config := &Config{}
+		config.DebugListenAddr = "localhost:0"
+
+		logFilter, stop := start(config)
+		defer stop()
+
+		addr := logFilter.DebugAddr().String()
+		Expect(addr).NotTo(HaveSuffix(":0"))
+
+		Expect(get(http.DefaultClient, "http://"+addr+"/debug/pprof/", "")).To(Equal(http.StatusOK))
+		Expect(get(http.DefaultClient, "http://"+addr+"/debug/pprof/cmdline", "")).To(Equal(http.StatusOK))
+		Expect(get(http.DefaultClient, "http://"+addr+"/healthz", "")).To(Equal(http.StatusOK))
+		Expect(get(http.DefaultClient, "http://"+addr+"/logfilter-test-unknown", "")).To(Equal(http.StatusNotFound))
+	})
+
+	It("should listen on a Unix socket", func() {
+		tmpDir, err := ioutil.TempDir("", "logfilter-test-")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+
+		socketPath := filepath.Join(tmpDir, "debug.sock")
+
+		// stale socket from a previous run
+		staleListener, err := net.Listen("unix", socketPath)
+		Expect(err).NotTo(HaveOccurred())
+		staleListener.(*net.UnixListener).SetUnlinkOnClose(false)
+		staleListener.Close()
+
+		config := &Config{}
+		config.DebugListenAddr = "unix:" + socketPath
+
+		logFilter, stop := start(config)
+		defer stop()
+
+		Expect(logFilter.DebugAddr().Network()).To(Equal("unix"))
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+				},
+			},
+			Timeout: 5 * time.Second,
+		}
+
+		Expect(get(client, "http://logfilter/healthz", "")).To(Equal(http.StatusOK))
+	})
+
+	It("should not remove a socket in use or a file that is not a socket", func() {
+		tmpDir, err := ioutil.TempDir("", "logfilter-test-")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+
+		socketPath := filepath.Join(tmpDir, "debug.sock")
+
+		listener, err := net.Listen("unix", socketPath)
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+
+		_, err = ListenDebug("unix:" + socketPath)
+		Expect(err).To(MatchError("debug socket is in use: " + socketPath))
+
+		filePath := filepath.Join(tmpDir, "debug.txt")
+		Expect(ioutil.WriteFile(filePath, []byte("data"), 0644)).To(Succeed())
+
+		_, err = ListenDebug("unix:" + filePath)
+		Expect(err).To(MatchError("debug socket path is not a socket: " + filePath))
+		Expect(filePath).To(BeAnExistingFile())
+	})
+
+	It("should require the bearer token", func() {
+		config := &Config{}
+		config.DebugListenAddr = "localhost:0"
+		config.DebugToken = "secret-token"
+
+		logFilter, stop := start(config)
+		defer stop()
+
+		url := "http://" + logFilter.DebugAddr().String() + "/status"
+
+		Expect(get(http.DefaultClient, url, "")).To(Equal(http.StatusUnauthorized))
+		Expect(get(http.DefaultClient, url, "wrong")).To(Equal(http.StatusUnauthorized))
+		Expect(get(http.DefaultClient, url, "secret-token")).To(Equal(http.StatusOK))
+	})
+
+	It("should allow disabling the debug server", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+
+		config := &Config{}
+		config.DebugListenAddr = listener.Addr().String()
+		config.DebugDisabled = true
+
+		logFilter := NewLogFilter(config, strings.NewReader("line\n"), ioutil.Discard, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.DebugAddr()).To(BeNil())
+
+		Expect(logFilter.Start()).To(MatchError(ContainSubstring("reading stdin")))
+	})
+})
@@ -0,0 +1,122 @@
+package logfilter
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// drainPollInterval is the interval of checking if the stdin scanner has
+// written all the lines that were already read.
+const drainPollInterval = 10 * time.Millisecond
+
+// drainAbortTimeout is the maximum time to wait for the writers to stop after
+// the drain deadline. A write blocked in the writer cannot be interrupted.
+const drainAbortTimeout = time.Second
+
+// errWritesAborted stops the writers after the drain deadline.
+var errWritesAborted = xerrors.New("writes aborted")
+
+// readTracker tracks if a Read is in progress. A scanner blocked in Read has
+// sent all the complete lines that were read before.
+type readTracker struct {
+	// reading is accessed atomically
+	reading int32
+
+	r io.Reader
+}
+
+func newReadTracker(r io.Reader) *readTracker {
+	return &readTracker{r: r}
+}
+
+func (r *readTracker) Read(b []byte) (int, error) {
+	atomic.StoreInt32(&r.reading, 1)
+	n, err := r.r.Read(b)
+	atomic.StoreInt32(&r.reading, 0)
+	return n, err
+}
+
+func (r *readTracker) isReading() bool {
+	return atomic.LoadInt32(&r.reading) == 1
+}
+
+// waitStdinDrained waits after the shutdown started until the stdin scanner
+// has sent all the lines that were read before the shutdown. stdin does not get
+// closed on SIGINT so the scanner is done once it blocks reading more input.
+func (f *LogFilter) waitStdinDrained(scanErrChan <-chan error, deadline <-chan struct{}) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if f.stdinReader.isReading() {
+			return nil
+		}
+
+		select {
+		case err := <-scanErrChan:
+			return err
+		case <-ticker.C:
+		case <-f.writerDone:
+			return nil
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+// drainDeadline returns a channel that is closed DrainTimeout after the first
+// call (the start of the shutdown) or nil if the drain has no deadline.
+func (f *LogFilter) drainDeadline() <-chan struct{} {
+	f.drainDeadlineOnce.Do(func() {
+		if f.config.DrainTimeout > 0 {
+			deadline := make(chan struct{})
+			time.AfterFunc(f.config.DrainTimeout, func() {
+				close(deadline)
+			})
+			f.drainDeadlineChan = deadline
+		}
+	})
+	return f.drainDeadlineChan
+}
+
+// abortWrites stops the writers after the drain deadline and waits until they
+// stop so that the outputs are not written after they are closed. The output
+// files also reject the writes after they are closed in case a writer is
+// blocked for longer than drainAbortTimeout.
+func (f *LogFilter) abortWrites() {
+	close(f.writeAbort)
+	if f.spool != nil {
+		f.spool.abort()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		f.writers.Wait()
+		close(stopped)
+	}()
+
+	timer := time.NewTimer(drainAbortTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-stopped:
+	case <-timer.C:
+		f.logger.WithFields(logrus.Fields{
+			"timeout": drainAbortTimeout,
+		}).Warn("LogFilter writers did not stop after the drain deadline")
+	}
+}
+
+// writesAborted reports if the writers were stopped by the drain deadline.
+func (f *LogFilter) writesAborted() bool {
+	select {
+	case <-f.writeAbort:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,221 @@
+package logfilter_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Drain", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logfilter-test-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should write the lines read from stdin before the shutdown", func() {
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.BufferLines = 100
+		config.DrainTimeout = 5 * time.Second
+		config.FullOutputFilename = filepath.Join(tmpDir, "logfilter.log")
+
+		expected := []string{}
+		for i := 0; i < 50; i++ {
+			expected = append(expected, fmt.Sprintf("line%d", i))
+		}
+		input := strings.Join(expected, "\n") + "\n"
+
+		// stdin does not get closed on shutdown
+		reader := io.MultiReader(strings.NewReader(input), funcReader(func(b []byte) (int, error) {
+			select {}
+		}))
+
+		writeStarted := make(chan struct{})
+		writeRelease := make(chan struct{})
+		var writeOnce sync.Once
+
+		output := &syncBuffer{}
+		writer := funcWriter(func(b []byte) (int, error) {
+			writeOnce.Do(func() {
+				close(writeStarted)
+				<-writeRelease
+			})
+			return output.Write(b)
+		})
+
+		logFilter := NewLogFilter(config, reader, writer, Logger)
+
+		ctx, cancel := context.WithCancel(TestCtx)
+		defer cancel()
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+		defer logFilter.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		Eventually(writeStarted).Should(BeClosed())
+		Eventually(func() uint64 {
+			return logFilter.Status().Streams[0].Lines
+		}).Should(BeEquivalentTo(50))
+
+		cancel()
+		close(writeRelease)
+
+		Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+
+		Expect(output.String()).To(Equal(input))
+
+		Expect(logFilter.Close()).To(MatchError(ContainSubstring("debug listener")))
+
+		fullOutput, err := ioutil.ReadFile(config.FullOutputFilename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(fullOutput)).To(Equal(input))
+	})
+
+	It("should stop draining after the drain deadline", func() {
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.DrainTimeout = 100 * time.Millisecond
+
+		writeRelease := make(chan struct{})
+		defer close(writeRelease)
+
+		writer := funcWriter(func(b []byte) (int, error) {
+			<-writeRelease
+			return len(b), nil
+		})
+
+		logFilter := NewLogFilter(config, bytes.NewReader([]byte("line1\n")), writer, Logger)
+
+		ctx, cancel := context.WithCancel(TestCtx)
+		defer cancel()
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+		defer logFilter.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+
+		Eventually(done).Should(Receive(MatchError("drain deadline exceeded")))
+	})
+
+	It("should stop the writers after the drain deadline", func() {
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.BufferLines = 100
+		config.DrainTimeout = 100 * time.Millisecond
+
+		var writes int64
+		var mu sync.Mutex
+
+		writer := funcWriter(func(b []byte) (int, error) {
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			writes++
+			mu.Unlock()
+			return len(b), nil
+		})
+
+		input := strings.Repeat("line\n", 100)
+
+		logFilter := NewLogFilter(config, bytes.NewReader([]byte(input)), writer, Logger)
+
+		ctx, cancel := context.WithCancel(TestCtx)
+		defer cancel()
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+		defer logFilter.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+
+		Eventually(done).Should(Receive(MatchError("drain deadline exceeded")))
+
+		mu.Lock()
+		written := writes
+		mu.Unlock()
+		Expect(written).To(BeNumerically("<", 100))
+
+		Consistently(func() int64 {
+			mu.Lock()
+			defer mu.Unlock()
+			return writes
+		}, 100*time.Millisecond).Should(Equal(written))
+	})
+
+	It("should not open the output files again after the drain deadline", func() {
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.DrainTimeout = 100 * time.Millisecond
+		config.FullOutputFilename = filepath.Join(tmpDir, "logfilter.log")
+		config.DebugDisabled = true
+
+		writeRelease := make(chan struct{})
+		writeReturned := make(chan struct{})
+
+		writer := funcWriter(func(b []byte) (int, error) {
+			<-writeRelease
+			close(writeReturned)
+			return len(b), nil
+		})
+
+		logFilter := NewLogFilter(config, bytes.NewReader([]byte("line1\n")), writer, Logger)
+
+		ctx, cancel := context.WithCancel(TestCtx)
+		defer cancel()
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+
+		// the writer is blocked for longer than the drain deadline
+		Eventually(done, 5*time.Second).Should(Receive(MatchError("drain deadline exceeded")))
+		Expect(logFilter.Close()).To(Succeed())
+
+		close(writeRelease)
+		Eventually(writeReturned).Should(BeClosed())
+
+		Consistently(func() bool {
+			_, err := os.Stat(config.FullOutputFilename)
+			return os.IsNotExist(err)
+		}, 100*time.Millisecond).Should(BeTrue())
+	})
+})
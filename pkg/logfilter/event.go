@@ -0,0 +1,38 @@
+package logfilter
+
+import (
+	"time"
+)
+
+// event is a line passing through the pipeline stages. The stages share the
+// event so that the line is decoded at most once per pass through the
+// pipeline.
+type event struct {
+	raw        []byte
+	stream     string
+	receivedAt time.Time
+	// seq is the order of the line across all the streams
+	seq uint64
+
+	doc *lazyJSON
+}
+
+func newEvent(raw []byte) *event {
+	return &event{
+		raw: raw,
+	}
+}
+
+// json returns the lazily decoded JSON document of the line.
+func (e *event) json() *lazyJSON {
+	if e.doc == nil {
+		e.doc = newLazyJSON(e.raw)
+	}
+	return e.doc
+}
+
+// stage is a step of the pipeline operating on the shared event. The JSON
+// filters are stages that report whether the line is included.
+type stage interface {
+	process(e *event) (bool, error)
+}
@@ -0,0 +1,101 @@
+package logfilter
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const FreeSpaceSupported = freeSpaceSupported
+
+// FullFile is an output file in memory that fails with ENOSPC when it holds
+// Limit bytes.
+type FullFile struct {
+	mu    sync.Mutex
+	limit int
+	buf   bytes.Buffer
+}
+
+func NewFullFile(limit int) *FullFile {
+	return &FullFile{
+		limit: limit,
+	}
+}
+
+func (f *FullFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := f.limit - f.buf.Len()
+	if n < 0 {
+		n = 0
+	}
+	if n > len(b) {
+		n = len(b)
+	}
+	f.buf.Write(b[:n])
+
+	if n < len(b) {
+		return n, &os.PathError{Op: "write", Path: "full", Err: syscall.ENOSPC}
+	}
+	return n, nil
+}
+
+// SetLimit frees or takes the space of the file.
+func (f *FullFile) SetLimit(limit int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.limit = limit
+}
+
+func (f *FullFile) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.buf.String()
+}
+
+func (f *FullFile) Close() error {
+	return nil
+}
+
+func (f *FullFile) currentFilename() string {
+	return ""
+}
+
+func (f *FullFile) reopen() error {
+	return nil
+}
+
+func (f *FullFile) rotate() error {
+	return nil
+}
+
+// NewGuardedFullFile returns the guard of the file output config in front of
+// the file and the output buffer of bufferSize (if not 0). The flush function
+// flushes the output buffer. The clock of the guard is now.
+func NewGuardedFullFile(file *FullFile, config Output, bufferSize int, now func() time.Time, logger *logrus.Entry) (w io.Writer, flush func() error, err error) {
+	guard, err := newGuardedFile(file, config, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	guard.now = now
+
+	guard.w = guard.fileWriter()
+	flush = func() error {
+		return nil
+	}
+	if bufferSize > 0 {
+		buffered := newBufferedWriter(guard.w, bufferSize)
+		guard.w = buffered
+		flush = buffered.Flush
+	}
+
+	return guard, flush, nil
+}
@@ -0,0 +1,186 @@
+package logfilter
+
+import (
+	"context"
+	"sync"
+)
+
+// filterJobSize is the maximum number of lines in a filter job. The lines
+// already waiting in the buffer are filtered together to reduce the overhead
+// of passing each line between the goroutines.
+const filterJobSize = 64
+
+// filterJob is a batch of consecutive lines filtered by a filter worker.
+type filterJob struct {
+	lines   []line
+	results []filterResult
+	// outputs holds the outputs of the routes of all the lines, the outputs of
+	// the results are parts of it
+	outputs []*output
+	// done receives a value after the lines are filtered
+	done chan struct{}
+}
+
+var filterJobPool = sync.Pool{
+	New: func() interface{} {
+		return &filterJob{
+			lines:   make([]line, 0, filterJobSize),
+			results: make([]filterResult, 0, filterJobSize),
+			done:    make(chan struct{}, 1),
+		}
+	},
+}
+
+// filterWorkers evaluates the filters of the lines concurrently. The jobs are
+// queued in results in the order of the lines so that the writer can write the
+// lines in their original order.
+type filterWorkers struct {
+	count   int
+	jobs    chan *filterJob
+	results chan *filterJob
+}
+
+func newFilterWorkers(count int) *filterWorkers {
+	return &filterWorkers{
+		count:   count,
+		jobs:    make(chan *filterJob, count),
+		results: make(chan *filterJob, 2*count),
+	}
+}
+
+// dispatchFilterJobs queues the lines from the buffer until the scanning is
+// done and the buffer is empty. The results are closed after the last line.
+func (f *LogFilter) dispatchFilterJobs(linesDone <-chan struct{}) {
+	w := f.filterWorkers
+
+	defer close(w.jobs)
+	defer close(w.results)
+
+	dispatch := func(l line) bool {
+		job := filterJobPool.Get().(*filterJob)
+		job.lines = append(job.lines, l)
+
+	batch:
+		for len(job.lines) < filterJobSize {
+			select {
+			case l := <-f.buffer.lines:
+				job.lines = append(job.lines, l)
+			default:
+				break batch
+			}
+		}
+
+		select {
+		case w.results <- job:
+		case <-f.writerDone:
+			return false
+		}
+
+		w.jobs <- job
+
+		return true
+	}
+
+	for {
+		select {
+		case l := <-f.buffer.lines:
+			if !dispatch(l) {
+				return
+			}
+		case <-linesDone:
+			// dispatch the lines remaining in the buffer
+			for {
+				select {
+				case l := <-f.buffer.lines:
+					if !dispatch(l) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-f.writerDone:
+			return
+		}
+	}
+}
+
+// runFilterWorker filters and routes the lines with its own copies of the
+// filters and the route matchers.
+func (f *LogFilter) runFilterWorker(_ context.Context) error {
+	jsonFilters := map[JSONFilter]JSONFilter{}
+	fullJSONFilter := cloneJSONFilter(f.fullJSONFilter)
+
+	var r *router
+	if f.router != nil {
+		r = f.router.clone()
+	}
+
+	for job := range f.filterWorkers.jobs {
+		for _, l := range job.lines {
+			if l.fullOnly {
+				// the parts of an oversized line are not filtered
+				job.results = append(job.results, filterResult{})
+				continue
+			}
+
+			jsonFilter, ok := jsonFilters[l.stream.jsonFilter]
+			if !ok {
+				jsonFilter = cloneJSONFilter(l.stream.jsonFilter)
+				jsonFilters[l.stream.jsonFilter] = jsonFilter
+			}
+
+			result := f.filterResult(l, jsonFilter, fullJSONFilter, r)
+			// the outputs of the router are reused for the next line
+			start := len(job.outputs)
+			job.outputs = append(job.outputs, result.outputs...)
+			result.outputs = job.outputs[start:len(job.outputs):len(job.outputs)]
+
+			job.results = append(job.results, result)
+		}
+		job.done <- struct{}{}
+	}
+
+	return nil
+}
+
+// releaseFilterJob returns the job to the pool after the lines were written.
+func releaseFilterJob(job *filterJob) {
+	for i := range job.lines {
+		job.lines[i] = line{}
+	}
+	job.lines = job.lines[:0]
+	for i := range job.results {
+		job.results[i] = filterResult{}
+	}
+	job.results = job.results[:0]
+	for i := range job.outputs {
+		job.outputs[i] = nil
+	}
+	job.outputs = job.outputs[:0]
+	filterJobPool.Put(job)
+}
+
+// cloneJSONFilter returns a filter that can be used concurrently with the
+// original filter.
+func cloneJSONFilter(jsonFilter JSONFilter) JSONFilter {
+	switch jsonFilter := jsonFilter.(type) {
+	case *TemplateJSONFilter:
+		// the template can be executed in parallel, the buffer is per filter
+		return &TemplateJSONFilter{
+			ExcludeTpl: jsonFilter.ExcludeTpl,
+			fields:     jsonFilter.fields,
+		}
+	case *JQJSONFilter:
+		// the compiled query can be run in parallel
+		return &JQJSONFilter{
+			Code:   jsonFilter.Code,
+			fields: jsonFilter.fields,
+		}
+	case *lockedJSONFilter:
+		return cloneJSONFilter(jsonFilter.jsonFilter)
+	}
+
+	// StaticJSONFilter is safe for concurrent use
+	return jsonFilter
+}
@@ -0,0 +1,165 @@
+package logfilter_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Filter workers", func() {
+	DescribeTable("should filter the lines concurrently and write them in order",
+		func(configure func(config *Config)) {
+			config := &Config{}
+			config.MaxScanLineSize = 1024
+			config.BufferLines = 100
+			config.FilterWorkers = 4
+			configure(config)
+
+			input := []string{}
+			expected := []string{}
+			for i := 0; i < 1000; i++ {
+				level := "Info"
+				if i%3 == 0 {
+					level = "Debug"
+				}
+				l := fmt.Sprintf(`{"Level":"%s","N":%d}`, level, i)
+				input = append(input, l)
+				if level != "Debug" {
+					expected = append(expected, l)
+				}
+			}
+
+			writer := &syncBuffer{}
+
+			logFilter := NewLogFilter(config, strings.NewReader(strings.Join(input, "\n")+"\n"), writer, Logger)
+			Expect(logFilter.Init(TestCtx)).To(Succeed())
+			defer logFilter.Close()
+
+			Expect(logFilter.Start()).To(MatchError("reading stdin: EOF"))
+
+			Expect(writer.String()).To(Equal(strings.Join(expected, "\n") + "\n"))
+
+			status := logFilter.Status()
+			Expect(status.Streams[0].Included).To(BeEquivalentTo(len(expected)))
+			// the excluded lines can be dropped with the drop-excluded policy
+			Expect(status.Streams[0].Excluded + status.Streams[0].Dropped).To(BeEquivalentTo(len(input) - len(expected)))
+		},
+		Entry("JQ filter query", func(config *Config) {
+			config.FilterQuery = `select(.Level != "Debug")`
+		}),
+		Entry("exclude template", func(config *Config) {
+			config.ExcludeTemplate = `{{eq .Level "Debug"}}`
+		}),
+		Entry("drop-excluded buffer policy", func(config *Config) {
+			config.ExcludeTemplate = `{{eq .Level "Debug"}}`
+			config.BufferPolicy = BufferPolicyDropExcluded
+		}),
+	)
+
+	It("should write the lines of each proc stream in order", func() {
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.FilterWorkers = 4
+		config.FilterQuery = `select(.n % 2 == 0)`
+		config.Procs = Procs{
+			{Name: "a", Cmd: []string{"bash", "-c", `for i in $(seq 1 200); do echo "{\"p\":\"a\",\"n\":$i}"; done`}},
+			{Name: "b", Cmd: []string{"bash", "-c", `for i in $(seq 1 200); do echo "{\"p\":\"b\",\"n\":$i}"; done`}},
+		}
+
+		writer := &syncBuffer{}
+
+		logFilter := NewLogFilter(config, nil, writer, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(HaveOccurred())
+
+		streams := map[string][]string{}
+		for _, l := range strings.Split(strings.TrimSpace(writer.String()), "\n") {
+			streams[l[6:7]] = append(streams[l[6:7]], l)
+		}
+
+		for _, p := range []string{"a", "b"} {
+			expected := []string{}
+			for i := 2; i <= 200; i += 2 {
+				expected = append(expected, fmt.Sprintf(`{"p":"%s","n":%d}`, p, i))
+			}
+			Expect(streams[p]).To(Equal(expected))
+		}
+	})
+
+	It("should evaluate the full output filter and the routes in the workers", func() {
+		tmpDir, err := ioutil.TempDir("", "logfilter-test-")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.BufferLines = 100
+		config.FilterWorkers = 4
+		config.FilterQuery = `select(.Level != "Debug")`
+		config.FullOutputFilename = filepath.Join(tmpDir, "logfilter.log")
+		config.FullOutputFilterQuery = `select(.N % 2 == 0)`
+		config.Outputs = Outputs{
+			{Name: "errors", Type: OutputTypeFile, Filename: filepath.Join(tmpDir, "errors.log"), MaxSizeMB: 1},
+		}
+		config.Routes = Routes{
+			{MatchQuery: `select(.Level == "Error")`, Outputs: []string{"errors"}},
+		}
+
+		input := []string{}
+		expectedStdout := []string{}
+		expectedErrors := []string{}
+		expectedFull := []string{}
+		for i := 0; i < 1000; i++ {
+			level := []string{"Debug", "Info", "Error"}[i%3]
+			l := fmt.Sprintf(`{"Level":"%s","N":%d}`, level, i)
+			input = append(input, l)
+			switch level {
+			case "Info":
+				expectedStdout = append(expectedStdout, l)
+			case "Error":
+				expectedErrors = append(expectedErrors, l)
+			}
+			if i%2 == 0 {
+				expectedFull = append(expectedFull, l)
+			}
+		}
+
+		writer := &syncBuffer{}
+
+		logFilter := NewLogFilter(config, strings.NewReader(strings.Join(input, "\n")+"\n"), writer, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("reading stdin: EOF"))
+
+		Expect(writer.String()).To(Equal(strings.Join(expectedStdout, "\n") + "\n"))
+
+		errors, err := ioutil.ReadFile(filepath.Join(tmpDir, "errors.log"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(errors)).To(Equal(strings.Join(expectedErrors, "\n") + "\n"))
+
+		full, err := ioutil.ReadFile(config.FullOutputFilename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(full)).To(Equal(strings.Join(expectedFull, "\n") + "\n"))
+	})
+
+	It("should fail for a negative number of filter workers", func() {
+		config := &Config{}
+		config.FilterWorkers = -1
+
+		logFilter := NewLogFilter(config, strings.NewReader(""), &syncBuffer{}, Logger)
+		defer logFilter.Close()
+
+		Expect(logFilter.Init(TestCtx)).To(MatchError("filter workers must not be negative: -1"))
+	})
+})
@@ -0,0 +1,199 @@
+package logfilter
+
+import (
+	"encoding/json"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	ContextBefore = "before"
+	ContextAfter  = "after"
+)
+
+// lineRing is a bounded buffer of the most recent lines.
+type lineRing struct {
+	lines []line
+	start int
+	size  int
+}
+
+func newLineRing(capacity int) *lineRing {
+	return &lineRing{
+		lines: make([]line, capacity),
+	}
+}
+
+func (r *lineRing) push(l line) {
+	if len(r.lines) == 0 {
+		return
+	}
+	if r.size < len(r.lines) {
+		r.lines[(r.start+r.size)%len(r.lines)] = l
+		r.size++
+		return
+	}
+	r.lines[r.start] = l
+	r.start = (r.start + 1) % len(r.lines)
+}
+
+// drain returns the buffered lines from the oldest to the newest and empties
+// the buffer.
+func (r *lineRing) drain() []line {
+	lines := make([]line, r.size)
+	for i := range lines {
+		j := (r.start + i) % len(r.lines)
+		lines[i] = r.lines[j]
+		r.lines[j] = line{}
+	}
+	r.start = 0
+	r.size = 0
+	return lines
+}
+
+// flightRecorder keeps the recently excluded lines of each proc (or stdin) and
+// writes them as context around the included lines matching the context
+// condition. The lines with a correlation ID are grouped by the ID instead and
+// all the lines of the ID are written as context. It is not safe for
+// concurrent use.
+type flightRecorder struct {
+	matcher      *lineMatcher
+	before       int
+	after        int
+	beforeLabel  *procLabel
+	afterLabel   *procLabel
+	rings        map[*proc]*lineRing
+	afterPending map[*proc]int
+	correlation  *correlationBuffer
+}
+
+func (f *LogFilter) initFlightRecorder() error {
+	if f.config.ContextTemplate == "" && f.config.ContextQuery == "" {
+		if f.config.CorrelationField != "" {
+			return xerrors.Errorf("correlation field requires context template or context query")
+		}
+		return nil
+	}
+
+	if f.config.ContextTemplate != "" && f.config.ContextQuery != "" {
+		return xerrors.Errorf("cannot use both context template and context query")
+	}
+
+	if f.config.ContextBefore < 0 || f.config.ContextAfter < 0 {
+		return xerrors.Errorf("context before and after must not be negative")
+	}
+
+	matcher, err := newLineMatcher(f.config.ContextTemplate, f.config.ContextQuery)
+	if err != nil {
+		return xerrors.Errorf("failed to build context matcher: %w", err)
+	}
+
+	f.flightRecorder = &flightRecorder{
+		matcher:      matcher,
+		before:       f.config.ContextBefore,
+		after:        f.config.ContextAfter,
+		beforeLabel:  newContextLabel(f.config.ContextField, ContextBefore),
+		afterLabel:   newContextLabel(f.config.ContextField, ContextAfter),
+		rings:        map[*proc]*lineRing{},
+		afterPending: map[*proc]int{},
+	}
+
+	if f.config.CorrelationField != "" {
+		if f.config.CorrelationTTL <= 0 || f.config.CorrelationMaxBytes <= 0 {
+			return xerrors.Errorf("correlation ttl and max bytes must be greater than 0")
+		}
+
+		f.flightRecorder.correlation, err = newCorrelationBuffer(f.config.CorrelationField, f.config.CorrelationTTL, f.config.CorrelationMaxBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// observe returns the context lines that have to be written before the line.
+func (r *flightRecorder) observe(l line, included bool, now time.Time) []line {
+	if r.correlation != nil {
+		r.correlation.expire(now)
+
+		if id, ok := r.correlation.id(l.event); ok {
+			return r.observeCorrelated(l, included, id, now)
+		}
+	}
+
+	p := l.stream.proc
+
+	if !included {
+		if r.afterPending[p] > 0 {
+			r.afterPending[p]--
+			return []line{{stream: l.stream, b: r.afterLabel.apply(l.b)}}
+		}
+
+		ring, ok := r.rings[p]
+		if !ok {
+			ring = newLineRing(r.before)
+			r.rings[p] = ring
+		}
+		ring.push(l)
+
+		return nil
+	}
+
+	if !r.matcher.Match(l.event) {
+		if r.afterPending[p] > 0 {
+			r.afterPending[p]--
+		}
+		return nil
+	}
+
+	r.afterPending[p] = r.after
+
+	ring, ok := r.rings[p]
+	if !ok {
+		return nil
+	}
+
+	return r.labelBefore(ring.drain())
+}
+
+// observeCorrelated buffers the excluded line in the group of its correlation
+// ID and releases the group when the line matches the context condition. The
+// excluded lines of a released group are written until the group expires.
+func (r *flightRecorder) observeCorrelated(l line, included bool, id string, now time.Time) []line {
+	g := r.correlation.group(id, now)
+
+	if !included {
+		if g.released {
+			return []line{{stream: l.stream, b: r.afterLabel.apply(l.b)}}
+		}
+		r.correlation.add(g, l)
+		return nil
+	}
+
+	if !r.matcher.Match(l.event) {
+		return nil
+	}
+
+	return r.labelBefore(r.correlation.release(g))
+}
+
+func (r *flightRecorder) labelBefore(lines []line) []line {
+	for i, l := range lines {
+		lines[i].b = r.beforeLabel.apply(l.b)
+	}
+	return lines
+}
+
+// newContextLabel returns a label that adds the field with the context
+// position to the JSON lines and prefixes the other lines with "[context] ".
+func newContextLabel(field string, position string) *procLabel {
+	jsonField, _ := json.Marshal(field)
+	jsonPosition, _ := json.Marshal(position)
+
+	return &procLabel{
+		jsonPrefix: []byte(`{` + string(jsonField) + `:` + string(jsonPosition)),
+		textPrefix: []byte("[context] "),
+	}
+}
@@ -0,0 +1,148 @@
+package logfilter_test
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("FlightRecorder", func() {
+	It("should write the excluded lines around the matching lines as context", func() {
+		input := strings.Join([]string{
+			`{"Level":"Debug","Message":"d0"}`,
+			`{"Level":"Debug","Message":"d1"}`,
+			`{"Level":"Debug","Message":"d2"}`,
+			`{"Level":"Debug","Message":"d3"}`,
+			`{"Level":"Information","Message":"i1"}`,
+			`{"Level":"Error","Message":"e1"}`,
+			`{"Level":"Debug","Message":"d4"}`,
+			`{"Level":"Information","Message":"i2"}`,
+			`{"Level":"Debug","Message":"d5"}`,
+			`{"Level":"Debug","Message":"d6"}`,
+			`{"Level":"Error","Message":"e2"}`,
+			`{"Level":"Error","Message":"e3"}`,
+		}, "\n") + "\n"
+
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.FilterQuery = `select(.Level != "Debug")`
+		config.ContextQuery = `select(.Level == "Error")`
+		config.ContextBefore = 3
+		config.ContextAfter = 2
+		config.ContextField = "logfilterContext"
+
+		output := bytes.NewBuffer(nil)
+
+		logFilter := NewLogFilter(config, strings.NewReader(input), output, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("reading stdin: EOF"))
+
+		Expect(output.String()).To(Equal(strings.Join([]string{
+			`{"Level":"Information","Message":"i1"}`,
+			`{"logfilterContext":"before","Level":"Debug","Message":"d1"}`,
+			`{"logfilterContext":"before","Level":"Debug","Message":"d2"}`,
+			`{"logfilterContext":"before","Level":"Debug","Message":"d3"}`,
+			`{"Level":"Error","Message":"e1"}`,
+			`{"logfilterContext":"after","Level":"Debug","Message":"d4"}`,
+			`{"Level":"Information","Message":"i2"}`,
+			`{"logfilterContext":"before","Level":"Debug","Message":"d5"}`,
+			`{"logfilterContext":"before","Level":"Debug","Message":"d6"}`,
+			`{"Level":"Error","Message":"e2"}`,
+			`{"Level":"Error","Message":"e3"}`,
+		}, "\n") + "\n"))
+	})
+
+	It("should write the excluded lines of the correlation ID", func() {
+		input := strings.Join([]string{
+			`{"Level":"Debug","Message":"a1","trace_id":"a"}`,
+			`{"Level":"Debug","Message":"b1","trace_id":"b"}`,
+			`{"Level":"Debug","Message":"n1"}`,
+			`{"Level":"Debug","Message":"a2","trace_id":"a"}`,
+			`{"Level":"Information","Message":"b2","trace_id":"b"}`,
+			`{"Level":"Error","Message":"a3","trace_id":"a"}`,
+			`{"Level":"Debug","Message":"a4","trace_id":"a"}`,
+			`{"Level":"Debug","Message":"n2"}`,
+			`{"Level":"Error","Message":"n3"}`,
+		}, "\n") + "\n"
+
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.FilterQuery = `select(.Level != "Debug")`
+		config.ContextQuery = `select(.Level == "Error")`
+		config.ContextBefore = 10
+		config.ContextField = "logfilterContext"
+		config.CorrelationField = ".trace_id"
+		config.CorrelationTTL = time.Minute
+		config.CorrelationMaxBytes = 1024 * 1024
+
+		output := bytes.NewBuffer(nil)
+
+		logFilter := NewLogFilter(config, strings.NewReader(input), output, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("reading stdin: EOF"))
+
+		Expect(output.String()).To(Equal(strings.Join([]string{
+			`{"Level":"Information","Message":"b2","trace_id":"b"}`,
+			`{"logfilterContext":"before","Level":"Debug","Message":"a1","trace_id":"a"}`,
+			`{"logfilterContext":"before","Level":"Debug","Message":"a2","trace_id":"a"}`,
+			`{"Level":"Error","Message":"a3","trace_id":"a"}`,
+			`{"logfilterContext":"after","Level":"Debug","Message":"a4","trace_id":"a"}`,
+			`{"logfilterContext":"before","Level":"Debug","Message":"n1"}`,
+			`{"logfilterContext":"before","Level":"Debug","Message":"n2"}`,
+			`{"Level":"Error","Message":"n3"}`,
+		}, "\n") + "\n"))
+	})
+
+	It("should discard the least recently active correlation IDs over the memory cap", func() {
+		input := strings.Join([]string{
+			`{"Level":"Debug","Message":"a1","trace_id":"a"}`,
+			`{"Level":"Debug","Message":"b1","trace_id":"b"}`,
+			`{"Level":"Debug","Message":"c1","trace_id":"c"}`,
+			`{"Level":"Error","Message":"a2","trace_id":"a"}`,
+			`{"Level":"Error","Message":"c2","trace_id":"c"}`,
+		}, "\n") + "\n"
+
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.FilterQuery = `select(.Level != "Debug")`
+		config.ContextQuery = `select(.Level == "Error")`
+		config.ContextField = "logfilterContext"
+		config.CorrelationField = ".trace_id"
+		config.CorrelationTTL = time.Minute
+		config.CorrelationMaxBytes = 120
+
+		output := bytes.NewBuffer(nil)
+
+		logFilter := NewLogFilter(config, strings.NewReader(input), output, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("reading stdin: EOF"))
+
+		Expect(output.String()).To(Equal(strings.Join([]string{
+			`{"Level":"Error","Message":"a2","trace_id":"a"}`,
+			`{"logfilterContext":"before","Level":"Debug","Message":"c1","trace_id":"c"}`,
+			`{"Level":"Error","Message":"c2","trace_id":"c"}`,
+		}, "\n") + "\n"))
+	})
+
+	It("should fail for both context template and context query", func() {
+		config := &Config{}
+		config.ContextTemplate = `{{eq .Level "Error"}}`
+		config.ContextQuery = `select(.Level == "Error")`
+
+		logFilter := NewLogFilter(config, strings.NewReader(""), bytes.NewBuffer(nil), Logger)
+		defer logFilter.Close()
+
+		Expect(logFilter.Init(TestCtx)).To(MatchError("cannot use both context template and context query"))
+	})
+})
@@ -0,0 +1,18 @@
+package logfilter
+
+import (
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+const freeSpaceSupported = true
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the filesystem of the path.
+func freeSpace(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, xerrors.Errorf("failed to stat filesystem: %s: %w", path, err)
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package logfilter
+
+import (
+	"golang.org/x/xerrors"
+)
+
+const freeSpaceSupported = false
+
+func freeSpace(path string) (uint64, error) {
+	return 0, xerrors.Errorf("free space is only supported on linux")
+}
@@ -0,0 +1,305 @@
+package logfilter
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// guardCheckInterval is the minimum interval between the checks of the disk
+// quota and the free space.
+const guardCheckInterval = time.Second
+
+// guardCheckBytes is the number of bytes written after which the disk quota
+// and the free space are checked before the guardCheckInterval.
+const guardCheckBytes = megabyte
+
+// ValidateMaxTotalSize checks that the total size fits at least one file.
+func ValidateMaxTotalSize(maxTotalSizeMB int, maxSizeMB int) error {
+	if maxTotalSizeMB > 0 && maxTotalSizeMB < maxSizeMB {
+		return xerrors.Errorf("max total size must not be less than max size: %d < %d", maxTotalSizeMB, maxSizeMB)
+	}
+	return nil
+}
+
+// guardedFile limits the disk usage of a rotated file. The oldest rotated
+// files are removed when the total size of the current file and the rotated
+// files exceeds MaxTotalSizeMB. The writes are skipped while the free space
+// of the filesystem is below MinFreeMB and resumed once there is enough free
+// space again. The guard is in front of the output buffer so that the lines
+// are skipped whole. It is safe for concurrent use.
+type guardedFile struct {
+	file rotatedFile
+	// w writes to the file through the output buffer
+	w io.Writer
+
+	config Output
+	// location is the location of the periods in the names of the rotated
+	// files
+	location *time.Location
+	logger   *logrus.Entry
+	now      func() time.Time
+
+	mu           sync.Mutex
+	checkedAt    time.Time
+	writtenBytes int64
+
+	// paused, pausedLines (the number of lines skipped during the current
+	// pause) and skippedLines are accessed atomically
+	paused          int32
+	pausedLines     uint64
+	skippedLines    uint64
+	lastSkipWarnAt  int64
+	lastCheckWarnAt int64
+}
+
+func newGuardedFile(file rotatedFile, config Output, logger *logrus.Entry) (*guardedFile, error) {
+	if config.MinFreeMB > 0 && !freeSpaceSupported {
+		return nil, xerrors.Errorf("min free space is only supported on linux")
+	}
+
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load time zone: %s: %w", config.TimeZone, err)
+	}
+
+	return &guardedFile{
+		file:     file,
+		config:   config,
+		location: location,
+		logger:   logger.WithField("output", config.Name),
+		now:      time.Now,
+	}, nil
+}
+
+// Write writes a line unless the writes are paused.
+func (f *guardedFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+
+	if f.checkedAt.IsZero() || now.Sub(f.checkedAt) >= guardCheckInterval || f.writtenBytes >= guardCheckBytes {
+		f.check(now)
+	}
+
+	if f.isPaused() {
+		f.skip(b, now)
+		return len(b), nil
+	}
+
+	n, err := f.w.Write(b)
+	f.writtenBytes += int64(n)
+	return n, err
+}
+
+// fileWriter returns the writer of the file behind the output buffer. With
+// MinFreeMB the writes are paused if the filesystem gets full between the
+// checks of the free space.
+func (f *guardedFile) fileWriter() io.Writer {
+	if f.config.MinFreeMB <= 0 {
+		return f.file
+	}
+	return &noSpaceWriter{guard: f}
+}
+
+// noSpaceWriter writes to the file of the guard. The writes are paused instead
+// of failing with ENOSPC and the data that did not fit is skipped. The rest of
+// a line that did not fit is skipped too and a line cut off in the file is
+// ended before the next write so that the lines written after the resume are
+// not appended to it. The writes are serialized by the guard or by the output
+// buffer.
+type noSpaceWriter struct {
+	guard *guardedFile
+
+	// midLine is set if the data written to the file ends in the middle of a
+	// line
+	midLine bool
+	// cut is set if the file ends with a line cut off by ENOSPC
+	cut bool
+	// skipping is set until the end of a line that did not fit
+	skipping bool
+}
+
+func (w *noSpaceWriter) Write(b []byte) (int, error) {
+	size := len(b)
+
+	if w.skipping {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			return size, nil
+		}
+		w.skipping = false
+		b = b[i+1:]
+		if len(b) == 0 {
+			return size, nil
+		}
+	}
+
+	if w.cut {
+		b = append([]byte{'\n'}, b...)
+	}
+
+	n, err := w.guard.file.Write(b)
+	if n > 0 {
+		w.cut = false
+		w.midLine = b[n-1] != '\n'
+	}
+	if err != nil && xerrors.Is(err, syscall.ENOSPC) {
+		w.cut = w.midLine
+		w.skipping = b[len(b)-1] != '\n'
+		w.guard.noSpace(b[n:])
+		return size, nil
+	}
+	if err != nil {
+		// the skipped bytes are reported as written, the added newline is not
+		written := n - (len(b) - size)
+		if written < 0 {
+			written = 0
+		}
+		return written, err
+	}
+
+	return size, nil
+}
+
+// noSpace pauses the writes after the filesystem got full. It can be called by
+// Write through the output buffer so it does not take f.mu.
+func (f *guardedFile) noSpace(b []byte) {
+	now := f.now()
+
+	if atomic.CompareAndSwapInt32(&f.paused, 0, 1) {
+		atomic.StoreUint64(&f.pausedLines, 0)
+
+		f.logger.WithFields(logrus.Fields{
+			"minFreeMB": f.config.MinFreeMB,
+		}).Warn("LogFilter output paused, no space left on device")
+	}
+
+	f.skip(b, now)
+}
+
+// skip counts the skipped lines (also the line that is not ended in b) and
+// logs a rate-limited warning.
+func (f *guardedFile) skip(b []byte, now time.Time) {
+	lines := uint64(bytes.Count(b, []byte{'\n'}))
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		lines++
+	}
+	atomic.AddUint64(&f.pausedLines, lines)
+	skipped := atomic.AddUint64(&f.skippedLines, lines)
+
+	if !warnAllowed(&f.lastSkipWarnAt, now) {
+		return
+	}
+
+	f.logger.WithFields(logrus.Fields{
+		"skippedLines": skipped,
+		"minFreeMB":    f.config.MinFreeMB,
+	}).Warn("LogFilter output skipping lines, not enough free space")
+}
+
+// check enforces the disk quota and pauses or resumes the writes based on the
+// free space.
+func (f *guardedFile) check(now time.Time) {
+	f.checkedAt = now
+	f.writtenBytes = 0
+
+	if f.config.MaxTotalSizeMB > 0 {
+		if err := f.enforceQuota(); err != nil && warnAllowed(&f.lastCheckWarnAt, now) {
+			f.logger.WithError(err).Warn("LogFilter failed to enforce output quota")
+		}
+	}
+
+	if f.config.MinFreeMB > 0 {
+		f.checkFreeSpace(now)
+	}
+}
+
+// enforceQuota removes the oldest rotated files until the total size of the
+// current file and the rotated files is within MaxTotalSizeMB. The current
+// file is never removed.
+func (f *guardedFile) enforceQuota() error {
+	quota := int64(f.config.MaxTotalSizeMB) * megabyte
+
+	current := f.file.currentFilename()
+
+	var total int64
+	if info, err := os.Stat(current); err == nil {
+		total = info.Size()
+	}
+
+	files, err := oldFiles(f.config.Filename, current, f.location)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		total += file.Size()
+	}
+
+	dir := filepath.Dir(f.config.Filename)
+
+	// the files are sorted from the newest to the oldest
+	for i := len(files) - 1; i >= 0 && total > quota; i-- {
+		if err := os.Remove(filepath.Join(dir, files[i].Name())); err != nil && !os.IsNotExist(err) {
+			return xerrors.Errorf("failed to remove old output file: %w", err)
+		}
+		total -= files[i].Size()
+
+		f.logger.WithFields(logrus.Fields{
+			"file":           files[i].Name(),
+			"maxTotalSizeMB": f.config.MaxTotalSizeMB,
+		}).Info("LogFilter output file removed over quota")
+	}
+
+	return nil
+}
+
+func (f *guardedFile) checkFreeSpace(now time.Time) {
+	free, err := freeSpace(filepath.Dir(f.config.Filename))
+	if err != nil {
+		// the writes are not paused if the free space is unknown
+		if warnAllowed(&f.lastCheckWarnAt, now) {
+			f.logger.WithError(err).Warn("LogFilter failed to check output free space")
+		}
+		return
+	}
+
+	enough := free >= uint64(f.config.MinFreeMB)*megabyte
+
+	switch {
+	case !enough && !f.isPaused():
+		atomic.StoreUint64(&f.pausedLines, 0)
+		atomic.StoreInt32(&f.paused, 1)
+
+		f.logger.WithFields(logrus.Fields{
+			"freeBytes": free,
+			"minFreeMB": f.config.MinFreeMB,
+		}).Warn("LogFilter output paused, not enough free space")
+	case enough && f.isPaused():
+		atomic.StoreInt32(&f.paused, 0)
+
+		f.logger.WithFields(logrus.Fields{
+			"freeBytes":    free,
+			"skippedLines": atomic.LoadUint64(&f.pausedLines),
+		}).Info("LogFilter output resumed")
+	}
+}
+
+// isPaused reports if the writes are skipped because of the free space.
+func (f *guardedFile) isPaused() bool {
+	return atomic.LoadInt32(&f.paused) == 1
+}
+
+// skipped returns the number of lines skipped because of the free space.
+func (f *guardedFile) skipped() uint64 {
+	return atomic.LoadUint64(&f.skippedLines)
+}
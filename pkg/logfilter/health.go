@@ -0,0 +1,294 @@
+package logfilter
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// HealthProblem is a reason why the logfilter is unhealthy.
+type HealthProblem struct {
+	Check  string     `json:"check"`
+	Reason string     `json:"reason"`
+	Since  time.Time  `json:"since"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// Health tracks the named health checks that are currently failing. It is safe
+// for concurrent use.
+type Health struct {
+	mu       sync.Mutex
+	problems map[string]HealthProblem
+}
+
+func NewHealth() *Health {
+	return &Health{
+		problems: map[string]HealthProblem{},
+	}
+}
+
+// SetUnhealthy marks the check as failing. If duration is greater than 0 the
+// check recovers automatically after the duration.
+func (h *Health) SetUnhealthy(check string, reason string, duration time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+
+	problem := HealthProblem{
+		Check:  check,
+		Reason: reason,
+		Since:  now,
+	}
+	if existing, ok := h.problems[check]; ok {
+		problem.Since = existing.Since
+	}
+	if duration > 0 {
+		until := now.Add(duration)
+		problem.Until = &until
+	}
+
+	h.problems[check] = problem
+}
+
+// SetHealthy marks the check as passing.
+func (h *Health) SetHealthy(check string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.problems, check)
+}
+
+// Problems returns the currently failing checks sorted by the check name.
+func (h *Health) Problems() []HealthProblem {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+
+	problems := []HealthProblem{}
+	for check, problem := range h.problems {
+		if problem.Until != nil && !now.Before(*problem.Until) {
+			delete(h.problems, check)
+			continue
+		}
+		problems = append(problems, problem)
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Check < problems[j].Check
+	})
+
+	return problems
+}
+
+// IsHealthy returns true if no checks are failing.
+func (h *Health) IsHealthy() bool {
+	return len(h.Problems()) == 0
+}
+
+// trackedWriter records the start time of the write in progress so that the
+// stuck writes can be detected.
+type trackedWriter struct {
+	// writeStartedAt is accessed atomically and must be 64-bit aligned
+	writeStartedAt int64
+
+	name string
+	w    io.Writer
+}
+
+func newTrackedWriter(name string, w io.Writer) *trackedWriter {
+	return &trackedWriter{
+		name: name,
+		w:    w,
+	}
+}
+
+func (w *trackedWriter) Write(b []byte) (int, error) {
+	atomic.StoreInt64(&w.writeStartedAt, time.Now().UnixNano())
+	n, err := w.w.Write(b)
+	atomic.StoreInt64(&w.writeStartedAt, 0)
+	return n, err
+}
+
+// writeDuration returns the duration of the write in progress or 0.
+func (w *trackedWriter) writeDuration(now time.Time) time.Duration {
+	writeStartedAt := atomic.LoadInt64(&w.writeStartedAt)
+	if writeStartedAt == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, writeStartedAt))
+}
+
+// HealthStatus is the response body of the health endpoints.
+type HealthStatus struct {
+	Status   string          `json:"status"`
+	Problems []HealthProblem `json:"problems"`
+}
+
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusFail = "fail"
+)
+
+// LivenessProblems returns the reasons why the logfilter is not healthy: the
+// pipeline is not running, a writer is stuck, a command is not running or a
+// check (trigger, watchdog) is failing.
+func (f *LogFilter) LivenessProblems() []HealthProblem {
+	now := time.Now()
+
+	problems := []HealthProblem{}
+
+	addProblem := func(check string, reason string) {
+		problems = append(problems, HealthProblem{
+			Check:  check,
+			Reason: reason,
+			Since:  now,
+		})
+	}
+
+	if f.ctx.Err() != nil {
+		addProblem("pipeline", "shutting down")
+	} else {
+		select {
+		case <-f.writerDone:
+			addProblem("pipeline", "writer stopped")
+		default:
+		}
+	}
+
+	for _, w := range f.trackedWriters {
+		if d := w.writeDuration(now); f.config.WriterStuckTimeout > 0 && d >= f.config.WriterStuckTimeout {
+			addProblem("writer/"+w.name, "write in progress for "+d.Round(time.Millisecond).String())
+		}
+	}
+
+	for _, p := range f.procs {
+		state := p.commander.State()
+		if state.Running {
+			continue
+		}
+		if f.config.ReadyOnExit && state.Exited && state.ExitCode == 0 {
+			continue
+		}
+		reason := "not running"
+		if state.Exited {
+			reason = "exited: " + state.ExitError
+			if state.ExitError == "" {
+				reason = "exited"
+			}
+		}
+		addProblem(p.check("proc"), reason)
+	}
+
+	problems = append(problems, f.health.Problems()...)
+
+	return problems
+}
+
+// ReadinessProblems returns the liveness problems and the reasons why the
+// command is not ready yet: the ready line was not matched yet or the command
+// has not exited successfully yet (ReadyOnExit).
+func (f *LogFilter) ReadinessProblems() []HealthProblem {
+	problems := f.LivenessProblems()
+
+	now := time.Now()
+
+	if f.readyMatcher != nil && atomic.LoadInt32(&f.readyMatched) == 0 {
+		problems = append(problems, HealthProblem{
+			Check:  "ready",
+			Reason: "ready line not matched yet",
+			Since:  now,
+		})
+	}
+
+	if f.config.ReadyOnExit {
+		for _, p := range f.procs {
+			state := p.commander.State()
+			if !state.Exited || state.Running || state.ExitCode != 0 {
+				problems = append(problems, HealthProblem{
+					Check:  p.check("ready"),
+					Reason: "command has not exited successfully yet",
+					Since:  now,
+				})
+			}
+		}
+	}
+
+	return problems
+}
+
+func (f *LogFilter) initReadiness() error {
+	if f.config.ReadyTemplate != "" && f.config.ReadyQuery != "" {
+		return xerrors.Errorf("cannot use both ready template and ready query")
+	}
+
+	if f.config.ReadyOnExit && len(f.procs) == 0 {
+		return xerrors.Errorf("ready on exit requires a command")
+	}
+
+	if f.config.ReadyTemplate != "" || f.config.ReadyQuery != "" {
+		matcher, err := newLineMatcher(f.config.ReadyTemplate, f.config.ReadyQuery)
+		if err != nil {
+			return xerrors.Errorf("failed to build ready matcher: %w", err)
+		}
+		f.readyMatcher = matcher
+	}
+
+	return nil
+}
+
+// observeReadiness marks the logfilter ready after the first line matching
+// the ready condition.
+func (f *LogFilter) observeReadiness(l line) {
+	if f.readyMatcher == nil || atomic.LoadInt32(&f.readyMatched) == 1 {
+		return
+	}
+
+	if f.readyMatcher.Match(l.event) {
+		atomic.StoreInt32(&f.readyMatched, 1)
+
+		f.logger.WithFields(logrus.Fields{
+			"line":   string(l.b),
+			"stream": l.stream.name,
+		}).Info("Ready line matched")
+	}
+}
+
+// resetReadiness requires the ready line again after the command exits so that
+// the restarted command is not reported ready before it logs the ready line.
+func (f *LogFilter) resetReadiness() {
+	if f.readyMatcher == nil {
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&f.readyMatched, 1, 0) {
+		f.logger.Info("Ready line reset after command exit")
+	}
+}
+
+func healthHandler(problemsFn func() []HealthProblem) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := HealthStatus{
+			Status:   HealthStatusOK,
+			Problems: problemsFn(),
+		}
+
+		code := http.StatusOK
+		if len(status.Problems) > 0 {
+			status.Status = HealthStatusFail
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
@@ -0,0 +1,207 @@
+package logfilter_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Health", func() {
+	getStatus := func(logFilter *LogFilter, path string) (int, HealthStatus) {
+		resp, err := http.Get("http://" + logFilter.DebugAddr().String() + path)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+
+		status := HealthStatus{}
+		Expect(json.NewDecoder(resp.Body).Decode(&status)).To(Succeed())
+
+		return resp.StatusCode, status
+	}
+
+	It("should report readiness after the ready line", func() {
+		script := `
+			echo '{"MessageTemplate":"Starting"}'
+			sleep 0.3
+			echo '{"MessageTemplate":"Application started"}'
+			exec sleep 5
+		`
+
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", script}
+		config.CmdShutdownTimeout = 100 * time.Millisecond
+		config.ReadyQuery = `select(.MessageTemplate == "Application started")`
+
+		logFilter := NewLogFilter(config, nil, &syncBuffer{}, Logger)
+
+		ctx, cancel := context.WithCancel(TestCtx)
+		defer cancel()
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+		defer logFilter.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		Eventually(func() int {
+			code, _ := getStatus(logFilter, "/healthz")
+			return code
+		}).Should(Equal(http.StatusOK))
+
+		code, status := getStatus(logFilter, "/readyz")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(status.Status).To(Equal(HealthStatusFail))
+		Expect(status.Problems).To(HaveLen(1))
+		Expect(status.Problems[0].Check).To(Equal("ready"))
+		Expect(status.Problems[0].Reason).To(Equal("ready line not matched yet"))
+
+		Eventually(func() int {
+			code, _ := getStatus(logFilter, "/readyz")
+			return code
+		}).Should(Equal(http.StatusOK))
+
+		cancel()
+		Eventually(done).Should(Receive())
+	})
+
+	It("should require the ready line again after the command restarts", func() {
+		tmpDir, err := ioutil.TempDir("", "logfilter-test-")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+
+		script := `
+			echo x >> "$0"
+			if [ "$(wc -l < "$0")" -lt 2 ]; then
+				echo '{"msg":"ready"}'
+				sleep 0.3
+				exit 1
+			fi
+			sleep 0.5
+			echo '{"msg":"ready"}'
+			exec sleep 5
+		`
+
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", script, filepath.Join(tmpDir, "counter")}
+		config.CmdShutdownTimeout = 100 * time.Millisecond
+		config.CmdRestartPolicy = RestartAlways
+		config.CmdRestartDelay = 10 * time.Millisecond
+		config.ReadyQuery = `select(.msg == "ready")`
+
+		logFilter := NewLogFilter(config, nil, &syncBuffer{}, Logger)
+
+		ctx, cancel := context.WithCancel(TestCtx)
+		defer cancel()
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+		defer logFilter.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		readyCode := func() int {
+			code, _ := getStatus(logFilter, "/readyz")
+			return code
+		}
+
+		Eventually(readyCode).Should(Equal(http.StatusOK))
+		Eventually(readyCode).Should(Equal(http.StatusServiceUnavailable))
+		Eventually(readyCode).Should(Equal(http.StatusOK))
+
+		cancel()
+		Eventually(done).Should(Receive())
+	})
+
+	It("should report a stuck writer and a stopped command", func() {
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", "echo line"}
+		config.CmdRestartPolicy = RestartAlways
+		config.CmdRestartDelay = 10 * time.Second
+		config.WriterStuckTimeout = 100 * time.Millisecond
+
+		writeBlock := make(chan struct{})
+
+		writer := funcWriter(func(b []byte) (int, error) {
+			<-writeBlock
+			return len(b), nil
+		})
+
+		logFilter := NewLogFilter(config, nil, writer, Logger)
+
+		ctx, cancel := context.WithCancel(TestCtx)
+		defer cancel()
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+		defer logFilter.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		Eventually(func() []string {
+			checks := []string{}
+			for _, problem := range logFilter.LivenessProblems() {
+				checks = append(checks, problem.Check)
+			}
+			return checks
+		}).Should(ConsistOf("writer/stdout", "proc"))
+
+		code, status := getStatus(logFilter, "/healthz")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(status.Problems).To(HaveLen(2))
+
+		cancel()
+		close(writeBlock)
+		Eventually(done).Should(Receive())
+	})
+
+	It("should report ready after the command exited successfully", func() {
+		config := &Config{}
+		config.Procs = Procs{
+			{Name: "migrate", Cmd: []string{"true"}},
+			{Name: "web", Cmd: []string{"bash", "-c", "exec sleep 5"}},
+		}
+		config.ProcsExitPolicy = ProcsExitContinue
+		config.CmdShutdownTimeout = 100 * time.Millisecond
+		config.ReadyOnExit = true
+
+		logFilter := NewLogFilter(config, nil, ioutil.Discard, Logger)
+
+		ctx, cancel := context.WithCancel(TestCtx)
+		defer cancel()
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.ReadinessProblems()).NotTo(BeEmpty())
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		Eventually(func() []string {
+			reasons := []string{}
+			for _, problem := range logFilter.ReadinessProblems() {
+				reasons = append(reasons, problem.Check+": "+problem.Reason)
+			}
+			return reasons
+		}).Should(Equal([]string{"ready/web: command has not exited successfully yet"}))
+
+		cancel()
+		Eventually(done).Should(Receive())
+	})
+})
@@ -1,14 +1,16 @@
 package logfilter
 
 import (
-	"encoding/json"
-
 	"github.com/itchyny/gojq"
 	"golang.org/x/xerrors"
 )
 
 type JQJSONFilter struct {
 	Code *gojq.Code
+
+	// fields are the top-level fields used by the query or nil if the query
+	// needs the whole document
+	fields map[string]struct{}
 }
 
 func NewJQJSONFilter(queryStr string) (*JQJSONFilter, error) {
@@ -21,17 +23,25 @@ func NewJQJSONFilter(queryStr string) (*JQJSONFilter, error) {
 		return nil, xerrors.Errorf("failed to compile JQ query: %s: %w", query, err)
 	}
 
-	return &JQJSONFilter{
+	f := &JQJSONFilter{
 		Code: code,
-	}, nil
+	}
+
+	if fields, ok := queryFields(query); ok {
+		f.fields = fields
+	}
+
+	return f, nil
 }
 
 func (f *JQJSONFilter) IsIncluded(b []byte) (bool, error) {
-	var input map[string]interface{}
+	return f.process(newEvent(b))
+}
 
-	err := json.Unmarshal(b, &input)
+func (f *JQJSONFilter) process(e *event) (bool, error) {
+	input, err := e.json().object(f.fields)
 	if err != nil {
-		return false, xerrors.Errorf("failed to parse json: %s: %w", string(b), err)
+		return false, xerrors.Errorf("failed to parse json: %s: %w", string(e.raw), err)
 	}
 
 	iter := f.Code.Run(input)
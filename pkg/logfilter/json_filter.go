@@ -1,5 +1,10 @@
 package logfilter
 
+import (
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
 type JSONFilter interface {
 	IsIncluded(b []byte) (bool, error)
 }
@@ -9,3 +14,67 @@ type StaticJSONFilter bool
 func (f StaticJSONFilter) IsIncluded(b []byte) (bool, error) {
 	return bool(f), nil
 }
+
+// NewJSONFilter builds a JSON filter from either an exclude template or a JQ
+// filter query. If both are empty all lines are included.
+func NewJSONFilter(excludeTemplate string, filterQuery string, logger *logrus.Entry) (JSONFilter, error) {
+	if excludeTemplate != "" && filterQuery != "" {
+		return nil, xerrors.Errorf("cannot use both exclude template and filter query")
+	}
+
+	if excludeTemplate != "" {
+		logger.WithField("excludeTemplate", excludeTemplate).Debug("Initializing template JSON filter")
+
+		jsonFilter, err := NewTemplateJSONFilter(excludeTemplate)
+		if err != nil {
+			return nil, err
+		}
+		return jsonFilter, nil
+	}
+
+	if filterQuery != "" {
+		logger.WithField("filterQuery", filterQuery).Debug("Initializing JQ JSON filter")
+
+		jsonFilter, err := NewJQJSONFilter(filterQuery)
+		if err != nil {
+			return nil, err
+		}
+		return jsonFilter, nil
+	}
+
+	return StaticJSONFilter(true), nil
+}
+
+// NewFullOutputJSONFilter builds the filter of the full output from either an
+// exclude template, a JQ filter query or an exclude regex. If all are empty
+// all lines are included.
+func NewFullOutputJSONFilter(excludeTemplate string, filterQuery string, excludeRegex string, logger *logrus.Entry) (JSONFilter, error) {
+	if excludeRegex == "" {
+		return NewJSONFilter(excludeTemplate, filterQuery, logger)
+	}
+
+	if excludeTemplate != "" || filterQuery != "" {
+		return nil, xerrors.Errorf("cannot use exclude regex together with exclude template or filter query")
+	}
+
+	logger.WithField("excludeRegex", excludeRegex).Debug("Initializing regex JSON filter")
+
+	jsonFilter, err := NewRegexJSONFilter(excludeRegex)
+	if err != nil {
+		return nil, err
+	}
+	return jsonFilter, nil
+}
+
+func (f StaticJSONFilter) process(e *event) (bool, error) {
+	return bool(f), nil
+}
+
+// filterEvent evaluates the JSON filter on the shared event. The filters that
+// are not stages get the raw line.
+func filterEvent(jsonFilter JSONFilter, e *event) (bool, error) {
+	if s, ok := jsonFilter.(stage); ok {
+		return s.process(e)
+	}
+	return jsonFilter.IsIncluded(e.raw)
+}
@@ -0,0 +1,577 @@
+package logfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"text/template/parse"
+
+	"github.com/itchyny/gojq"
+)
+
+// lazyJSON is a JSON document decoded on demand. The top-level fields of an
+// object are indexed on the first access and each field is decoded at most
+// once, so the stages that need different fields share the decoding. Only the
+// structure of the object and the decoded fields are validated, the document
+// is decoded fully if they are invalid.
+type lazyJSON struct {
+	raw []byte
+
+	indexed bool
+	// obj is set if raw is a valid JSON object
+	obj    bool
+	fields []lazyField
+
+	// decoded is set after the whole document was decoded into value or err
+	decoded bool
+	value   interface{}
+	err     error
+}
+
+// lazyField is a top-level field of an object.
+type lazyField struct {
+	// key is the unescaped key
+	key     []byte
+	raw     []byte
+	decoded bool
+	value   interface{}
+	err     error
+}
+
+func newLazyJSON(raw []byte) *lazyJSON {
+	return &lazyJSON{
+		raw: raw,
+	}
+}
+
+// object returns the decoded object with only the given fields or with all
+// the fields if fields is nil. The returned map is owned by the caller but the
+// field values are shared.
+func (j *lazyJSON) object(fields map[string]struct{}) (map[string]interface{}, error) {
+	if !j.isObject() {
+		return j.unmarshalObject()
+	}
+
+	if fields == nil {
+		obj := make(map[string]interface{}, len(j.fields))
+		// the last duplicate key wins like in json.Unmarshal
+		for i := range j.fields {
+			value, err := j.fields[i].decode()
+			if err != nil {
+				return j.invalid()
+			}
+			obj[string(j.fields[i].key)] = value
+		}
+		return obj, nil
+	}
+
+	obj := make(map[string]interface{}, len(fields))
+	for name := range fields {
+		if field := j.field(name); field != nil {
+			value, err := field.decode()
+			if err != nil {
+				return j.invalid()
+			}
+			obj[name] = value
+		}
+	}
+	return obj, nil
+}
+
+// unmarshalObject decodes the whole document to report the same errors as the
+// full decoding.
+func (j *lazyJSON) unmarshalObject() (map[string]interface{}, error) {
+	var obj map[string]interface{}
+	err := json.Unmarshal(j.raw, &obj)
+	return obj, err
+}
+
+// invalid falls back to the full decoding after a field failed to decode.
+func (j *lazyJSON) invalid() (map[string]interface{}, error) {
+	j.obj = false
+	j.fields = nil
+	return j.unmarshalObject()
+}
+
+// decode returns the whole decoded document.
+func (j *lazyJSON) decode() (interface{}, error) {
+	if j.decoded {
+		return j.value, j.err
+	}
+
+	if j.isObject() {
+		var obj map[string]interface{}
+		obj, j.err = j.object(nil)
+		if j.err == nil {
+			j.value = obj
+		}
+	} else {
+		j.err = json.Unmarshal(j.raw, &j.value)
+	}
+	j.decoded = true
+
+	return j.value, j.err
+}
+
+// isObject returns true if the document is a JSON object. The values of the
+// fields are validated when they are decoded.
+func (j *lazyJSON) isObject() bool {
+	j.index()
+	return j.obj
+}
+
+// field returns the last field with the key or nil.
+func (j *lazyJSON) field(key string) *lazyField {
+	for i := len(j.fields) - 1; i >= 0; i-- {
+		// the conversion in the comparison does not allocate
+		if string(j.fields[i].key) == key {
+			return &j.fields[i]
+		}
+	}
+	return nil
+}
+
+// index finds the top-level fields if the document is a JSON object. Only
+// the spans walked by the scanner are validated (the braces, the keys, the
+// colons and the commas), the values are validated when they are decoded.
+func (j *lazyJSON) index() {
+	if j.indexed {
+		return
+	}
+	j.indexed = true
+
+	b := j.raw
+
+	i := skipSpace(b, 0)
+	if i >= len(b) || b[i] != '{' {
+		return
+	}
+	i = skipSpace(b, i+1)
+
+	fields := make([]lazyField, 0, 8)
+
+	if i < len(b) && b[i] != '}' {
+		for {
+			if i >= len(b) || b[i] != '"' {
+				return
+			}
+			keyStart := i
+			i = skipString(b, i)
+			if i < 0 {
+				return
+			}
+			key := unquoteKey(b[keyStart:i])
+			if key == nil {
+				return
+			}
+
+			i = skipSpace(b, i)
+			if i >= len(b) || b[i] != ':' {
+				return
+			}
+			i = skipSpace(b, i+1)
+
+			valueStart := i
+			i = skipValue(b, i)
+			if i < 0 {
+				return
+			}
+
+			fields = append(fields, lazyField{
+				key: key,
+				raw: b[valueStart:i],
+			})
+
+			i = skipSpace(b, i)
+			if i < len(b) && b[i] == '}' {
+				break
+			}
+			if i >= len(b) || b[i] != ',' {
+				return
+			}
+			i = skipSpace(b, i+1)
+		}
+	}
+
+	// only spaces can follow the object
+	if i >= len(b) || skipSpace(b, i+1) != len(b) {
+		return
+	}
+
+	j.fields = fields
+	j.obj = true
+}
+
+func (f *lazyField) decode() (interface{}, error) {
+	if !f.decoded {
+		f.err = json.Unmarshal(f.raw, &f.value)
+		f.decoded = true
+	}
+	return f.value, f.err
+}
+
+// unquoteKey returns the key without the quotes. Only the keys with escapes
+// are copied.
+func unquoteKey(quotedKey []byte) []byte {
+	rawKey := quotedKey[1 : len(quotedKey)-1]
+
+	if bytes.IndexByte(rawKey, '\\') < 0 {
+		return rawKey
+	}
+
+	var key string
+	if err := json.Unmarshal(quotedKey, &key); err != nil {
+		return nil
+	}
+	return []byte(key)
+}
+
+func skipSpace(b []byte, i int) int {
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t' || b[i] == '\r' || b[i] == '\n') {
+		i++
+	}
+	return i
+}
+
+// skipString returns the index after the string starting at i or -1 if the
+// string is not terminated or contains a control character.
+func skipString(b []byte, i int) int {
+	for i++; i < len(b); i++ {
+		switch {
+		case b[i] == '\\':
+			i++
+		case b[i] == '"':
+			return i + 1
+		case b[i] < 0x20:
+			return -1
+		}
+	}
+	return -1
+}
+
+// skipValue returns the index after the value starting at i or -1 if the end
+// of the value is not found. The value itself is not validated.
+func skipValue(b []byte, i int) int {
+	if i >= len(b) {
+		return -1
+	}
+
+	switch b[i] {
+	case '"':
+		return skipString(b, i)
+	case '{', '[':
+		depth := 0
+		for i < len(b) {
+			switch b[i] {
+			case '"':
+				i = skipString(b, i)
+				if i < 0 {
+					return -1
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+			i++
+		}
+		return -1
+	}
+
+	start := i
+	for i < len(b) {
+		switch b[i] {
+		case ',', '}', ']', ' ', '\t', '\r', '\n':
+			if i == start {
+				return -1
+			}
+			return i
+		}
+		i++
+	}
+	return -1
+}
+
+// queryFields returns the top-level fields referenced by the JQ query. It
+// returns false if the query might need the whole document.
+func queryFields(query *gojq.Query) (map[string]struct{}, bool) {
+	fields := map[string]struct{}{}
+	if !analyzeQuery(query, true, fields) {
+		return nil, false
+	}
+	return fields, true
+}
+
+// analyzeQuery collects the top-level fields referenced by the query. root is
+// true if the input of the query is the whole document. The queries with a
+// different input can access anything.
+func analyzeQuery(q *gojq.Query, root bool, fields map[string]struct{}) bool {
+	if q == nil || !root {
+		return true
+	}
+
+	if q.Meta != nil || len(q.Imports) > 0 || len(q.FuncDefs) > 0 || q.Func != "" {
+		return false
+	}
+
+	if q.Term != nil {
+		return analyzeTerm(q.Term, fields)
+	}
+
+	switch q.Op {
+	case gojq.OpPipe:
+		return analyzeQuery(q.Left, true, fields) && analyzeQuery(q.Right, !isSubvalueQuery(q.Left), fields)
+	case gojq.OpComma, gojq.OpAdd, gojq.OpSub, gojq.OpMul, gojq.OpDiv, gojq.OpMod,
+		gojq.OpEq, gojq.OpNe, gojq.OpGt, gojq.OpLt, gojq.OpGe, gojq.OpLe,
+		gojq.OpAnd, gojq.OpOr, gojq.OpAlt:
+		return analyzeQuery(q.Left, true, fields) && analyzeQuery(q.Right, true, fields)
+	}
+
+	return false
+}
+
+// isSubvalueQuery returns true if the output of the query is never the whole
+// document.
+func isSubvalueQuery(q *gojq.Query) bool {
+	if q.Term == nil || len(q.FuncDefs) > 0 {
+		return false
+	}
+
+	switch q.Term.Type {
+	case gojq.TermTypeIndex:
+		for _, suffix := range q.Term.SuffixList {
+			if suffix.Bind != nil {
+				return false
+			}
+		}
+		return true
+	case gojq.TermTypeNull, gojq.TermTypeTrue, gojq.TermTypeFalse, gojq.TermTypeNumber, gojq.TermTypeString:
+		return len(q.Term.SuffixList) == 0
+	}
+
+	return false
+}
+
+// rootFuncs are the functions that can be applied to the whole document
+// because they do not depend on its fields.
+var rootFuncs = map[string]bool{
+	"select": true,
+	"not":    true,
+	"empty":  true,
+}
+
+func analyzeTerm(t *gojq.Term, fields map[string]struct{}) bool {
+	switch t.Type {
+	case gojq.TermTypeIndex:
+		field, ok := literalIndex(t.Index)
+		if !ok {
+			return false
+		}
+		fields[field] = struct{}{}
+		return analyzeSuffixes(t.SuffixList, fields)
+
+	case gojq.TermTypeNull, gojq.TermTypeTrue, gojq.TermTypeFalse, gojq.TermTypeNumber, gojq.TermTypeBreak:
+		return len(t.SuffixList) == 0
+
+	case gojq.TermTypeString:
+		return analyzeString(t.Str, fields) && len(t.SuffixList) == 0
+
+	case gojq.TermTypeFunc:
+		if strings.HasPrefix(t.Func.Name, "$") {
+			return len(t.Func.Args) == 0 && analyzeSuffixes(t.SuffixList, fields)
+		}
+		if !rootFuncs[t.Func.Name] || len(t.SuffixList) > 0 {
+			return false
+		}
+		for _, arg := range t.Func.Args {
+			if !analyzeQuery(arg, true, fields) {
+				return false
+			}
+		}
+		return true
+
+	case gojq.TermTypeObject:
+		for _, kv := range t.Object.KeyVals {
+			switch {
+			case kv.KeyOnly != "":
+				if !strings.HasPrefix(kv.KeyOnly, "$") {
+					fields[kv.KeyOnly] = struct{}{}
+				}
+			case kv.KeyOnlyString != nil:
+				if kv.KeyOnlyString.Queries != nil {
+					return false
+				}
+				fields[kv.KeyOnlyString.Str] = struct{}{}
+			}
+			if !analyzeString(kv.KeyString, fields) || !analyzeQuery(kv.KeyQuery, true, fields) {
+				return false
+			}
+			if kv.Val != nil {
+				for _, q := range kv.Val.Queries {
+					if !analyzeQuery(q, true, fields) {
+						return false
+					}
+				}
+			}
+		}
+		return analyzeSuffixes(t.SuffixList, fields)
+
+	case gojq.TermTypeArray:
+		return analyzeQuery(t.Array.Query, true, fields) && analyzeSuffixes(t.SuffixList, fields)
+
+	case gojq.TermTypeUnary:
+		return analyzeTerm(t.Unary.Term, fields) && len(t.SuffixList) == 0
+
+	case gojq.TermTypeIf:
+		if !analyzeQuery(t.If.Cond, true, fields) || !analyzeQuery(t.If.Then, true, fields) || !analyzeQuery(t.If.Else, true, fields) {
+			return false
+		}
+		for _, elif := range t.If.Elif {
+			if !analyzeQuery(elif.Cond, true, fields) || !analyzeQuery(elif.Then, true, fields) {
+				return false
+			}
+		}
+		return len(t.SuffixList) == 0
+
+	case gojq.TermTypeTry:
+		// the input of catch is the error
+		return analyzeQuery(t.Try.Body, true, fields) && len(t.SuffixList) == 0
+
+	case gojq.TermTypeQuery:
+		return analyzeQuery(t.Query, true, fields) && len(t.SuffixList) == 0
+	}
+
+	return false
+}
+
+// analyzeSuffixes analyzes the suffixes of a term whose output is not the
+// whole document. The index expressions and the bind bodies get the whole
+// document as input.
+func analyzeSuffixes(suffixes []*gojq.Suffix, fields map[string]struct{}) bool {
+	for _, suffix := range suffixes {
+		if suffix.Index != nil {
+			if !analyzeQuery(suffix.Index.Start, true, fields) || !analyzeQuery(suffix.Index.End, true, fields) {
+				return false
+			}
+		}
+		if suffix.Bind != nil {
+			if !analyzeQuery(suffix.Bind.Body, true, fields) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func analyzeString(s *gojq.String, fields map[string]struct{}) bool {
+	if s == nil {
+		return true
+	}
+	for _, q := range s.Queries {
+		if !analyzeQuery(q, true, fields) {
+			return false
+		}
+	}
+	return true
+}
+
+// literalIndex returns the field name if the index is a literal string.
+func literalIndex(index *gojq.Index) (string, bool) {
+	if index.Name != "" {
+		return index.Name, true
+	}
+	if index.Str != nil && index.Str.Queries == nil {
+		return index.Str.Str, true
+	}
+	if index.Start != nil && !index.IsSlice && index.End == nil {
+		if t := index.Start.Term; t != nil && index.Start.Right == nil && len(index.Start.FuncDefs) == 0 &&
+			t.Type == gojq.TermTypeString && t.Format == "" && t.Str.Queries == nil && len(t.SuffixList) == 0 {
+			return t.Str.Str, true
+		}
+	}
+	return "", false
+}
+
+// templateFields returns the top-level fields referenced by the template. It
+// returns false if the template might need the whole document.
+func templateFields(tree *parse.Tree) (map[string]struct{}, bool) {
+	fields := map[string]struct{}{}
+	if tree == nil || !analyzeNode(tree.Root, true, fields) {
+		return nil, false
+	}
+	return fields, true
+}
+
+// analyzeNode collects the top-level fields referenced by the template node.
+// root is true if dot is the whole document.
+func analyzeNode(node parse.Node, root bool, fields map[string]struct{}) bool {
+	switch node := node.(type) {
+	case nil:
+		return true
+	case *parse.ListNode:
+		if node == nil {
+			return true
+		}
+		for _, n := range node.Nodes {
+			if !analyzeNode(n, root, fields) {
+				return false
+			}
+		}
+		return true
+	case *parse.TextNode, *parse.CommentNode,
+		*parse.StringNode, *parse.NumberNode, *parse.BoolNode, *parse.NilNode, *parse.IdentifierNode:
+		return true
+	case *parse.ActionNode:
+		return analyzeNode(node.Pipe, root, fields)
+	case *parse.IfNode:
+		return analyzeBranch(&node.BranchNode, root, root, fields)
+	case *parse.RangeNode:
+		return analyzeBranch(&node.BranchNode, root, false, fields)
+	case *parse.WithNode:
+		return analyzeBranch(&node.BranchNode, root, false, fields)
+	case *parse.PipeNode:
+		if node == nil {
+			return true
+		}
+		for _, cmd := range node.Cmds {
+			for _, arg := range cmd.Args {
+				if !analyzeNode(arg, root, fields) {
+					return false
+				}
+			}
+		}
+		return true
+	case *parse.FieldNode:
+		if root {
+			fields[node.Ident[0]] = struct{}{}
+		}
+		return true
+	case *parse.VariableNode:
+		if node.Ident[0] != "$" {
+			return true
+		}
+		if len(node.Ident) < 2 {
+			return false
+		}
+		fields[node.Ident[1]] = struct{}{}
+		return true
+	case *parse.ChainNode:
+		return analyzeNode(node.Node, root, fields)
+	case *parse.DotNode:
+		return !root
+	}
+
+	return false
+}
+
+// analyzeBranch analyzes an if, range or with node. listRoot is true if dot is
+// the whole document in the list.
+func analyzeBranch(node *parse.BranchNode, root bool, listRoot bool, fields map[string]struct{}) bool {
+	return analyzeNode(node.Pipe, root, fields) &&
+		analyzeNode(node.List, listRoot && root, fields) &&
+		analyzeNode(node.ElseList, root, fields)
+}
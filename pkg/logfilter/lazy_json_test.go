@@ -0,0 +1,115 @@
+package logfilter_test
+
+import (
+	"bytes"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Lazy JSON", func() {
+	DescribeTable("JQ filter",
+		func(query string, line string, expected bool) {
+			jsonFilter, err := NewJQJSONFilter(query)
+			Expect(err).NotTo(HaveOccurred())
+
+			included, err := jsonFilter.IsIncluded([]byte(line))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(included).To(Equal(expected))
+		},
+		Entry("top-level field", `select(.Level != "Debug")`, `{"Properties":{"Level":"Info"},"Level":"Debug"}`, false),
+		Entry("top-level field included", `select(.Level != "Debug")`, `{"Level":"Info","Properties":{"a":[1,{"b":"}"}]}}`, true),
+		Entry("nested field", `select(.Properties.Level == "Debug")`, `{"Level":"Info","Properties":{"Level":"Debug"}}`, true),
+		Entry("escaped key", `select(.Level == "Debug")`, `{"Le\u0076el":"Debug"}`, true),
+		Entry("duplicate key", `select(.Level == "Debug")`, `{"Level":"Info","Level":"Debug"}`, true),
+		Entry("string index", `select(.["Message Template"] == "x")`, `{"Message Template":"x"}`, true),
+		Entry("pipe", `.Level | select(test("^Deb"))`, `{"Level":"Debug"}`, true),
+		Entry("index expression", `select(.Properties[.Key] == 1)`, `{"Key":"a","Properties":{"a":1}}`, true),
+		Entry("string interpolation", `select("\(.Level)-\(.Code)" == "Info-1")`, `{"Level":"Info","Code":1}`, true),
+		Entry("object construction", `select({Level, Code} == {"Level":"Info","Code":1})`, `{"Level":"Info","Code":1,"Other":2}`, true),
+		Entry("whole document length", `select(length > 2)`, `{"a":1,"b":2,"c":3}`, true),
+		Entry("whole document keys", `select(keys | length == 1)`, `{"a":1,"b":2}`, false),
+		Entry("whole document iteration", `select([.[]] | length == 2)`, `{"a":1,"b":2}`, true),
+		Entry("selected document field", `select(.a == 1) | select(.b == 2)`, `{"a":1,"b":2}`, true),
+		Entry("whole document after select", `select(.a == 1) | select(length == 2)`, `{"a":1,"b":2}`, true),
+	)
+
+	DescribeTable("template filter",
+		func(excludeTemplate string, line string, expected bool) {
+			jsonFilter, err := NewTemplateJSONFilter(excludeTemplate)
+			Expect(err).NotTo(HaveOccurred())
+
+			included, err := jsonFilter.IsIncluded([]byte(line))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(included).To(Equal(expected))
+		},
+		Entry("top-level field", `{{with .Level}}{{eq . "Debug"}}{{end}}`, `{"Properties":{"Level":"Info"},"Level":"Debug"}`, false),
+		Entry("nested field", `{{eq .Properties.Level "Debug"}}`, `{"Level":"Info","Properties":{"Level":"Debug"}}`, false),
+		Entry("root variable in with", `{{with .Properties}}{{eq $.Level "Debug"}}{{end}}`, `{"Level":"Debug","Properties":{"a":1}}`, false),
+		Entry("else branch", `{{with .Missing}}false{{else}}{{eq .Level "Debug"}}{{end}}`, `{"Level":"Debug"}`, false),
+		Entry("range", `{{range .Tags}}{{if eq . "noisy"}}true{{end}}{{end}}`, `{"Tags":["a","noisy"]}`, false),
+		Entry("whole document", `{{if eq (len .) 2}}true{{end}}`, `{"a":1,"b":2}`, false),
+		Entry("array document", `{{if eq (len .) 2}}true{{end}}`, `[1,2]`, false),
+	)
+
+	It("should fail for invalid JSON", func() {
+		jsonFilter, err := NewJQJSONFilter(`select(.Level != "Debug")`)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = jsonFilter.IsIncluded([]byte(`{"Level":"Info","Properties":{`))
+		Expect(err).To(MatchError(ContainSubstring("failed to parse json")))
+
+		_, err = jsonFilter.IsIncluded([]byte(`[1,2]`))
+		Expect(err).To(MatchError(ContainSubstring("failed to parse json")))
+
+		for _, line := range []string{
+			`{"Level":tru}`,
+			`{"Level":"Info"} x`,
+			`{"Level" "Info"}`,
+			`{"Level":"Info",}`,
+			`{"Level":"Info"`,
+		} {
+			_, err = jsonFilter.IsIncluded([]byte(line))
+			Expect(err).To(MatchError(ContainSubstring("failed to parse json")), line)
+		}
+	})
+
+	It("should share the decoded line between the stages using different fields", func() {
+		input := strings.Join([]string{
+			`{"Level":"Debug","Code":1,"Message":"d1"}`,
+			`{"Level":"Information","Code":2,"Message":"i1"}`,
+			`{"Level":"Debug","Code":3,"Message":"d2"}`,
+			`{"Level":"Error","Code":500,"Message":"e1"}`,
+		}, "\n") + "\n"
+
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.FilterQuery = `select(.Level != "Debug")`
+		config.ContextTemplate = `{{if ge .Code 500.0}}true{{end}}`
+		config.ContextBefore = 1
+		config.ReadyQuery = `select(length == 3 and .Message == "i1")`
+		config.ContextField = "logfilterContext"
+
+		output := bytes.NewBuffer(nil)
+
+		logFilter := NewLogFilter(config, strings.NewReader(input), output, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("reading stdin: EOF"))
+
+		Expect(output.String()).To(Equal(strings.Join([]string{
+			`{"Level":"Information","Code":2,"Message":"i1"}`,
+			`{"logfilterContext":"before","Level":"Debug","Code":3,"Message":"d2"}`,
+			`{"Level":"Error","Code":500,"Message":"e1"}`,
+		}, "\n") + "\n"))
+
+		for _, problem := range logFilter.ReadinessProblems() {
+			Expect(problem.Check).NotTo(Equal("ready"))
+		}
+	})
+})
@@ -7,18 +7,79 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-var newLine = []byte{'\n'}
+// dropWarnInterval is the minimum interval between the warnings about the
+// lines dropped by the buffer policy or the oversized lines.
+const dropWarnInterval = 10 * time.Second
+
+const (
+	StreamStdin  = "stdin"
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+	StreamFD     = "fd"
+)
+
+// stream is a source of lines with its own filter and output.
+type stream struct {
+	// lastLineAt and the counters are accessed atomically and must be 64-bit
+	// aligned
+	lastLineAt          int64
+	lastDropWarnAt      int64
+	lastOversizedWarnAt int64
+	lines               uint64
+	bytes               uint64
+	included            uint64
+	excluded            uint64
+	dropped             uint64
+	oversized           uint64
+
+	name       string
+	kind       string
+	reader     io.Reader
+	jsonFilter JSONFilter
+	writer     io.Writer
+	label      *procLabel
+	proc       *proc
+	recent     *recentLines
+	progress   *scanProgress
+}
+
+// line is a scanned line together with its source stream.
+type line struct {
+	stream *stream
+	// b has a spare capacity for the newline added by writeLine when possible
+	b []byte
+	// buf is the pooled buffer of b or nil if b is not pooled
+	buf *lineBuf
+	// event is shared by the pipeline stages of the line
+	event *event
+
+	// fullOnly is set for the parts of an oversized line that are written only
+	// to the full output
+	fullOnly bool
+	// partial is set if the oversized line continues in the next line
+	partial bool
+
+	// filtered is set if included was already evaluated by the scanner
+	filtered bool
+	included bool
+}
 
 type LogFilter struct {
+	// seq is the sequence number of the last scanned line, accessed
+	// atomically
+	seq uint64
+
 	config *Config
 	reader io.Reader
 	writer io.Writer
@@ -29,20 +90,52 @@ type LogFilter struct {
 	errGroup *errgroup.Group
 
 	debugListener net.Listener
-	commander     *Commander
 	debugServer   *http.Server
 
-	stdoutReader io.ReadCloser
-	stdoutWriter io.WriteCloser
-	stderrReader io.ReadCloser
-	stderrWriter io.WriteCloser
+	procs   []*proc
+	streams []*stream
+	buffer  *lineBuffer
 
-	linesChan chan []byte
+	filterWorkers *filterWorkers
 
 	jsonFilter JSONFilter
 
-	fullWriter       io.Writer
-	lumberjackLogger *lumberjack.Logger
+	startedAt time.Time
+
+	health   *Health
+	triggers []*trigger
+	hooksWg  sync.WaitGroup
+
+	trackedWriters  []*trackedWriter
+	bufferedWriters []*bufferedWriter
+	readyMatcher    *lineMatcher
+	readyMatched    int32
+
+	watchGroups []*watchGroup
+	tail        *tailHub
+
+	flightRecorder *flightRecorder
+
+	emitChan   chan []byte
+	writerDone chan struct{}
+	// writeAbort is closed at the drain deadline to stop the writers
+	writeAbort chan struct{}
+	// writers are the goroutines writing to the outputs
+	writers sync.WaitGroup
+
+	spool *spool
+
+	stdinReader       *readTracker
+	drainDeadlineOnce sync.Once
+	drainDeadlineChan <-chan struct{}
+
+	fullWriter     io.Writer
+	fullJSONFilter JSONFilter
+
+	outputs []*output
+	router  *router
+	// outputReopenSignal reopens the output files or is nil
+	outputReopenSignal os.Signal
 }
 
 func NewLogFilter(
@@ -68,63 +161,245 @@ func (f *LogFilter) Init(ctx context.Context) error {
 
 	var err error
 
-	f.debugListener, err = net.Listen("tcp", f.config.DebugListenAddr)
+	if !f.config.DebugDisabled {
+		f.debugListener, err = ListenDebug(f.config.DebugListenAddr)
+		if err != nil {
+			return xerrors.Errorf("debug listener listen failed: %s: %w", f.config.DebugListenAddr, err)
+		}
+	}
+
+	f.jsonFilter, err = NewJSONFilter(f.config.ExcludeTemplate, f.config.FilterQuery, f.logger)
 	if err != nil {
-		return xerrors.Errorf("debug listener listen failed: %s: %w", f.config.DebugListenAddr, err)
+		return xerrors.Errorf("failed to build json filter: %w", err)
 	}
 
-	if len(f.config.Cmd) > 0 {
-		f.stdoutReader, f.stdoutWriter = io.Pipe()
-		f.stderrReader, f.stderrWriter = io.Pipe()
+	f.health = NewHealth()
+
+	f.writer = f.wrapWriter(OutputStdout, f.writer)
+
+	if f.config.SpoolDir != "" {
+		if f.config.SpoolMaxBytes <= 0 {
+			return xerrors.Errorf("spool max bytes must be greater than 0")
+		}
+
+		f.spool, err = newSpool(f.config.SpoolDir, f.config.SpoolMaxBytes, f.writer)
+		if err != nil {
+			return err
+		}
+		f.writer = f.spool
+	}
+
+	f.outputs = append(f.outputs, &output{
+		name:   OutputStdout,
+		writer: f.writer,
+	})
 
-		f.commander = NewCommander(f.config.Cmd, f.config.CmdShutdownTimeout, f.stdoutWriter, f.stderrWriter, f.logger)
+	if len(f.config.Cmd) > 0 && len(f.config.Procs) > 0 {
+		return xerrors.Errorf("cannot use both cmd and procs")
 	}
 
-	f.linesChan = make(chan []byte)
+	if err := ValidateRestartPolicy(f.config.CmdRestartPolicy); err != nil {
+		return err
+	}
 
-	if f.config.ExcludeTemplate != "" && f.config.FilterQuery != "" {
-		return xerrors.Errorf("cannot use both exclude template and filter query")
+	switch f.config.ProcsExitPolicy {
+	case "", ProcsExitShutdown, ProcsExitContinue:
+	default:
+		return xerrors.Errorf("invalid procs exit policy: %s", f.config.ProcsExitPolicy)
 	}
 
-	if f.config.ExcludeTemplate != "" {
-		f.logger.WithField("excludeTemplate", f.config.ExcludeTemplate).Debug("Initializing template JSON filter")
+	procs := f.config.Procs
+	if len(f.config.Cmd) > 0 {
+		procs = Procs{{
+			Cmd:           f.config.Cmd,
+			RestartPolicy: f.config.CmdRestartPolicy,
+			RestartDelay:  Duration(f.config.CmdRestartDelay),
+		}}
+	}
 
-		jsonFilter, err := NewTemplateJSONFilter(f.config.ExcludeTemplate)
+	if len(procs) > 1 && f.config.CmdStdin {
+		return xerrors.Errorf("cannot forward stdin to multiple procs")
+	}
+
+	for _, procConfig := range procs {
+		p, err := f.initProc(procConfig)
 		if err != nil {
-			return xerrors.Errorf("failed to build json filter: %w", err)
+			return err
 		}
-		f.jsonFilter = jsonFilter
-	} else if f.config.FilterQuery != "" {
-		f.logger.WithField("filterQuery", f.config.FilterQuery).Debug("Initializing JQ JSON filter")
+		f.procs = append(f.procs, p)
+		f.streams = append(f.streams, p.streams...)
+	}
 
-		jsonFilter, err := NewJQJSONFilter(f.config.FilterQuery)
-		if err != nil {
-			return xerrors.Errorf("failed to build json filter: %w", err)
+	if len(f.procs) == 0 {
+		f.stdinReader = newReadTracker(f.reader)
+
+		f.streams = append(f.streams, &stream{
+			name:       StreamStdin,
+			kind:       StreamStdin,
+			reader:     f.stdinReader,
+			jsonFilter: f.jsonFilter,
+			writer:     f.writer,
+		})
+	}
+
+	if err := f.initTriggers(); err != nil {
+		return err
+	}
+
+	if err := f.initWatchdog(); err != nil {
+		return err
+	}
+
+	if err := f.initReadiness(); err != nil {
+		return err
+	}
+
+	if err := f.initFlightRecorder(); err != nil {
+		return err
+	}
+
+	f.tail = newTailHub(f.config.TailBufferSize)
+
+	if err := ValidateBufferPolicy(f.config.BufferPolicy); err != nil {
+		return err
+	}
+
+	if err := ValidateOversizedLinePolicy(f.config.OversizedLinePolicy); err != nil {
+		return err
+	}
+
+	if f.config.BufferLines < 0 {
+		return xerrors.Errorf("buffer lines must not be negative")
+	}
+
+	if f.config.BufferPolicy == BufferPolicyDropExcluded {
+		// the scanners evaluate the filters concurrently with the writer
+		lockedJSONFilters := map[JSONFilter]*lockedJSONFilter{}
+		for _, s := range f.streams {
+			locked, ok := lockedJSONFilters[s.jsonFilter]
+			if !ok {
+				locked = &lockedJSONFilter{jsonFilter: s.jsonFilter}
+				lockedJSONFilters[s.jsonFilter] = locked
+			}
+			s.jsonFilter = locked
 		}
-		f.jsonFilter = jsonFilter
-	} else {
-		f.jsonFilter = StaticJSONFilter(true)
+	}
+
+	f.emitChan = make(chan []byte)
+	f.writerDone = make(chan struct{})
+	f.writeAbort = make(chan struct{})
+
+	f.buffer = newLineBuffer(
+		f.config.BufferLines,
+		f.config.BufferBytes,
+		f.config.BufferPolicy,
+		func(l line) bool { return !f.isLineIncluded(l) },
+		f.lineDropped,
+		f.writerDone,
+	)
+
+	if f.config.FilterWorkers < 0 {
+		return xerrors.Errorf("filter workers must not be negative: %d", f.config.FilterWorkers)
+	}
+
+	if f.config.FilterWorkers > 1 {
+		f.filterWorkers = newFilterWorkers(f.config.FilterWorkers)
 	}
 
 	f.fullWriter = ioutil.Discard
+	f.fullJSONFilter = StaticJSONFilter(true)
 
 	if f.config.FullOutputFilename != "" {
-		f.lumberjackLogger = &lumberjack.Logger{
+		full, err := f.initOutput(Output{
+			Name:       OutputFull,
+			Type:       OutputTypeFile,
 			Filename:   f.config.FullOutputFilename,
-			MaxSize:    f.config.FullOutputMaxSizeMB,
-			MaxAge:     f.config.FullOutputMaxAgeDays,
+			MaxSizeMB:  f.config.FullOutputMaxSizeMB,
+			MaxAgeDays: f.config.FullOutputMaxAgeDays,
 			MaxBackups: f.config.FullOutputMaxBackups,
 			Compress:   f.config.FullOutputCompress,
+
+			RotateInterval: f.config.FullOutputRotateInterval,
+			TimeZone:       f.config.FullOutputTimeZone,
+
+			MaxTotalSizeMB: f.config.FullOutputMaxTotalSizeMB,
+			MinFreeMB:      f.config.FullOutputMinFreeMB,
+		})
+		if err != nil {
+			return err
+		}
+		f.fullWriter = full.writer
+
+		f.fullJSONFilter, err = NewFullOutputJSONFilter(
+			f.config.FullOutputExcludeTemplate,
+			f.config.FullOutputFilterQuery,
+			f.config.FullOutputExcludeRegex,
+			f.logger,
+		)
+		if err != nil {
+			return xerrors.Errorf("failed to build full output json filter: %w", err)
+		}
+	}
+
+	for _, outputConfig := range f.config.Outputs {
+		if _, err := f.initOutput(outputConfig); err != nil {
+			return err
 		}
+	}
+
+	if err := f.initRouter(); err != nil {
+		return err
+	}
+
+	if err := ValidateOutputReopenAction(f.config.OutputReopenAction); err != nil {
+		return err
+	}
 
-		f.fullWriter = f.lumberjackLogger
+	switch f.config.OutputReopenSignal {
+	case "none":
+	case "":
+		f.outputReopenSignal = defaultOutputReopenSignal
+	default:
+		f.outputReopenSignal, err = ParseSignal(f.config.OutputReopenSignal)
+		if err != nil {
+			return xerrors.Errorf("invalid output reopen signal: %w", err)
+		}
 	}
 
-	f.debugServer = NewDebugServer()
+	if f.debugListener != nil {
+		debugMux := NewDebugMux()
+		debugMux.Handle("/healthz", healthHandler(f.LivenessProblems))
+		debugMux.Handle("/readyz", healthHandler(f.ReadinessProblems))
+		debugMux.Handle("/status", statusHandler(f.Status))
+		debugMux.Handle("/tail", f.tailHandler())
+		debugMux.Handle("/outputs/reopen", outputReopenHandler(f.ReopenOutputFiles))
+		debugMux.Handle("/outputs/rotate", outputReopenHandler(f.RotateOutputFiles))
+
+		var debugHandler http.Handler = debugMux
+		if f.config.DebugToken != "" {
+			debugHandler = bearerTokenHandler(f.config.DebugToken, debugMux)
+		}
+
+		f.debugServer = NewDebugServer(debugHandler)
+	}
 
 	return nil
 }
 
+// DebugAddr returns the address of the debug server listener or nil if the
+// debug server is disabled.
+func (f *LogFilter) DebugAddr() net.Addr {
+	if f.debugListener == nil {
+		return nil
+	}
+	return f.debugListener.Addr()
+}
+
+// Health returns the health state of the logfilter.
+func (f *LogFilter) Health() *Health {
+	return f.health
+}
+
 func (f *LogFilter) Spawn(fn func(context.Context) error) {
 	f.errGroup.Go(func() error {
 		err := fn(f.ctx)
@@ -137,25 +412,33 @@ func (f *LogFilter) Spawn(fn func(context.Context) error) {
 }
 
 func (f *LogFilter) Start() error {
-	f.Spawn(func(ctx context.Context) error {
-		f.logger.WithField("listenAddr", f.config.DebugListenAddr).Info("Starting debug HTTP server")
+	f.startedAt = time.Now()
 
-		err := f.debugServer.Serve(f.debugListener)
-		if ctx.Err() == nil {
-			return err
-		}
-		return nil
-	})
+	if f.debugServer != nil {
+		f.Spawn(func(ctx context.Context) error {
+			f.logger.WithFields(logrus.Fields{
+				"listenAddr": f.debugListener.Addr().String(),
+				"listenNet":  f.debugListener.Addr().Network(),
+				"tokenAuth":  f.config.DebugToken != "",
+			}).Info("Starting debug HTTP server")
+
+			err := f.debugServer.Serve(f.debugListener)
+			if ctx.Err() == nil {
+				return err
+			}
+			return nil
+		})
+	}
 
 	linesDone := make(chan struct{})
 
-	if f.commander == nil {
+	if len(f.procs) == 0 {
 		scanErrChan := make(chan error, 1)
 
 		// scanning lines from f.reader must not be done in f.Spawn because stdin
 		// does not get closed on SIGINT
 		go func() {
-			err := f.scanLines(f.reader)
+			err := f.scanLines(f.streams[0])
 			if err == nil {
 				err = xerrors.Errorf("reading stdin: %w", io.EOF)
 			}
@@ -168,74 +451,122 @@ func (f *LogFilter) Start() error {
 			case err := <-scanErrChan:
 				return err
 			case <-ctx.Done():
-				return nil
+				// the lines that were read before the shutdown are still written
+				return f.waitStdinDrained(scanErrChan, f.drainDeadline())
 			}
 		})
 	} else {
 		var cmdScanningDone sync.WaitGroup
 
-		cmdScanningDone.Add(2)
+		cmdScanningDone.Add(len(f.streams))
 
-		f.Spawn(func(_ context.Context) error {
-			defer cmdScanningDone.Done()
-			return f.scanLines(f.stdoutReader)
-		})
+		for _, s := range f.streams {
+			s := s
 
-		f.Spawn(func(_ context.Context) error {
-			defer cmdScanningDone.Done()
+			f.Spawn(func(_ context.Context) error {
+				defer cmdScanningDone.Done()
+				return f.scanLines(s)
+			})
+		}
+
+		running := int32(len(f.procs))
+
+		for _, p := range f.procs {
+			p := p
+
+			f.Spawn(func(ctx context.Context) error {
+				err := p.commander.Start(ctx)
+				p.closeWriters()
+				return f.procExited(ctx, p, err, atomic.AddInt32(&running, -1))
+			})
+		}
 
-			return f.scanLines(f.stderrReader)
+		f.Spawn(func(_ context.Context) error {
+			cmdScanningDone.Wait()
+			close(linesDone)
+			return nil
 		})
+	}
 
-		f.Spawn(func(ctx context.Context) error {
-			err := f.commander.Start(ctx)
-			f.stdoutWriter.Close()
-			f.stderrWriter.Close()
-			if err == nil {
-				err = xerrors.Errorf("command exited")
+	if f.config.StallTimeout > 0 || f.config.HeartbeatInterval > 0 {
+		f.Spawn(f.runWatchdog)
+	}
+
+	if f.spool != nil {
+		// the spool is drained also after the ctx is done so that the spooled
+		// lines are not lost
+		f.writers.Add(1)
+		f.Spawn(func(_ context.Context) error {
+			defer f.writers.Done()
+			if err := f.spool.drain(); err != nil {
+				return err
 			}
-			return err
+			return f.flushWriters()
 		})
+	}
 
+	if len(f.bufferedWriters) > 0 && f.config.OutputFlushInterval > 0 {
+		f.Spawn(f.runFlusher)
+	}
+
+	if f.outputReopenSignal != nil && f.hasOutputFiles() {
+		f.Spawn(f.runOutputReopenSignal)
+	}
+
+	if f.filterWorkers != nil {
 		f.Spawn(func(_ context.Context) error {
-			cmdScanningDone.Wait()
-			close(linesDone)
+			f.dispatchFilterJobs(linesDone)
 			return nil
 		})
+
+		for i := 0; i < f.filterWorkers.count; i++ {
+			f.Spawn(f.runFilterWorker)
+		}
 	}
 
+	f.writers.Add(1)
 	f.Spawn(func(_ context.Context) error {
-		for {
-			select {
-			case line := <-f.linesChan:
-				if f.isLineIncluded(line) {
-					if _, err := f.writer.Write(line); err != nil {
-						return xerrors.Errorf("writer write failed: %w", err)
-					}
-					if _, err := f.writer.Write(newLine); err != nil {
-						return xerrors.Errorf("writer write failed: %w", err)
-					}
-				}
+		defer f.writers.Done()
+		defer close(f.writerDone)
+		if f.spool != nil {
+			defer f.spool.close()
+		}
 
-				if _, err := f.fullWriter.Write(line); err != nil {
-					return xerrors.Errorf("full writer write failed: %w", err)
-				}
-				if _, err := f.fullWriter.Write(newLine); err != nil {
-					return xerrors.Errorf("full writer write failed: %w", err)
-				}
-			case <-linesDone:
-				return nil
-			}
+		if err := f.writeLines(linesDone); err != nil {
+			return err
 		}
+		return f.flushWriters()
 	})
 
 	<-f.ctx.Done()
 
 	f.logger.Info("Shutting down")
 
-	_ = f.debugServer.Shutdown(context.Background())
+	drainDeadline := f.drainDeadline()
+
+	if f.debugServer != nil {
+		_ = f.debugServer.Shutdown(context.Background())
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- f.errGroup.Wait()
+	}()
+
+	var err error
+
+	select {
+	case err = <-errChan:
+	case <-drainDeadline:
+		f.logger.WithFields(logrus.Fields{
+			"drainTimeout": f.config.DrainTimeout,
+		}).Warn("LogFilter drain deadline exceeded, in-flight lines may be lost")
+		err = xerrors.Errorf("drain deadline exceeded")
+		f.abortWrites()
+	}
+
+	f.hooksWg.Wait()
 
-	err := f.errGroup.Wait()
 	if err != nil {
 		return err
 	}
@@ -245,12 +576,193 @@ func (f *LogFilter) Start() error {
 	return nil
 }
 
+// writeLines writes the emitted lines and the lines from the buffer until the
+// scanning is done and the buffer is empty. With the filter workers the lines
+// are taken from the ordered results of the workers instead of the buffer.
+func (f *LogFilter) writeLines(linesDone <-chan struct{}) error {
+	lines := f.buffer.lines
+	var results <-chan *filterJob
+
+	if f.filterWorkers != nil {
+		lines = nil
+		results = f.filterWorkers.results
+		// the results are closed after the last line
+		linesDone = nil
+	}
+
+	for {
+		if f.writesAborted() {
+			return errWritesAborted
+		}
+
+		select {
+		case <-f.writeAbort:
+			return errWritesAborted
+		case b := <-f.emitChan:
+			if err := writeLine(f.writer, b); err != nil {
+				return xerrors.Errorf("writer write failed: %w", err)
+			}
+		case l := <-lines:
+			if err := f.processLine(l, nil); err != nil {
+				return err
+			}
+		case job, ok := <-results:
+			if !ok {
+				return nil
+			}
+			<-job.done
+			for i, l := range job.lines {
+				if err := f.processLine(l, &job.results[i]); err != nil {
+					return err
+				}
+			}
+			releaseFilterJob(job)
+		case <-linesDone:
+			// write the lines remaining in the buffer
+			for {
+				select {
+				case <-f.writeAbort:
+					return errWritesAborted
+				case l := <-f.buffer.lines:
+					if err := f.processLine(l, nil); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// processLine writes the filtered line to the outputs. The filters are
+// evaluated by the writer if the result of the filter workers is nil.
+func (f *LogFilter) processLine(l line, result *filterResult) error {
+	f.buffer.done(l)
+
+	if l.fullOnly {
+		var err error
+		if l.partial {
+			_, err = f.fullWriter.Write(l.b)
+		} else {
+			err = writeLine(f.fullWriter, l.b)
+		}
+		if err != nil {
+			return xerrors.Errorf("full writer write failed: %w", err)
+		}
+		if l.buf != nil {
+			putLineBuf(l.buf)
+		}
+		return nil
+	}
+
+	if result == nil {
+		r := f.filterResult(l, l.stream.jsonFilter, f.fullJSONFilter, f.router)
+		result = &r
+	}
+	included := result.included
+
+	l.stream.count(included)
+	// the tail subscribers keep the line
+	retained := f.tail.publish(l, included)
+
+	if f.flightRecorder != nil {
+		for _, cl := range f.flightRecorder.observe(l, included, time.Now()) {
+			if err := writeLine(cl.stream.writer, cl.b); err != nil {
+				return xerrors.Errorf("writer write failed: %w", err)
+			}
+		}
+	}
+
+	if included {
+		if err := f.writeIncluded(l, result.outputs); err != nil {
+			return err
+		}
+	}
+
+	f.observeTriggers(l)
+	f.observeReadiness(l)
+
+	if result.full {
+		if err := writeLine(f.fullWriter, l.b); err != nil {
+			return xerrors.Errorf("full writer write failed: %w", err)
+		}
+	}
+
+	if l.buf != nil && !retained {
+		putLineBuf(l.buf)
+	}
+
+	return nil
+}
+
+// runFlusher flushes the buffered writers every OutputFlushInterval. The
+// writers are flushed for the last time after the lines are written.
+func (f *LogFilter) runFlusher(ctx context.Context) error {
+	ticker := time.NewTicker(f.config.OutputFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.flushWriters(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (f *LogFilter) flushWriters() error {
+	for _, w := range f.bufferedWriters {
+		if err := w.Flush(); err != nil {
+			return xerrors.Errorf("writer flush failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// procExited decides if the logfilter should shut down after the process
+// exited. A non-nil error shuts down the logfilter.
+func (f *LogFilter) procExited(ctx context.Context, p *proc, err error, running int32) error {
+	if p.name == "" {
+		if err == nil {
+			err = xerrors.Errorf("command exited")
+		}
+		return err
+	}
+
+	if f.config.ProcsExitPolicy == ProcsExitContinue && running > 0 && ctx.Err() == nil {
+		f.logger.WithError(err).WithFields(logrus.Fields{
+			"proc":    p.name,
+			"running": running,
+		}).Warn("Proc exited, other procs continue running")
+		return nil
+	}
+
+	if err == nil {
+		return xerrors.Errorf("proc exited: %s", p.name)
+	}
+	return xerrors.Errorf("proc exited: %s: %w", p.name, err)
+}
+
 func (f *LogFilter) Close() error {
 	var closeErr error
 
-	if f.lumberjackLogger != nil {
-		if err := f.lumberjackLogger.Close(); err != nil {
-			closeErr = multierror.Append(closeErr, xerrors.Errorf("failed to close lumberjack logger: %w", err))
+	for _, o := range f.outputs {
+		if err := o.close(); err != nil {
+			closeErr = multierror.Append(closeErr, err)
+		}
+	}
+
+	for _, p := range f.procs {
+		p.close()
+	}
+
+	if f.spool != nil {
+		if err := f.spool.remove(); err != nil {
+			closeErr = multierror.Append(closeErr, xerrors.Errorf("failed to remove spool file: %w", err))
 		}
 	}
 
@@ -263,18 +775,97 @@ func (f *LogFilter) Close() error {
 	return closeErr
 }
 
-func (f *LogFilter) scanLines(r io.Reader) error {
-	scanner := bufio.NewScanner(r)
-	scanner.Buffer(make([]byte, 4096), f.config.MaxScanLineSize)
+func (f *LogFilter) scanLines(s *stream) error {
+	maxLineSize := f.config.MaxScanLineSize
+	if maxLineSize <= 0 {
+		maxLineSize = bufio.MaxScanTokenSize
+	}
+
+	splitter := &lineSplitter{
+		max:    maxLineSize,
+		policy: f.config.OversizedLinePolicy,
+	}
+
+	scanner := bufio.NewScanner(s.reader)
+	// the extra byte is for the newline after a line of maxLineSize bytes
+	scanner.Buffer(make([]byte, 4096), maxLineSize+1)
+	scanner.Split(splitter.split)
+
+	// the lines kept for the crash dump or the flight recorder are not pooled
+	pooled := s.recent == nil && f.flightRecorder == nil
+
+	labelSize := 0
+	if s.label != nil {
+		labelSize = s.label.size()
+	}
 
 	for scanner.Scan() {
 		b := scanner.Bytes()
 
-		// scanner.Bytes() can return a slice of a bigger byte slice and is not safe to send in channels
-		bc := make([]byte, len(b))
-		copy(bc, b)
+		now := time.Now()
+		s.touch(now, len(b))
 
-		f.linesChan <- bc
+		l := line{stream: s}
+
+		if splitter.oversized {
+			if splitter.first {
+				f.lineOversized(s)
+			}
+
+			switch splitter.policy {
+			case OversizedLineTruncate:
+				if !splitter.first {
+					// skip the rest of the line
+					if s.progress != nil {
+						s.progress.scan(splitter.consumed)
+					}
+					continue
+				}
+				b = append(b[:len(b):len(b)], TruncatedLineMarker...)
+			case OversizedLineFull:
+				l.fullOnly = true
+				l.partial = splitter.partial
+			}
+		}
+
+		// scanner.Bytes() can return a slice of a bigger byte slice and is not
+		// safe to send in channels. The extra byte is for the newline.
+		if pooled {
+			l.buf = getLineBuf()
+			l.b = l.buf.b[:0]
+			l.event = &l.buf.event
+		} else {
+			l.b = make([]byte, 0, labelSize+len(b)+1)
+			l.event = &event{}
+		}
+
+		// the label is applied only to the first part of a line written to the
+		// full output in parts
+		if s.label != nil && (!l.fullOnly || splitter.first) {
+			l.b = s.label.appendTo(l.b, b)
+		} else {
+			l.b = append(l.b, b...)
+		}
+
+		if l.buf != nil {
+			l.buf.b = l.b
+		}
+
+		*l.event = event{
+			raw:        l.b,
+			stream:     s.name,
+			receivedAt: now,
+			seq:        atomic.AddUint64(&f.seq, 1),
+		}
+
+		if s.recent != nil && !l.fullOnly {
+			s.recent.push(l)
+		}
+		if s.progress != nil {
+			s.progress.scan(splitter.consumed)
+		}
+
+		f.buffer.put(l)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -284,11 +875,96 @@ func (f *LogFilter) scanLines(r io.Reader) error {
 	return nil
 }
 
-func (f *LogFilter) isLineIncluded(line []byte) bool {
-	ok, err := f.jsonFilter.IsIncluded(line)
+// lineDropped counts the line dropped by the buffer policy. The warning is
+// logged at most once per dropWarnInterval for each stream.
+func (f *LogFilter) lineDropped(l line) {
+	dropped := atomic.AddUint64(&l.stream.dropped, 1)
+
+	if !warnAllowed(&l.stream.lastDropWarnAt, time.Now()) {
+		return
+	}
+
+	f.logger.WithFields(logrus.Fields{
+		"stream":  l.stream.name,
+		"dropped": dropped,
+		"policy":  f.config.BufferPolicy,
+	}).Warn("LogFilter buffer full, dropping lines")
+}
+
+// lineOversized counts the line longer than MaxScanLineSize. The warning is
+// logged at most once per dropWarnInterval for each stream.
+func (f *LogFilter) lineOversized(s *stream) {
+	oversized := atomic.AddUint64(&s.oversized, 1)
+
+	if !warnAllowed(&s.lastOversizedWarnAt, time.Now()) {
+		return
+	}
+
+	f.logger.WithFields(logrus.Fields{
+		"stream":          s.name,
+		"oversized":       oversized,
+		"maxScanLineSize": f.config.MaxScanLineSize,
+		"policy":          f.config.OversizedLinePolicy,
+	}).Warn("LogFilter line too long")
+}
+
+// warnAllowed reports if a warning can be logged. It allows at most one
+// warning per dropWarnInterval for the lastWarnAt which is accessed
+// atomically.
+func warnAllowed(lastWarnAt *int64, now time.Time) bool {
+	last := atomic.LoadInt64(lastWarnAt)
+	if now.Sub(time.Unix(0, last)) < dropWarnInterval {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(lastWarnAt, last, now.UnixNano())
+}
+
+func (f *LogFilter) isLineIncluded(l line) bool {
+	if l.filtered {
+		return l.included
+	}
+	return f.filterLine(l.stream.jsonFilter, l)
+}
+
+// filterResult is the result of the filters of a line.
+type filterResult struct {
+	included bool
+	// full is set if the line is written to the full output
+	full bool
+	// outputs are the outputs of the routes matching an included line
+	outputs []*output
+}
+
+// filterResult evaluates the filter of the stream, the full output filter and
+// the routes of the line. The outputs are valid until the next route of the
+// router.
+func (f *LogFilter) filterResult(l line, jsonFilter JSONFilter, fullJSONFilter JSONFilter, r *router) filterResult {
+	result := filterResult{
+		included: l.included,
+		full:     f.filterLine(fullJSONFilter, l),
+	}
+	if !l.filtered {
+		result.included = f.filterLine(jsonFilter, l)
+	}
+
+	if result.included && r != nil {
+		result.outputs = r.route(l)
+	}
+
+	return result
+}
+
+// filterLine evaluates the filter for the line. The lines that fail to be
+// filtered are included.
+func (f *LogFilter) filterLine(jsonFilter JSONFilter, l line) bool {
+	ok, err := filterEvent(jsonFilter, l.event)
 	if err != nil {
 		if f.logger.Level <= logrus.DebugLevel {
-			f.logger.WithField("line", string(line)).Debug("LogFilter failed to filter line")
+			f.logger.WithFields(logrus.Fields{
+				"line":   string(l.b),
+				"stream": l.stream.name,
+				"seq":    l.event.seq,
+			}).Debug("LogFilter failed to filter line")
 		}
 		return true
 	}
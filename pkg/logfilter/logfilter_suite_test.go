@@ -2,18 +2,28 @@ package logfilter_test
 
 import (
 	"context"
+	"os"
 	"testing"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/sirupsen/logrus"
+
+	"github.com/bancek/logfilter/pkg/logfilter"
 )
 
 var TestCtx context.Context
 var TestCtxTimeoutCancel func()
 var Logger *logrus.Entry
 
+func TestMain(m *testing.M) {
+	// the rlimit tests execute the commands through the test binary
+	logfilter.RunRlimitHelper()
+
+	os.Exit(m.Run())
+}
+
 func TestLogfilter(t *testing.T) {
 	RegisterFailHandler(Fail)
 
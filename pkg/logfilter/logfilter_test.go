@@ -13,6 +13,7 @@ import (
 	"github.com/kballard/go-shellquote"
 	"github.com/kelseyhightower/envconfig"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
@@ -54,14 +55,71 @@ var _ = Describe("LogFilter", func() {
 		prefix := strings.ToUpper("LOGFILTERTEST" + Rand())
 		os.Setenv(prefix+"_CMD", `bash -c "echo \"123\""`)
 		os.Setenv(prefix+"_CMDSHUTDOWNTIMEOUT", "1s")
+		os.Setenv(prefix+"_CMDRESTARTPOLICY", "on-failure")
+		os.Setenv(prefix+"_CMDRESTARTDELAY", "2s")
+		os.Setenv(prefix+"_PROCS", `[{"name": "web", "cmd": "bin/web --port 80", "restartPolicy": "always", "restartDelay": "3s"}, {"name": "worker", "cmd": ["bin/worker", "-v"], "filterQuery": "."}]`)
+		os.Setenv(prefix+"_PROCSEXITPOLICY", "continue")
+		os.Setenv(prefix+"_PROCLABELFIELD", "proc")
+		os.Setenv(prefix+"_CMDSTDIN", "true")
+		os.Setenv(prefix+"_CMDENV", `FOO=bar BAZ="qux quux"`)
+		os.Setenv(prefix+"_CMDSTRIPENV", "true")
+		os.Setenv(prefix+"_CMDDIR", "/tmp")
+		os.Setenv(prefix+"_CMDUSER", "nobody")
+		os.Setenv(prefix+"_CMDGROUP", "nogroup")
+		os.Setenv(prefix+"_CMDRLIMITS", "nofile=1024:4096 core=0 cpu=unlimited")
+		os.Setenv(prefix+"_FD", "3")
+		os.Setenv(prefix+"_FDEXCLUDETEMPLATE", "fdtpl")
+		os.Setenv(prefix+"_FDOUTPUT", "full")
+		os.Setenv(prefix+"_TRIGGERS", `[{"name": "fds", "matchQuery": ".", "threshold": 3, "window": "1m", "action": "signal", "signal": "USR1"}]`)
+		os.Setenv(prefix+"_STALLTIMEOUT", "30s")
+		os.Setenv(prefix+"_STALLSTREAMS", "stdout,fd")
+		os.Setenv(prefix+"_STALLRESTART", "true")
+		os.Setenv(prefix+"_HEARTBEATINTERVAL", "1m")
+		os.Setenv(prefix+"_READYQUERY", "select(.ready)")
+		os.Setenv(prefix+"_READYONEXIT", "true")
+		os.Setenv(prefix+"_CONTEXTQUERY", "select(.Level == \"Error\")")
+		os.Setenv(prefix+"_CONTEXTBEFORE", "5")
+		os.Setenv(prefix+"_CONTEXTAFTER", "2")
+		os.Setenv(prefix+"_CONTEXTFIELD", "ctx")
+		os.Setenv(prefix+"_CORRELATIONFIELD", ".trace_id")
+		os.Setenv(prefix+"_CORRELATIONTTL", "30s")
+		os.Setenv(prefix+"_CORRELATIONMAXBYTES", "1024")
+		os.Setenv(prefix+"_CRASHDUMPLINES", "50")
+		os.Setenv(prefix+"_CRASHDUMPFILE", "crash.log")
+		os.Setenv(prefix+"_WRITERSTUCKTIMEOUT", "1m")
 		os.Setenv(prefix+"_EXCLUDETEMPLATE", "tpl")
 		os.Setenv(prefix+"_FILTERQUERY", ".")
 		os.Setenv(prefix+"_DEBUGLISTENADDR", "localhost:1234")
+		os.Setenv(prefix+"_DEBUGDISABLED", "true")
+		os.Setenv(prefix+"_DEBUGTOKEN", "token")
+		os.Setenv(prefix+"_BUFFERLINES", "100")
+		os.Setenv(prefix+"_BUFFERBYTES", "4096")
+		os.Setenv(prefix+"_BUFFERPOLICY", "drop-oldest")
+		os.Setenv(prefix+"_SPOOLDIR", "/var/spool/logfilter")
+		os.Setenv(prefix+"_SPOOLMAXBYTES", "1048576")
+		os.Setenv(prefix+"_DRAINTIMEOUT", "1m")
+		os.Setenv(prefix+"_TAILBUFFERSIZE", "10")
 		os.Setenv(prefix+"_FULLOUTPUTFILENAME", "filename")
 		os.Setenv(prefix+"_FULLOUTPUTMAXSIZEMB", "2")
 		os.Setenv(prefix+"_FULLOUTPUTMAXAGEDAYS", "3")
 		os.Setenv(prefix+"_FULLOUTPUTMAXBACKUPS", "4")
 		os.Setenv(prefix+"_FULLOUTPUTCOMPRESS", "true")
+		os.Setenv(prefix+"_FULLOUTPUTROTATEINTERVAL", "daily")
+		os.Setenv(prefix+"_FULLOUTPUTTIMEZONE", "Europe/Ljubljana")
+		os.Setenv(prefix+"_FULLOUTPUTMAXTOTALSIZEMB", "20")
+		os.Setenv(prefix+"_FULLOUTPUTMINFREEMB", "500")
+		os.Setenv(prefix+"_OUTPUTREOPENSIGNAL", "SIGHUP")
+		os.Setenv(prefix+"_OUTPUTREOPENACTION", "rotate")
+		os.Setenv(prefix+"_FULLOUTPUTEXCLUDETEMPLATE", "{{.Full}}")
+		os.Setenv(prefix+"_FULLOUTPUTFILTERQUERY", ".full")
+		os.Setenv(prefix+"_FULLOUTPUTEXCLUDEREGEX", "health")
+		os.Setenv(prefix+"_OUTPUTS", `[{"name": "errors", "type": "file", "filename": "errors.log"}, {"name": "err", "type": "stderr"}]`)
+		os.Setenv(prefix+"_ROUTES", `[{"matchQuery": "select(.Level == \"Error\")", "outputs": ["errors", "stdout"]}]`)
+		os.Setenv(prefix+"_ROUTEMODE", "all")
+		os.Setenv(prefix+"_FILTERWORKERS", "4")
+		os.Setenv(prefix+"_OUTPUTBUFFERSIZE", "65536")
+		os.Setenv(prefix+"_OUTPUTFLUSHINTERVAL", "1s")
+		os.Setenv(prefix+"_OVERSIZEDLINEPOLICY", "split")
 		os.Setenv(prefix+"_LOGLEVEL", "warn")
 
 		config := &Config{}
@@ -70,18 +128,91 @@ var _ = Describe("LogFilter", func() {
 		Expect(err).NotTo(HaveOccurred())
 
 		Expect(config).To(Equal(&Config{
-			Cmd:                  []string{"bash", "-c", `echo "123"`},
-			CmdShutdownTimeout:   1 * time.Second,
-			ExcludeTemplate:      "tpl",
-			FilterQuery:          ".",
-			DebugListenAddr:      "localhost:1234",
-			FullOutputFilename:   "filename",
-			FullOutputMaxSizeMB:  2,
-			FullOutputMaxAgeDays: 3,
-			FullOutputMaxBackups: 4,
-			FullOutputCompress:   true,
-			MaxScanLineSize:      52428800,
-			LogLevel:             "warn",
+			Cmd:                []string{"bash", "-c", `echo "123"`},
+			CmdShutdownTimeout: 1 * time.Second,
+			CmdRestartPolicy:   "on-failure",
+			CmdRestartDelay:    2 * time.Second,
+			Procs: Procs{
+				{Name: "web", Cmd: []string{"bin/web", "--port", "80"}, RestartPolicy: "always", RestartDelay: Duration(3 * time.Second)},
+				{Name: "worker", Cmd: []string{"bin/worker", "-v"}, FilterQuery: "."},
+			},
+			ProcsExitPolicy: "continue",
+			ProcLabelField:  "proc",
+			CmdStdin:        true,
+			CmdEnv:          []string{"FOO=bar", "BAZ=qux quux"},
+			CmdStripEnv:     true,
+			CmdDir:          "/tmp",
+			CmdUser:         "nobody",
+			CmdGroup:        "nogroup",
+			CmdRlimits: Rlimits{
+				{Resource: "nofile", Soft: 1024, Hard: 4096},
+				{Resource: "core", Soft: 0, Hard: 0},
+				{Resource: "cpu", Soft: RlimitInfinity, Hard: RlimitInfinity},
+			},
+			FD:                3,
+			FDEnv:             "LOGFILTER_FD",
+			FDExcludeTemplate: "fdtpl",
+			FDOutput:          "full",
+			Triggers: Triggers{
+				{Name: "fds", MatchQuery: ".", Threshold: 3, Window: Duration(time.Minute), Action: "signal", Signal: "USR1"},
+			},
+			StallTimeout:              30 * time.Second,
+			StallStreams:              []string{"stdout", "fd"},
+			StallLine:                 true,
+			StallRestart:              true,
+			HeartbeatInterval:         time.Minute,
+			ReadyQuery:                "select(.ready)",
+			ReadyOnExit:               true,
+			ContextQuery:              `select(.Level == "Error")`,
+			ContextBefore:             5,
+			ContextAfter:              2,
+			ContextField:              "ctx",
+			CorrelationField:          ".trace_id",
+			CorrelationTTL:            30 * time.Second,
+			CorrelationMaxBytes:       1024,
+			CrashDumpLines:            50,
+			CrashDumpFile:             "crash.log",
+			WriterStuckTimeout:        time.Minute,
+			ExcludeTemplate:           "tpl",
+			FilterQuery:               ".",
+			DebugListenAddr:           "localhost:1234",
+			DebugDisabled:             true,
+			DebugToken:                "token",
+			BufferLines:               100,
+			BufferBytes:               4096,
+			BufferPolicy:              "drop-oldest",
+			SpoolDir:                  "/var/spool/logfilter",
+			SpoolMaxBytes:             1048576,
+			DrainTimeout:              time.Minute,
+			TailBufferSize:            10,
+			FullOutputFilename:        "filename",
+			FullOutputMaxSizeMB:       2,
+			FullOutputMaxAgeDays:      3,
+			FullOutputMaxBackups:      4,
+			FullOutputCompress:        true,
+			FullOutputRotateInterval:  "daily",
+			FullOutputTimeZone:        "Europe/Ljubljana",
+			FullOutputMaxTotalSizeMB:  20,
+			FullOutputMinFreeMB:       500,
+			OutputReopenSignal:        "SIGHUP",
+			OutputReopenAction:        "rotate",
+			FullOutputExcludeTemplate: "{{.Full}}",
+			FullOutputFilterQuery:     ".full",
+			FullOutputExcludeRegex:    "health",
+			Outputs: Outputs{
+				{Name: "errors", Type: "file", Filename: "errors.log", MaxSizeMB: 100},
+				{Name: "err", Type: "stderr"},
+			},
+			Routes: Routes{
+				{MatchQuery: `select(.Level == "Error")`, Outputs: []string{"errors", "stdout"}},
+			},
+			RouteMode:           "all",
+			FilterWorkers:       4,
+			OutputBufferSize:    65536,
+			OutputFlushInterval: time.Second,
+			MaxScanLineSize:     52428800,
+			OversizedLinePolicy: "split",
+			LogLevel:            "warn",
 		}))
 	})
 
@@ -215,6 +346,115 @@ var _ = Describe("LogFilter", func() {
 		Expect(strings.Split(writer.String(), "\n")).To(Equal(expectedOutput))
 	})
 
+	It("should filter the structured log fd separately", func() {
+		script := `
+			echo '{"Level":"Debug","Message":"stdout"}'
+			echo '{"Level":"Debug","Message":"fd"}' >&$LOGFILTER_FD
+			echo '{"Level":"Information","Message":"fd"}' >&$LOGFILTER_FD
+		`
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", script}
+		config.FD = 3
+		config.FDEnv = "LOGFILTER_FD"
+		config.FDFilterQuery = `select(.Level != "Debug")`
+
+		writer := bytes.NewBuffer(nil)
+
+		err := run(config, nil, writer)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("command exited"))
+
+		lines := strings.Split(writer.String(), "\n")
+		Expect(lines).To(ConsistOf(
+			`{"Level":"Debug","Message":"stdout"}`,
+			`{"Level":"Information","Message":"fd"}`,
+			"",
+		))
+	})
+
+	It("should fail if the structured log fd is invalid", func() {
+		config := &Config{}
+		config.Cmd = []string{"true"}
+		config.FD = 2
+
+		logFilter := NewLogFilter(config, nil, bytes.NewBuffer(nil), Logger)
+
+		err := logFilter.Init(TestCtx)
+		Expect(err).To(MatchError("structured log fd must be 3 or greater: 2"))
+	})
+
+	It("should run multiple procs and label their lines", func() {
+		config := &Config{}
+		config.Procs = Procs{
+			{Name: "web", Cmd: []string{"bash", "-c", `echo '{"Level":"Debug"}'; echo '{"Level":"Information"}'; echo "plain"; sleep 0.2`}},
+			{Name: "worker", Cmd: []string{"bash", "-c", `echo '{"Level":"Debug"}' >&2; sleep 5`}, FilterQuery: "."},
+		}
+		config.ProcLabelField = "process"
+		config.ExcludeTemplate = `{{eq .Level "Debug"}}`
+
+		writer := bytes.NewBuffer(nil)
+
+		err := run(config, nil, writer)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("proc exited: web"))
+
+		Expect(strings.Split(writer.String(), "\n")).To(ConsistOf(
+			`{"process":"web","Level":"Information"}`,
+			`[web] plain`,
+			`{"process":"worker","Level":"Debug"}`,
+			"",
+		))
+	})
+
+	It("should keep running the other procs if one exits", func() {
+		config := &Config{}
+		config.Procs = Procs{
+			{Name: "first", Cmd: []string{"bash", "-c", `echo first`}},
+			{Name: "second", Cmd: []string{"bash", "-c", `sleep 0.3; echo second`}},
+		}
+		config.ProcsExitPolicy = ProcsExitContinue
+
+		writer := bytes.NewBuffer(nil)
+
+		err := run(config, nil, writer)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("proc exited: second"))
+
+		Expect(strings.Split(writer.String(), "\n")).To(Equal([]string{"first", "second", ""}))
+	})
+
+	It("should fail to decode invalid procs", func() {
+		var procs Procs
+		Expect(procs.Decode(`[{"name": "web"}]`)).To(MatchError("proc cmd must not be empty: web"))
+		Expect(procs.Decode(`[{"cmd": "true"}]`)).To(MatchError("proc name must not be empty"))
+		Expect(procs.Decode(`[{"name": "a", "cmd": "true"}, {"name": "a", "cmd": "true"}]`)).To(MatchError("duplicate proc name: a"))
+		Expect(procs.Decode(`[{"name": "a", "cmd": "true", "restartPolicy": "sometimes"}]`)).To(MatchError("proc a: invalid restart policy: sometimes"))
+	})
+
+	It("should forward stdin to the command", func() {
+		config := &Config{}
+		config.Cmd = []string{"cat"}
+		config.CmdStdin = true
+		config.ExcludeTemplate = defaultExcludeTpl
+
+		reader := bytes.NewReader([]byte(testInput + "\n"))
+		writer := bytes.NewBuffer(nil)
+
+		err := run(config, reader, writer)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("command exited"))
+
+		Expect(strings.Split(writer.String(), "\n")).To(Equal(expectedOutput))
+	})
+
+	It("should fail to decode invalid rlimits", func() {
+		var rlimits Rlimits
+		Expect(rlimits.Decode("nofile=1024:4096")).To(Succeed())
+		Expect(rlimits.Decode("unknown=1")).To(MatchError("unknown rlimit resource: unknown"))
+		Expect(rlimits.Decode("nofile=2:1")).To(MatchError("rlimit soft limit is greater than hard limit: nofile=2:1"))
+		Expect(rlimits.Decode("nofile")).To(HaveOccurred())
+	})
+
 	It("should fail to run a non-existent command", func() {
 		config := &Config{}
 		config.Cmd = []string{"nonexistentcmd"}
@@ -286,6 +526,59 @@ var _ = Describe("LogFilter", func() {
 		Expect(string(out)).To(Equal(testInput + "\n"))
 	})
 
+	DescribeTable("should filter the full output separately",
+		func(configure func(config *Config)) {
+			tmpDir, err := ioutil.TempDir("", "logfilter-test-")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			config := &Config{}
+			config.ExcludeTemplate = defaultExcludeTpl
+			config.FullOutputFilename = filepath.Join(tmpDir, "logfilter.log")
+			configure(config)
+
+			reader := bytes.NewReader([]byte(testInput))
+			writer := bytes.NewBuffer(nil)
+
+			err = run(config, reader, writer)
+			Expect(err).To(HaveOccurred())
+
+			Expect(strings.Split(writer.String(), "\n")).To(Equal(expectedOutput))
+
+			out, err := ioutil.ReadFile(config.FullOutputFilename)
+			Expect(err).NotTo(HaveOccurred())
+
+			// the lines that fail to be filtered are included
+			Expect(string(out)).To(Equal(strings.Join([]string{
+				testInputLines[0],
+				testInputLines[1],
+				testInputLines[3],
+			}, "\n") + "\n"))
+		},
+		Entry("exclude template", func(config *Config) {
+			config.FullOutputExcludeTemplate = `{{eq .Level "Debug"}}`
+		}),
+		Entry("filter query", func(config *Config) {
+			config.FullOutputFilterQuery = `select(.Level != "Debug")`
+		}),
+		Entry("exclude regex", func(config *Config) {
+			config.FullOutputExcludeRegex = `"Level":"Debug"`
+		}),
+	)
+
+	It("should fail to use the full output exclude regex with another full output filter", func() {
+		config := &Config{}
+		config.FullOutputFilename = filepath.Join(os.TempDir(), "logfilter.log")
+		config.FullOutputFilterQuery = `select(.Level != "Debug")`
+		config.FullOutputExcludeRegex = `"Level":"Debug"`
+
+		logFilter := NewLogFilter(config, bytes.NewReader(nil), bytes.NewBuffer(nil), Logger)
+		defer logFilter.Close()
+
+		err := logFilter.Init(TestCtx)
+		Expect(err).To(MatchError(ContainSubstring("cannot use exclude regex together with exclude template or filter query")))
+	})
+
 	It("should fail if writer.Write fails", func() {
 		config := &Config{}
 		config.ExcludeTemplate = defaultExcludeTpl
@@ -0,0 +1,212 @@
+package logfilter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/hashicorp/go-multierror"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// OutputStdout is the built-in output of the included lines.
+	OutputStdout = "stdout"
+	// OutputFull is the built-in output of the full output file
+	// (FullOutputFilename) with its own filter.
+	OutputFull = "full"
+)
+
+// output is a named destination of the lines.
+type output struct {
+	name   string
+	writer io.Writer
+	// file is the rotated file of a file output or nil
+	file rotatedFile
+	// guard is the disk usage guard of the file or nil
+	guard *guardedFile
+}
+
+// wrapWriter tracks the writes of the output for the stuck writer detection
+// and buffers them if OutputBufferSize is set.
+func (f *LogFilter) wrapWriter(name string, w io.Writer) io.Writer {
+	writer := newTrackedWriter(name, w)
+	f.trackedWriters = append(f.trackedWriters, writer)
+
+	if f.config.OutputBufferSize > 0 {
+		bufferedWriter := newBufferedWriter(writer, f.config.OutputBufferSize)
+		f.bufferedWriters = append(f.bufferedWriters, bufferedWriter)
+		return bufferedWriter
+	}
+
+	return writer
+}
+
+// initOutput builds the output from its config.
+func (f *LogFilter) initOutput(config Output) (*output, error) {
+	o := &output{
+		name: config.Name,
+	}
+
+	switch config.Type {
+	case OutputTypeStdout:
+		// the writes are already tracked, buffered and spooled
+		o.writer = f.output(OutputStdout).writer
+	case OutputTypeStderr:
+		o.writer = f.wrapWriter(config.Name, os.Stderr)
+	case OutputTypeFile:
+		file, err := newRotatedFile(config)
+		if err != nil {
+			return nil, xerrors.Errorf("output %s: %w", config.Name, err)
+		}
+		o.file = file
+		if config.MaxTotalSizeMB > 0 || config.MinFreeMB > 0 {
+			if err := ValidateMaxTotalSize(config.MaxTotalSizeMB, config.MaxSizeMB); err != nil {
+				return nil, xerrors.Errorf("output %s: %w", config.Name, err)
+			}
+			o.guard, err = newGuardedFile(file, config, f.logger)
+			if err != nil {
+				return nil, xerrors.Errorf("output %s: %w", config.Name, err)
+			}
+			// the guard gets the whole lines in front of the output buffer
+			o.guard.w = f.wrapWriter(config.Name, o.guard.fileWriter())
+			o.writer = o.guard
+		} else {
+			o.writer = f.wrapWriter(config.Name, o.file)
+		}
+	default:
+		return nil, xerrors.Errorf("invalid output type: %s: %s", config.Name, config.Type)
+	}
+
+	f.outputs = append(f.outputs, o)
+
+	return o, nil
+}
+
+// output returns the output with the name or nil.
+func (f *LogFilter) output(name string) *output {
+	for _, o := range f.outputs {
+		if o.name == name {
+			return o
+		}
+	}
+	return nil
+}
+
+// close closes the file of the output and flushes it to the disk.
+func (o *output) close() error {
+	if o.file == nil {
+		return nil
+	}
+
+	if err := o.file.Close(); err != nil {
+		return xerrors.Errorf("failed to close output file: %s: %w", o.name, err)
+	}
+
+	return nil
+}
+
+const (
+	OutputReopenActionReopen = "reopen"
+	OutputReopenActionRotate = "rotate"
+)
+
+// ValidateOutputReopenAction checks if the reopen action is known.
+func ValidateOutputReopenAction(action string) error {
+	switch action {
+	case "", OutputReopenActionReopen, OutputReopenActionRotate:
+		return nil
+	}
+	return xerrors.Errorf("invalid output reopen action: %s", action)
+}
+
+func (f *LogFilter) hasOutputFiles() bool {
+	for _, o := range f.outputs {
+		if o.file != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ReopenOutputFiles closes the output files. They are opened again on the next
+// write so that the files moved or truncated by an external tool (e.g.
+// logrotate) are not written anymore.
+func (f *LogFilter) ReopenOutputFiles() error {
+	return f.eachOutputFile(OutputReopenActionReopen, rotatedFile.reopen)
+}
+
+// RotateOutputFiles moves the output files to backups and starts new files.
+func (f *LogFilter) RotateOutputFiles() error {
+	return f.eachOutputFile(OutputReopenActionRotate, rotatedFile.rotate)
+}
+
+func (f *LogFilter) eachOutputFile(action string, fn func(rotatedFile) error) error {
+	// the buffered lines are written to the old files
+	if err := f.flushWriters(); err != nil {
+		return err
+	}
+
+	var actionErr error
+
+	for _, o := range f.outputs {
+		if o.file == nil {
+			continue
+		}
+		if err := fn(o.file); err != nil {
+			actionErr = multierror.Append(actionErr, xerrors.Errorf("failed to %s output file: %s: %w", action, o.name, err))
+		}
+	}
+
+	if actionErr != nil {
+		return actionErr
+	}
+
+	f.logger.WithField("action", action).Info("LogFilter output files reopened")
+
+	return nil
+}
+
+// runOutputReopenSignal reopens or rotates the output files on the signal.
+func (f *LogFilter) runOutputReopenSignal(ctx context.Context) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, f.outputReopenSignal)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-signals:
+			var err error
+			if f.config.OutputReopenAction == OutputReopenActionRotate {
+				err = f.RotateOutputFiles()
+			} else {
+				err = f.ReopenOutputFiles()
+			}
+			if err != nil {
+				f.logger.WithError(err).Warn("LogFilter failed to reopen output files")
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// outputReopenHandler reopens or rotates the output files on POST requests.
+func outputReopenHandler(fn func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := fn(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
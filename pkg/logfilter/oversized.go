@@ -0,0 +1,111 @@
+package logfilter
+
+import (
+	"bufio"
+	"bytes"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	OversizedLineFail     = "fail"
+	OversizedLineTruncate = "truncate"
+	OversizedLineSplit    = "split"
+	OversizedLineFull     = "full"
+)
+
+// TruncatedLineMarker is appended to the truncated oversized lines.
+const TruncatedLineMarker = "...[truncated]"
+
+// ValidateOversizedLinePolicy checks if the oversized line policy is known.
+func ValidateOversizedLinePolicy(policy string) error {
+	switch policy {
+	case "", OversizedLineFail, OversizedLineTruncate, OversizedLineSplit, OversizedLineFull:
+		return nil
+	}
+	return xerrors.Errorf("invalid oversized line policy: %s", policy)
+}
+
+// lineSplitter is a bufio.SplitFunc that splits the lines longer than max into
+// chunks of max bytes instead of failing with bufio.ErrTooLong, unless the
+// oversized line policy is fail. The scanner buffer must be able to hold max+1
+// bytes. The fields describe the last token returned.
+type lineSplitter struct {
+	max    int
+	policy string
+
+	// inOversized is true while the rest of an oversized line is being read
+	inOversized bool
+
+	// oversized is true if the token is a part of an oversized line
+	oversized bool
+	// first is true if the token is the first part of an oversized line
+	first bool
+	// partial is true if the oversized line continues after the token
+	partial bool
+
+	// consumed is the number of bytes consumed including the token
+	consumed int64
+}
+
+func (s *lineSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexByte(data, '\n'); i >= 0 && i <= s.max {
+		return s.lineEnd(i+1, dropCR(data[:i]))
+	}
+
+	if len(data) <= s.max {
+		if atEOF {
+			return s.lineEnd(len(data), data)
+		}
+		// request more data
+		return 0, nil, nil
+	}
+
+	first := !s.inOversized
+	s.inOversized = true
+
+	s.oversized = true
+	s.first = first
+	s.partial = true
+
+	switch s.policy {
+	case OversizedLineTruncate, OversizedLineSplit, OversizedLineFull:
+		s.consumed += int64(s.max)
+		return s.max, data[:s.max], nil
+	}
+
+	return 0, nil, bufio.ErrTooLong
+}
+
+// lineEnd returns the token of the line end. It is the last part of an
+// oversized line if the line was longer than max.
+func (s *lineSplitter) lineEnd(advance int, token []byte) (int, []byte, error) {
+	s.consumed += int64(advance)
+
+	if !s.inOversized {
+		s.oversized = false
+		s.first = false
+		s.partial = false
+		return advance, token, nil
+	}
+
+	s.inOversized = false
+
+	s.oversized = true
+	s.first = false
+	s.partial = false
+
+	return advance, token, nil
+}
+
+// dropCR drops a terminal \r from the data (same as bufio.ScanLines).
+func dropCR(data []byte) []byte {
+	if len(data) > 0 && data[len(data)-1] == '\r' {
+		return data[0 : len(data)-1]
+	}
+	return data
+}
@@ -0,0 +1,123 @@
+package logfilter_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Oversized lines", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logfilter-test-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	long := strings.Repeat("a", 10) + strings.Repeat("b", 10) + strings.Repeat("c", 5)
+	input := "line1\n" + long + "\nline2\n" + long + "\nline3"
+
+	DescribeTable("should apply the policy and continue scanning",
+		func(policy string, expectedOutput string, expectedFullOutput string) {
+			config := &Config{}
+			config.MaxScanLineSize = 10
+			config.OversizedLinePolicy = policy
+			config.FullOutputFilename = filepath.Join(tmpDir, "logfilter.log")
+
+			writer := &syncBuffer{}
+
+			logFilter := NewLogFilter(config, strings.NewReader(input), writer, Logger)
+			Expect(logFilter.Init(TestCtx)).To(Succeed())
+			defer logFilter.Close()
+
+			Expect(logFilter.Start()).To(MatchError("reading stdin: EOF"))
+
+			Expect(writer.String()).To(Equal(expectedOutput))
+
+			fullOutput, err := ioutil.ReadFile(config.FullOutputFilename)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(fullOutput)).To(Equal(expectedFullOutput))
+
+			Expect(logFilter.Status().Streams[0].Oversized).To(BeEquivalentTo(2))
+		},
+		Entry("truncate",
+			OversizedLineTruncate,
+			"line1\naaaaaaaaaa"+TruncatedLineMarker+"\nline2\naaaaaaaaaa"+TruncatedLineMarker+"\nline3\n",
+			"line1\naaaaaaaaaa"+TruncatedLineMarker+"\nline2\naaaaaaaaaa"+TruncatedLineMarker+"\nline3\n",
+		),
+		Entry("split",
+			OversizedLineSplit,
+			"line1\naaaaaaaaaa\nbbbbbbbbbb\nccccc\nline2\naaaaaaaaaa\nbbbbbbbbbb\nccccc\nline3\n",
+			"line1\naaaaaaaaaa\nbbbbbbbbbb\nccccc\nline2\naaaaaaaaaa\nbbbbbbbbbb\nccccc\nline3\n",
+		),
+		Entry("full",
+			OversizedLineFull,
+			"line1\nline2\nline3\n",
+			"line1\n"+long+"\nline2\n"+long+"\nline3\n",
+		),
+	)
+
+	It("should fail for the fail policy", func() {
+		config := &Config{}
+		config.MaxScanLineSize = 10
+		config.OversizedLinePolicy = OversizedLineFail
+
+		writer := &syncBuffer{}
+
+		logFilter := NewLogFilter(config, strings.NewReader(input), writer, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError(ContainSubstring("token too long")))
+
+		Expect(writer.String()).To(Equal("line1\n"))
+	})
+
+	It("should label only the first part of a line written to the full output", func() {
+		config := &Config{}
+		config.MaxScanLineSize = 10
+		config.OversizedLinePolicy = OversizedLineFull
+		config.FullOutputFilename = filepath.Join(tmpDir, "logfilter.log")
+		config.ProcLabelField = "proc"
+		config.Procs = Procs{
+			{Name: "web", Cmd: []string{"bash", "-c", "echo " + long + "; echo line1"}},
+		}
+
+		writer := &syncBuffer{}
+
+		logFilter := NewLogFilter(config, bytes.NewReader(nil), writer, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(HaveOccurred())
+
+		Expect(writer.String()).To(Equal("[web] line1\n"))
+
+		fullOutput, err := ioutil.ReadFile(config.FullOutputFilename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(fullOutput)).To(Equal("[web] " + long + "\n[web] line1\n"))
+	})
+
+	It("should fail for an invalid oversized line policy", func() {
+		config := &Config{}
+		config.OversizedLinePolicy = "explode"
+
+		logFilter := NewLogFilter(config, strings.NewReader(""), &syncBuffer{}, Logger)
+		defer logFilter.Close()
+
+		Expect(logFilter.Init(TestCtx)).To(MatchError("invalid oversized line policy: explode"))
+	})
+})
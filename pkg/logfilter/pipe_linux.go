@@ -0,0 +1,87 @@
+package logfilter
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// pipeReader reads the OS pipe the command writes to directly. The bytes are
+// read and recorded while holding the lock so that the bytes still in the pipe
+// and the recorded bytes are consistent for wait.
+func (p *scanProgress) pipeReader(f *os.File) io.Reader {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return f
+	}
+
+	p.pipe = f
+
+	return &pipeProgressReader{
+		conn: conn,
+		p:    p,
+	}
+}
+
+type pipeProgressReader struct {
+	conn syscall.RawConn
+	p    *scanProgress
+}
+
+func (r *pipeProgressReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	var n int
+	var readErr error
+
+	err := r.conn.Read(func(fd uintptr) bool {
+		r.p.mu.Lock()
+		defer r.p.mu.Unlock()
+
+		for {
+			n, readErr = syscall.Read(int(fd), b)
+			if readErr != syscall.EINTR {
+				break
+			}
+		}
+		if readErr == syscall.EAGAIN {
+			// wait until the pipe is readable
+			return false
+		}
+		if n > 0 {
+			r.p.written(b[:n])
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if readErr != nil {
+		return 0, readErr
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+
+	return n, nil
+}
+
+// pipeBuffered returns the number of bytes in the pipe that are not read yet
+// (TIOCINQ is FIONREAD on linux).
+func pipeBuffered(f *os.File) int {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return 0
+	}
+
+	n := 0
+	_ = conn.Control(func(fd uintptr) {
+		n, _ = unix.IoctlGetInt(int(fd), unix.TIOCINQ)
+	})
+
+	return n
+}
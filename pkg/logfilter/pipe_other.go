@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package logfilter
+
+import (
+	"io"
+	"os"
+)
+
+// pipeReader reads the OS pipe the command writes to directly. The bytes still
+// in the pipe are not waited for.
+func (p *scanProgress) pipeReader(f *os.File) io.Reader {
+	return f
+}
+
+func pipeBuffered(f *os.File) int {
+	return 0
+}
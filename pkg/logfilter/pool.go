@@ -0,0 +1,52 @@
+package logfilter
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// lineBufSize is the initial capacity of a pooled line buffer.
+	lineBufSize = 512
+
+	// maxPooledLineBufSize is the maximum capacity of a line buffer that is
+	// returned to the pool so that the pool does not keep huge lines alive.
+	maxPooledLineBufSize = 64 * 1024
+)
+
+// lineBuf is a pooled buffer of a scanned line. It is returned to the pool
+// after the line is written unless the line is retained by a later stage.
+type lineBuf struct {
+	b []byte
+	// event is the event of the line
+	event event
+}
+
+var lineBufPool = sync.Pool{
+	New: func() interface{} {
+		return &lineBuf{
+			b: make([]byte, 0, lineBufSize),
+		}
+	},
+}
+
+func getLineBuf() *lineBuf {
+	return lineBufPool.Get().(*lineBuf)
+}
+
+func putLineBuf(buf *lineBuf) {
+	if cap(buf.b) > maxPooledLineBufSize {
+		return
+	}
+	buf.b = buf.b[:0]
+	buf.event = event{}
+	lineBufPool.Put(buf)
+}
+
+// writeLine writes the line followed by a newline with a single Write. The
+// newline is added in place if the line has a spare capacity (the bytes after
+// the line must not be used by anything else), otherwise the line is copied.
+func writeLine(w io.Writer, b []byte) error {
+	_, err := w.Write(append(b, '\n'))
+	return err
+}
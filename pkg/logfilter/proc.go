@@ -0,0 +1,270 @@
+package logfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// proc is a command run by the logfilter together with its output streams.
+type proc struct {
+	name      string
+	config    Proc
+	commander *Commander
+	streams   []*stream
+
+	stdoutWriter io.WriteCloser
+	stderrWriter io.WriteCloser
+	fdReader     *os.File
+	fdWriter     *os.File
+}
+
+// closeWriters closes the write ends of the pipes so that the scanning of the
+// streams finishes after the command exits.
+func (p *proc) closeWriters() {
+	p.stdoutWriter.Close()
+	p.stderrWriter.Close()
+	if p.fdWriter != nil {
+		p.fdWriter.Close()
+	}
+}
+
+func (p *proc) close() {
+	if p.fdReader != nil {
+		p.fdWriter.Close()
+		p.fdReader.Close()
+	}
+}
+
+// streamName returns the stream name prefixed with the process name if the
+// logfilter runs multiple processes.
+func (p *proc) streamName(name string) string {
+	if p.name == "" {
+		return name
+	}
+	return p.name + "/" + name
+}
+
+// check returns the health check name for the process.
+func (p *proc) check(name string) string {
+	if p.name == "" {
+		return name
+	}
+	return name + "/" + p.name
+}
+
+func (f *LogFilter) initProc(procConfig Proc) (*proc, error) {
+	p := &proc{
+		name:   procConfig.Name,
+		config: procConfig,
+	}
+
+	logger := f.logger
+	if p.name != "" {
+		logger = logger.WithField("proc", p.name)
+	}
+
+	jsonFilter := f.jsonFilter
+	if procConfig.ExcludeTemplate != "" || procConfig.FilterQuery != "" {
+		var err error
+		jsonFilter, err = NewJSONFilter(procConfig.ExcludeTemplate, procConfig.FilterQuery, logger)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to build proc json filter: %s: %w", p.name, err)
+		}
+	}
+
+	var label *procLabel
+	if p.name != "" && f.config.ProcLabelField != "" {
+		label = newProcLabel(f.config.ProcLabelField, p.name)
+	}
+
+	stdoutReader, stdoutPipeWriter := io.Pipe()
+	stderrReader, stderrPipeWriter := io.Pipe()
+	p.stdoutWriter = stdoutPipeWriter
+	p.stderrWriter = stderrPipeWriter
+
+	var stdoutWriter io.Writer = stdoutPipeWriter
+	var stderrWriter io.Writer = stderrPipeWriter
+
+	p.streams = append(p.streams, &stream{
+		name:       p.streamName(StreamStdout),
+		kind:       StreamStdout,
+		reader:     stdoutReader,
+		jsonFilter: jsonFilter,
+		writer:     f.writer,
+		label:      label,
+		proc:       p,
+	}, &stream{
+		name:       p.streamName(StreamStderr),
+		kind:       StreamStderr,
+		reader:     stderrReader,
+		jsonFilter: jsonFilter,
+		writer:     f.writer,
+		label:      label,
+		proc:       p,
+	})
+
+	dir := procConfig.Dir
+	if dir == "" {
+		dir = f.config.CmdDir
+	}
+
+	options := CommanderOptions{
+		Env:           append(append([]string{}, f.config.CmdEnv...), procConfig.Env...),
+		Dir:           dir,
+		User:          f.config.CmdUser,
+		Group:         f.config.CmdGroup,
+		Rlimits:       f.config.CmdRlimits,
+		RestartPolicy: procConfig.RestartPolicy,
+		RestartDelay:  time.Duration(procConfig.RestartDelay),
+	}
+	if f.config.CmdStdin {
+		options.Stdin = f.reader
+	}
+	if f.config.CmdStripEnv {
+		options.StripEnvPrefix = EnvPrefix
+	}
+
+	if f.config.FD > 0 {
+		fdStream, err := f.initFDStream(p, &options, label)
+		if err != nil {
+			return nil, err
+		}
+		p.streams = append(p.streams, fdStream)
+	}
+
+	if f.config.CrashDumpLines > 0 {
+		for _, s := range p.streams {
+			s.recent = newRecentLines(f.config.CrashDumpLines)
+			s.progress = newScanProgress()
+
+			switch s.kind {
+			case StreamStdout:
+				stdoutWriter = s.progress.writer(stdoutWriter)
+			case StreamStderr:
+				stderrWriter = s.progress.writer(stderrWriter)
+			case StreamFD:
+				// the command writes to the pipe directly
+				s.reader = s.progress.pipeReader(p.fdReader)
+			}
+		}
+	}
+	options.OnExit = f.onProcExit(p)
+
+	p.commander = NewCommander(procConfig.Cmd, f.config.CmdShutdownTimeout, stdoutWriter, stderrWriter, options, logger)
+
+	return p, nil
+}
+
+// onProcExit is called after each run of the proc command. It writes the crash
+// dump if the command exited abnormally and it was not stopped by the logfilter.
+func (f *LogFilter) onProcExit(p *proc) func(CommanderState, bool) {
+	return func(state CommanderState, stopped bool) {
+		if f.config.CrashDumpLines > 0 && !stopped && state.ExitError != "" {
+			f.crashDump(p, state)
+		}
+
+		f.resetReadiness()
+	}
+}
+
+// initFDStream creates the pipe for the structured log stream and passes its
+// write end to the command as an extra file descriptor.
+func (f *LogFilter) initFDStream(p *proc, options *CommanderOptions, label *procLabel) (*stream, error) {
+	if f.config.FD < 3 {
+		return nil, xerrors.Errorf("structured log fd must be 3 or greater: %d", f.config.FD)
+	}
+
+	jsonFilter, err := NewJSONFilter(f.config.FDExcludeTemplate, f.config.FDFilterQuery, f.logger)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to build fd json filter: %w", err)
+	}
+
+	var writer io.Writer
+	switch f.config.FDOutput {
+	case "", FDOutputStdout:
+		writer = f.writer
+	case FDOutputFull:
+		writer = ioutil.Discard
+	default:
+		return nil, xerrors.Errorf("invalid fd output: %s", f.config.FDOutput)
+	}
+
+	p.fdReader, p.fdWriter, err = os.Pipe()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create fd pipe: %w", err)
+	}
+
+	// ExtraFiles entry i becomes file descriptor 3+i, nil entries are closed
+	options.ExtraFiles = make([]*os.File, f.config.FD-2)
+	options.ExtraFiles[f.config.FD-3] = p.fdWriter
+
+	if f.config.FDEnv != "" {
+		options.Env = append(options.Env, f.config.FDEnv+"="+strconv.Itoa(f.config.FD))
+	}
+
+	return &stream{
+		name:       p.streamName(StreamFD),
+		kind:       StreamFD,
+		reader:     p.fdReader,
+		jsonFilter: jsonFilter,
+		writer:     writer,
+		label:      label,
+		proc:       p,
+	}, nil
+}
+
+// procLabel adds the process name to the lines of a process.
+type procLabel struct {
+	jsonPrefix []byte
+	textPrefix []byte
+}
+
+func newProcLabel(field string, name string) *procLabel {
+	jsonField, _ := json.Marshal(field)
+	jsonName, _ := json.Marshal(name)
+
+	return &procLabel{
+		jsonPrefix: []byte(`{` + string(jsonField) + `:` + string(jsonName)),
+		textPrefix: []byte("[" + name + "] "),
+	}
+}
+
+// apply returns a new slice with the label field inserted as the first field
+// of a JSON object or with the label prefix for other lines. The slice has a
+// spare capacity for the newline.
+func (l *procLabel) apply(b []byte) []byte {
+	return l.appendTo(make([]byte, 0, l.size()+len(b)+1), b)
+}
+
+// appendTo appends the labeled line to dst.
+func (l *procLabel) appendTo(dst []byte, b []byte) []byte {
+	trimmed := bytes.TrimLeft(b, " \t")
+
+	if len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(trimmed) {
+		rest := bytes.TrimLeft(trimmed[1:], " \t\r\n")
+
+		dst = append(dst, l.jsonPrefix...)
+		if len(rest) > 0 && rest[0] != '}' {
+			dst = append(dst, ',')
+		}
+		return append(dst, rest...)
+	}
+
+	dst = append(dst, l.textPrefix...)
+	return append(dst, b...)
+}
+
+// size returns the maximum number of bytes the label adds to a line.
+func (l *procLabel) size() int {
+	if len(l.jsonPrefix)+1 > len(l.textPrefix) {
+		return len(l.jsonPrefix) + 1
+	}
+	return len(l.textPrefix)
+}
@@ -0,0 +1,32 @@
+package logfilter
+
+import (
+	"regexp"
+
+	"golang.org/x/xerrors"
+)
+
+// RegexJSONFilter excludes the lines matching the regular expression. The
+// lines do not have to be JSON.
+type RegexJSONFilter struct {
+	ExcludeRegexp *regexp.Regexp
+}
+
+func NewRegexJSONFilter(excludeRegex string) (*RegexJSONFilter, error) {
+	excludeRegexp, err := regexp.Compile(excludeRegex)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to compile exclude regex: %s: %w", excludeRegex, err)
+	}
+
+	return &RegexJSONFilter{
+		ExcludeRegexp: excludeRegexp,
+	}, nil
+}
+
+func (f *RegexJSONFilter) IsIncluded(b []byte) (bool, error) {
+	return !f.ExcludeRegexp.Match(b), nil
+}
+
+func (f *RegexJSONFilter) process(e *event) (bool, error) {
+	return f.IsIncluded(e.raw)
+}
@@ -0,0 +1,150 @@
+package logfilter
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+// rlimitResources are the supported rlimit resources by name.
+var rlimitResources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// rlimitHelperEnv marks the logfilter binary re-executed as the rlimit helper.
+// The value is the file descriptor of the start pipe and the path of the
+// command separated by a colon.
+const rlimitHelperEnv = "LOGFILTER_RLIMIT_HELPER"
+
+// RunRlimitHelper executes the command if the process was started by
+// logfilter as the rlimit helper of a command with CmdRlimits, otherwise it
+// returns. The helper waits until logfilter applied the rlimits to the helper
+// process and then executes the command in place of the helper so that the
+// command starts with the limits in place. The binaries that start commands
+// with CmdRlimits must call it at the start of main.
+func RunRlimitHelper() {
+	value, ok := os.LookupEnv(rlimitHelperEnv)
+	if !ok {
+		return
+	}
+
+	i := strings.IndexByte(value, ':')
+	if i < 0 {
+		fmt.Fprintf(os.Stderr, "logfilter: invalid %s: %s\n", rlimitHelperEnv, value)
+		os.Exit(127)
+	}
+	fd, err := strconv.Atoi(value[:i])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logfilter: invalid %s: %s\n", rlimitHelperEnv, value)
+		os.Exit(127)
+	}
+	path := value[i+1:]
+
+	start := os.NewFile(uintptr(fd), "rlimit-helper")
+	b := make([]byte, 1)
+	n, _ := start.Read(b)
+	start.Close()
+	if n != 1 {
+		// logfilter failed to apply the rlimits and kills the helper
+		os.Exit(127)
+	}
+
+	os.Unsetenv(rlimitHelperEnv)
+
+	err = syscall.Exec(path, os.Args, os.Environ())
+	fmt.Fprintf(os.Stderr, "logfilter: failed to execute command: %s: %s\n", path, err)
+	os.Exit(127)
+}
+
+// rlimitHelper starts the command through the logfilter binary which waits for
+// the rlimits before it executes the command.
+type rlimitHelper struct {
+	rlimits Rlimits
+	r       *os.File
+	w       *os.File
+}
+
+// newRlimitHelper changes the cmd to start the rlimit helper. The start pipe
+// is added after the ExtraFiles so their file descriptors are kept.
+func newRlimitHelper(cmd *exec.Cmd, rlimits Rlimits) (*rlimitHelper, error) {
+	for _, rlimit := range rlimits {
+		if _, ok := rlimitResources[rlimit.Resource]; !ok {
+			return nil, xerrors.Errorf("unknown rlimit resource: %s", rlimit.Resource)
+		}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get logfilter executable: %w", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create rlimit helper pipe: %w", err)
+	}
+
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(append([]*os.File{}, cmd.ExtraFiles...), r)
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(append([]string{}, env...), fmt.Sprintf("%s=%d:%s", rlimitHelperEnv, fd, cmd.Path))
+	cmd.Path = self
+
+	return &rlimitHelper{
+		rlimits: rlimits,
+		r:       r,
+		w:       w,
+	}, nil
+}
+
+// start applies the rlimits to the started helper and lets it execute the
+// command.
+func (h *rlimitHelper) start(pid int) error {
+	h.r.Close()
+
+	for _, rlimit := range h.rlimits {
+		limit := &unix.Rlimit{
+			Cur: rlimit.Soft,
+			Max: rlimit.Hard,
+		}
+		if err := unix.Prlimit(pid, rlimitResources[rlimit.Resource], limit, nil); err != nil {
+			return xerrors.Errorf("prlimit failed: %s: %w", rlimit.Resource, err)
+		}
+	}
+
+	if _, err := h.w.Write([]byte{0}); err != nil {
+		return xerrors.Errorf("failed to start rlimit helper: %w", err)
+	}
+
+	return nil
+}
+
+// close closes the start pipe. The helper exits if it was not started.
+func (h *rlimitHelper) close() {
+	h.r.Close()
+	h.w.Close()
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package logfilter
+
+import (
+	"os/exec"
+
+	"golang.org/x/xerrors"
+)
+
+// rlimitResources is nil, the rlimits are only supported on linux.
+var rlimitResources map[string]int
+
+// RunRlimitHelper returns, the rlimits are only supported on linux.
+func RunRlimitHelper() {}
+
+type rlimitHelper struct{}
+
+func newRlimitHelper(cmd *exec.Cmd, rlimits Rlimits) (*rlimitHelper, error) {
+	return nil, xerrors.Errorf("rlimits are only supported on linux")
+}
+
+func (h *rlimitHelper) start(pid int) error {
+	return nil
+}
+
+func (h *rlimitHelper) close() {}
@@ -0,0 +1,504 @@
+package logfilter
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	RotateIntervalHourly = "hourly"
+	RotateIntervalDaily  = "daily"
+)
+
+// ValidateRotateInterval checks if the rotate interval is known.
+func ValidateRotateInterval(interval string) error {
+	switch interval {
+	case "", RotateIntervalHourly, RotateIntervalDaily:
+		return nil
+	}
+	return xerrors.Errorf("invalid rotate interval: %s", interval)
+}
+
+// rotatedFile is an output file that is rotated and cleaned up by itself.
+// Close flushes the file to the disk. Writes after Close fail instead of
+// opening the file again.
+type rotatedFile interface {
+	io.WriteCloser
+	// currentFilename returns the name of the file being written
+	currentFilename() string
+	// reopen closes the file, the next write opens the file again (e.g. after
+	// it was moved or truncated by an external tool)
+	reopen() error
+	// rotate moves the file to a backup and starts a new file
+	rotate() error
+}
+
+// errFileClosed fails the writes after the file is closed.
+var errFileClosed = xerrors.New("output file closed")
+
+const megabyte = 1024 * 1024
+
+// defaultMaxSizeMB is the max size of the file if MaxSizeMB is not set (the
+// default of lumberjack).
+const defaultMaxSizeMB = 100
+
+// backupTimeFormat is the format of the rotation time in the names of the
+// backups created by lumberjack.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// sizeRotatedFile is a file rotated only by size.
+type sizeRotatedFile struct {
+	logger *lumberjack.Logger
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (f *sizeRotatedFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, errFileClosed
+	}
+	return f.logger.Write(b)
+}
+
+func (f *sizeRotatedFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	if err := f.logger.Close(); err != nil {
+		return err
+	}
+	return syncOutput(f.logger.Filename)
+}
+
+func (f *sizeRotatedFile) currentFilename() string {
+	return f.logger.Filename
+}
+
+func (f *sizeRotatedFile) reopen() error {
+	// lumberjack opens the file on the next write
+	return f.logger.Close()
+}
+
+func (f *sizeRotatedFile) rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	return f.logger.Rotate()
+}
+
+func newRotatedFile(config Output) (rotatedFile, error) {
+	if config.RotateInterval == "" {
+		return &sizeRotatedFile{logger: &lumberjack.Logger{
+			Filename:   config.Filename,
+			MaxSize:    config.MaxSizeMB,
+			MaxAge:     config.MaxAgeDays,
+			MaxBackups: config.MaxBackups,
+			Compress:   config.Compress,
+		}}, nil
+	}
+
+	if err := ValidateRotateInterval(config.RotateInterval); err != nil {
+		return nil, err
+	}
+
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load time zone: %s: %w", config.TimeZone, err)
+	}
+
+	return newTimeRotatedFile(config, location, time.Now), nil
+}
+
+// timeRotatedFile writes a separate file for each hour or day. The periods
+// start at the wall-clock boundaries of the location and the period is
+// included in the file name (e.g. logfilter-2020-08-18.log). The file of a
+// period is also rotated by size. The retention (MaxAgeDays and MaxBackups)
+// and the compression apply to the files of the previous periods and to the
+// size rotated backups. It is safe for concurrent use.
+type timeRotatedFile struct {
+	config   Output
+	location *time.Location
+	now      func() time.Time
+
+	mu        sync.Mutex
+	file      *lumberjack.Logger
+	periodEnd time.Time
+	// size follows the size of the file in lumberjack to detect the size
+	// rotations, it is -1 until the file is opened by the next write
+	size   int64
+	closed bool
+
+	// millMu serializes the compression and the removal of the old files
+	millMu sync.Mutex
+	millWG sync.WaitGroup
+}
+
+func newTimeRotatedFile(config Output, location *time.Location, now func() time.Time) *timeRotatedFile {
+	return &timeRotatedFile{
+		config:   config,
+		location: location,
+		now:      now,
+	}
+}
+
+func (f *timeRotatedFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, errFileClosed
+	}
+
+	now := f.now()
+
+	if f.file == nil || !now.Before(f.periodEnd) {
+		if err := f.openPeriod(now); err != nil {
+			return 0, err
+		}
+	}
+
+	rotated := f.sizeRotates(len(b))
+
+	n, err := f.file.Write(b)
+	if err != nil {
+		f.size = -1
+	}
+	if rotated {
+		// lumberjack only compresses the backups of the period
+		f.startMill("", now)
+	}
+
+	return n, err
+}
+
+// sizeRotates reports if lumberjack rotates the file by size before writing
+// n bytes. It follows the checks in lumberjack.Logger.Write.
+func (f *timeRotatedFile) sizeRotates(n int) bool {
+	maxSize := int64(f.config.MaxSizeMB) * megabyte
+	if maxSize <= 0 {
+		maxSize = defaultMaxSizeMB * megabyte
+	}
+	if int64(n) > maxSize {
+		return false
+	}
+
+	if f.size < 0 {
+		info, err := os.Stat(f.file.Filename)
+		if err != nil {
+			f.size = int64(n)
+			return false
+		}
+		if info.Size()+int64(n) >= maxSize {
+			f.size = int64(n)
+			return true
+		}
+		f.size = info.Size()
+	}
+
+	if f.size+int64(n) > maxSize {
+		f.size = int64(n)
+		return true
+	}
+
+	f.size += int64(n)
+	return false
+}
+
+// openPeriod closes the file of the previous period and starts the period of
+// now.
+func (f *timeRotatedFile) openPeriod(now time.Time) error {
+	previous := ""
+	if f.file != nil {
+		previous = f.file.Filename
+		if err := f.file.Close(); err != nil {
+			return xerrors.Errorf("failed to close period file: %w", err)
+		}
+	}
+
+	start, end := period(now.In(f.location), f.config.RotateInterval)
+
+	f.periodEnd = end
+	// the retention of the size rotated backups is handled by mill
+	f.file = &lumberjack.Logger{
+		Filename: periodFilename(f.config.Filename, start, f.config.RotateInterval),
+		MaxSize:  f.config.MaxSizeMB,
+		Compress: f.config.Compress,
+	}
+	f.size = -1
+
+	f.startMill(previous, now)
+
+	return nil
+}
+
+// startMill mills in the background. f.mu must be held.
+func (f *timeRotatedFile) startMill(previous string, now time.Time) {
+	current := f.file.Filename
+
+	f.millWG.Add(1)
+	go func() {
+		defer f.millWG.Done()
+		f.mill(previous, current, now)
+	}()
+}
+
+// mill compresses the file of the previous period (if any) and removes the
+// old files over the retention limits. Errors are ignored like in lumberjack.
+func (f *timeRotatedFile) mill(previous string, current string, now time.Time) {
+	f.millMu.Lock()
+	defer f.millMu.Unlock()
+
+	if f.config.Compress && previous != "" && previous != current {
+		if err := compressFile(previous); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+
+	if f.config.MaxBackups == 0 && f.config.MaxAgeDays == 0 {
+		return
+	}
+
+	files, err := oldFiles(f.config.Filename, current, f.location)
+	if err != nil {
+		return
+	}
+
+	cutoff := now.Add(-time.Duration(f.config.MaxAgeDays) * 24 * time.Hour)
+
+	for i, file := range files {
+		expired := f.config.MaxAgeDays > 0 && file.time.Before(cutoff)
+		overLimit := f.config.MaxBackups > 0 && i >= f.config.MaxBackups
+		if expired || overLimit {
+			_ = os.Remove(filepath.Join(filepath.Dir(f.config.Filename), file.Name()))
+		}
+	}
+}
+
+func (f *timeRotatedFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		if err == nil {
+			err = syncOutput(f.file.Filename)
+		}
+	}
+
+	f.millWG.Wait()
+
+	return err
+}
+
+func (f *timeRotatedFile) reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	f.size = -1
+	return f.file.Close()
+}
+
+func (f *timeRotatedFile) rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil || f.closed {
+		return nil
+	}
+	if err := f.file.Rotate(); err != nil {
+		f.size = -1
+		return err
+	}
+	f.size = 0
+	f.startMill("", f.now())
+	return nil
+}
+
+func (f *timeRotatedFile) currentFilename() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		start, _ := period(f.now().In(f.location), f.config.RotateInterval)
+		return periodFilename(f.config.Filename, start, f.config.RotateInterval)
+	}
+	return f.file.Filename
+}
+
+// period returns the start and the end of the hour or the day of t in the
+// location of t.
+func period(t time.Time, interval string) (time.Time, time.Time) {
+	if interval == RotateIntervalHourly {
+		start := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		return start, start.Add(time.Hour)
+	}
+
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	// AddDate handles the days shorter or longer than 24 hours
+	return start, start.AddDate(0, 0, 1)
+}
+
+// The layouts of the periods in the file names.
+const (
+	periodLayoutHourly = "2006-01-02T15"
+	periodLayoutDaily  = "2006-01-02"
+)
+
+// periodFilename adds the period to the file name before the extension.
+func periodFilename(filename string, start time.Time, interval string) string {
+	layout := periodLayoutDaily
+	if interval == RotateIntervalHourly {
+		layout = periodLayoutHourly
+	}
+
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-" + start.Format(layout) + ext
+}
+
+// oldFile is a rotated file of the output.
+type oldFile struct {
+	os.FileInfo
+	// time is the rotation time encoded in the file name
+	time time.Time
+}
+
+// oldFiles returns the rotated files of the output from the newest to the
+// oldest by the time encoded in their names. The rotated files have a period
+// or a lumberjack backup timestamp after the prefix. The periods are in the
+// location. The current file and the files without a time are skipped.
+func oldFiles(filename string, current string, location *time.Location) ([]oldFile, error) {
+	dir := filepath.Dir(filename)
+	ext := filepath.Ext(filename)
+	prefix := strings.TrimSuffix(filepath.Base(filename), ext) + "-"
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read output dir: %w", err)
+	}
+
+	files := []oldFile{}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || name == filepath.Base(current) || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(name, prefix)
+		switch {
+		case strings.HasSuffix(stamp, ext):
+			stamp = strings.TrimSuffix(stamp, ext)
+		case strings.HasSuffix(stamp, ext+".gz"):
+			stamp = strings.TrimSuffix(stamp, ext+".gz")
+		default:
+			continue
+		}
+		// skips the files of other outputs, e.g. logfilter-errors.log
+		t, ok := rotationTime(stamp, location)
+		if !ok {
+			continue
+		}
+		files = append(files, oldFile{FileInfo: info, time: t})
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].time.After(files[j].time)
+	})
+
+	return files, nil
+}
+
+// rotationTime parses the time in the name of a rotated file. The size
+// rotated backups end with the rotation time in UTC (also after the period,
+// e.g. 2020-08-18-2020-08-18T10-00-00.000). The files of the periods were
+// rotated at the end of the period.
+func rotationTime(stamp string, location *time.Location) (time.Time, bool) {
+	if len(stamp) >= len(backupTimeFormat) {
+		t, err := time.Parse(backupTimeFormat, stamp[len(stamp)-len(backupTimeFormat):])
+		if err == nil {
+			return t, true
+		}
+	}
+
+	if t, err := time.ParseInLocation(periodLayoutHourly, stamp, location); err == nil {
+		_, end := period(t, RotateIntervalHourly)
+		return end, true
+	}
+	if t, err := time.ParseInLocation(periodLayoutDaily, stamp, location); err == nil {
+		_, end := period(t, RotateIntervalDaily)
+		return end, true
+	}
+
+	return time.Time{}, false
+}
+
+// compressFile compresses the file with gzip and removes the original.
+func compressFile(filename string) (err error) {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(filename+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(filename + ".gz")
+		}
+	}()
+
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	// keep the modification time of the original file
+	if err := os.Chtimes(filename+".gz", info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	return os.Remove(filename)
+}
@@ -0,0 +1,418 @@
+package logfilter_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Rotation", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logfilter-test-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	run := func(configure func(config *Config)) Status {
+		config := &Config{}
+		config.DebugDisabled = true
+		config.MaxScanLineSize = 1024
+		config.FullOutputFilename = filepath.Join(tmpDir, "logfilter.log")
+		config.FullOutputMaxSizeMB = 1
+		configure(config)
+
+		logFilter := NewLogFilter(config, strings.NewReader("line1\nline2\n"), bytes.NewBuffer(nil), Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+
+		Expect(logFilter.Start()).To(MatchError("reading stdin: EOF"))
+		status := logFilter.Status()
+		Expect(logFilter.Close()).To(Succeed())
+
+		return status
+	}
+
+	It("should write the full output to the file of the period", func() {
+		location, err := time.LoadLocation("America/New_York")
+		Expect(err).NotTo(HaveOccurred())
+
+		before := time.Now().In(location)
+
+		status := run(func(config *Config) {
+			config.FullOutputRotateInterval = RotateIntervalHourly
+			config.FullOutputTimeZone = "America/New_York"
+		})
+
+		after := time.Now().In(location)
+
+		// the hour can change during the test
+		filenames := []string{
+			filepath.Join(tmpDir, "logfilter-"+before.Format("2006-01-02T15")+".log"),
+			filepath.Join(tmpDir, "logfilter-"+after.Format("2006-01-02T15")+".log"),
+		}
+
+		out, err := ioutil.ReadFile(filenames[0])
+		if os.IsNotExist(err) {
+			out, err = ioutil.ReadFile(filenames[1])
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal("line1\nline2\n"))
+
+		_, err = os.Stat(filepath.Join(tmpDir, "logfilter.log"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		Expect(filenames).To(ContainElement(status.FullOutput.Filename))
+		Expect(status.FullOutput.SizeBytes).To(BeEquivalentTo(len("line1\nline2\n")))
+	})
+
+	It("should remove the size rotated backups over the limit during the period", func() {
+		config := &Config{}
+		config.DebugDisabled = true
+		config.MaxScanLineSize = 1024 * 1024
+		config.FullOutputFilename = filepath.Join(tmpDir, "logfilter.log")
+		config.FullOutputMaxSizeMB = 1
+		config.FullOutputMaxBackups = 1
+		config.FullOutputRotateInterval = RotateIntervalDaily
+
+		r, w := io.Pipe()
+
+		logFilter := NewLogFilter(config, r, bytes.NewBuffer(nil), Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		line := strings.Repeat("a", 600*1024) + "\n"
+
+		backups := func() []string {
+			names, err := filepath.Glob(filepath.Join(tmpDir, "logfilter-*-*T*.log"))
+			Expect(err).NotTo(HaveOccurred())
+			return names
+		}
+
+		for i := 0; i < 6; i++ {
+			_, err := w.Write([]byte(line))
+			Expect(err).NotTo(HaveOccurred())
+
+			if i%2 == 1 {
+				// each size rotation creates a backup with a new timestamp
+				Eventually(backups).ShouldNot(BeEmpty())
+				time.Sleep(2 * time.Millisecond)
+			}
+		}
+		w.Close()
+
+		Eventually(done).Should(Receive(MatchError("reading stdin: EOF")))
+
+		Eventually(backups).Should(HaveLen(1))
+		Consistently(backups, 100*time.Millisecond).Should(HaveLen(1))
+	})
+
+	It("should remove the files of the old periods", func() {
+		now := time.Now()
+
+		oldFiles := []string{
+			"logfilter-2020-08-16.log.gz",
+			"logfilter-2020-08-17.log",
+			"logfilter-2020-08-18-2020-08-18T10-00-00.000.log",
+		}
+		for i, name := range oldFiles {
+			filename := filepath.Join(tmpDir, name)
+			Expect(ioutil.WriteFile(filename, []byte("old\n"), 0644)).To(Succeed())
+			modTime := now.Add(time.Duration(i-len(oldFiles)) * time.Hour)
+			Expect(os.Chtimes(filename, modTime, modTime)).To(Succeed())
+		}
+		// the files of the other outputs are kept
+		Expect(ioutil.WriteFile(filepath.Join(tmpDir, "logfilter-errors.log"), []byte("error\n"), 0644)).To(Succeed())
+
+		run(func(config *Config) {
+			config.FullOutputRotateInterval = RotateIntervalDaily
+			config.FullOutputMaxBackups = 2
+		})
+
+		infos, err := ioutil.ReadDir(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		names := []string{}
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+
+		Expect(names).To(ConsistOf(
+			"logfilter-"+now.UTC().Format("2006-01-02")+".log",
+			"logfilter-2020-08-17.log",
+			"logfilter-2020-08-18-2020-08-18T10-00-00.000.log",
+			"logfilter-errors.log",
+		))
+	})
+
+	It("should fail for an invalid rotate interval or time zone", func() {
+		config := &Config{}
+		config.DebugDisabled = true
+		config.FullOutputFilename = filepath.Join(tmpDir, "logfilter.log")
+		config.FullOutputRotateInterval = "weekly"
+
+		logFilter := NewLogFilter(config, strings.NewReader(""), bytes.NewBuffer(nil), Logger)
+		Expect(logFilter.Init(TestCtx)).To(MatchError("output full: invalid rotate interval: weekly"))
+		logFilter.Close()
+
+		config.FullOutputRotateInterval = RotateIntervalDaily
+		config.FullOutputTimeZone = "Mars/Olympus_Mons"
+
+		logFilter = NewLogFilter(config, strings.NewReader(""), bytes.NewBuffer(nil), Logger)
+		Expect(logFilter.Init(TestCtx)).To(MatchError(ContainSubstring("output full: failed to load time zone: Mars/Olympus_Mons")))
+		logFilter.Close()
+	})
+
+	It("should remove the oldest backups over the total size", func() {
+		now := time.Now()
+
+		backups := []string{
+			"logfilter-2020-08-16T10-00-00.000.log",
+			"logfilter-2020-08-17T10-00-00.000.log.gz",
+			"logfilter-2020-08-18T10-00-00.000.log",
+		}
+		for i, name := range backups {
+			filename := filepath.Join(tmpDir, name)
+			Expect(ioutil.WriteFile(filename, bytes.Repeat([]byte("x"), 400*1024), 0644)).To(Succeed())
+			modTime := now.Add(time.Duration(i-len(backups)) * time.Hour)
+			Expect(os.Chtimes(filename, modTime, modTime)).To(Succeed())
+		}
+
+		run(func(config *Config) {
+			config.FullOutputMaxTotalSizeMB = 1
+		})
+
+		infos, err := ioutil.ReadDir(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		names := []string{}
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+
+		Expect(names).To(ConsistOf(
+			"logfilter.log",
+			"logfilter-2020-08-17T10-00-00.000.log.gz",
+			"logfilter-2020-08-18T10-00-00.000.log",
+		))
+	})
+
+	It("should skip the lines while there is not enough free space", func() {
+		if runtime.GOOS != "linux" {
+			Skip("free space is only supported on linux")
+		}
+
+		config := &Config{}
+		config.DebugDisabled = true
+		config.MaxScanLineSize = 1024
+		config.FullOutputFilename = filepath.Join(tmpDir, "logfilter.log")
+		config.FullOutputMaxSizeMB = 1
+		// more than any filesystem has
+		config.FullOutputMinFreeMB = 1 << 30
+
+		output := bytes.NewBuffer(nil)
+
+		logFilter := NewLogFilter(config, strings.NewReader("line1\nline2\n"), output, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("reading stdin: EOF"))
+
+		Expect(output.String()).To(Equal("line1\nline2\n"))
+
+		status := logFilter.Status()
+		Expect(status.FullOutput.Paused).To(BeTrue())
+		Expect(status.FullOutput.SkippedLines).To(Equal(uint64(2)))
+
+		_, err := os.Stat(config.FullOutputFilename)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should pause the writes when the filesystem is full", func() {
+		if _, err := os.Stat("/dev/full"); err != nil {
+			Skip("/dev/full is not available")
+		}
+
+		filename := filepath.Join(tmpDir, "logfilter.log")
+		// the writes to /dev/full fail with ENOSPC
+		Expect(os.Symlink("/dev/full", filename)).To(Succeed())
+
+		for _, bufferSize := range []int{0, 4096} {
+			config := &Config{}
+			config.DebugDisabled = true
+			config.MaxScanLineSize = 1024
+			config.OutputBufferSize = bufferSize
+			config.FullOutputFilename = filename
+			config.FullOutputMaxSizeMB = 1
+			config.FullOutputMinFreeMB = 1
+
+			output := bytes.NewBuffer(nil)
+
+			logFilter := NewLogFilter(config, strings.NewReader("line1\nline2\nline3\n"), output, Logger)
+			Expect(logFilter.Init(TestCtx)).To(Succeed())
+
+			Expect(logFilter.Start()).To(MatchError("reading stdin: EOF"), "buffer size %d", bufferSize)
+
+			Expect(output.String()).To(Equal("line1\nline2\nline3\n"))
+
+			status := logFilter.Status()
+			Expect(status.FullOutput.Paused).To(BeTrue())
+			Expect(status.FullOutput.SkippedLines).To(Equal(uint64(3)), "buffer size %d", bufferSize)
+
+			logFilter.Close()
+		}
+	})
+
+	It("should end the line cut off when the filesystem got full", func() {
+		if !FreeSpaceSupported {
+			Skip("free space is only supported on linux")
+		}
+
+		for _, bufferSize := range []int{0, 16} {
+			file := NewFullFile(25)
+			now := time.Now()
+
+			config := Output{
+				Name:      OutputFull,
+				Type:      OutputTypeFile,
+				Filename:  filepath.Join(tmpDir, "logfilter.log"),
+				MinFreeMB: 1,
+			}
+
+			w, flush, err := NewGuardedFullFile(file, config, bufferSize, func() time.Time { return now }, Logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			// the filesystem gets full in the middle of line-4
+			for i := 1; i <= 6; i++ {
+				_, err := w.Write([]byte(fmt.Sprintf("line-%d\n", i)))
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			file.SetLimit(1024)
+			now = now.Add(2 * time.Second)
+
+			_, err = w.Write([]byte("line-7\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(flush()).To(Succeed())
+
+			// the cut off line is ended and the lines after the resume are
+			// complete
+			Expect(file.String()).To(Equal("line-1\nline-2\nline-3\nline\nline-7\n"), "buffer size %d", bufferSize)
+		}
+	})
+
+	It("should fail for a total size less than the max size", func() {
+		config := &Config{}
+		config.DebugDisabled = true
+		config.FullOutputFilename = filepath.Join(tmpDir, "logfilter.log")
+		config.FullOutputMaxSizeMB = 100
+		config.FullOutputMaxTotalSizeMB = 50
+
+		logFilter := NewLogFilter(config, strings.NewReader(""), bytes.NewBuffer(nil), Logger)
+		Expect(logFilter.Init(TestCtx)).To(MatchError("output full: max total size must not be less than max size: 50 < 100"))
+		logFilter.Close()
+	})
+
+	Describe("Reopen", func() {
+		var logFilter *LogFilter
+		var stdin *io.PipeWriter
+		var done chan error
+		var filename string
+
+		BeforeEach(func() {
+			filename = filepath.Join(tmpDir, "logfilter.log")
+
+			config := &Config{}
+			config.MaxScanLineSize = 1024
+			config.FullOutputFilename = filename
+
+			var reader io.Reader
+			reader, stdin = io.Pipe()
+
+			logFilter = NewLogFilter(config, reader, ioutil.Discard, Logger)
+			Expect(logFilter.Init(TestCtx)).To(Succeed())
+
+			done = make(chan error, 1)
+			go func() {
+				done <- logFilter.Start()
+			}()
+		})
+
+		AfterEach(func() {
+			stdin.Close()
+			Eventually(done).Should(Receive())
+			logFilter.Close()
+		})
+
+		readFile := func(name string) func() string {
+			return func() string {
+				b, _ := ioutil.ReadFile(name)
+				return string(b)
+			}
+		}
+
+		It("should reopen the full output file moved by an external tool", func() {
+			_, err := stdin.Write([]byte("line1\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(readFile(filename)).Should(Equal("line1\n"))
+
+			Expect(os.Rename(filename, filename+".1")).To(Succeed())
+
+			resp, err := http.Post("http://"+logFilter.DebugAddr().String()+"/outputs/reopen", "", nil)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+			_, err = stdin.Write([]byte("line2\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(readFile(filename)).Should(Equal("line2\n"))
+
+			Expect(readFile(filename + ".1")()).To(Equal("line1\n"))
+		})
+
+		It("should rotate the full output file", func() {
+			_, err := stdin.Write([]byte("line1\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(readFile(filename)).Should(Equal("line1\n"))
+
+			Expect(logFilter.RotateOutputFiles()).To(Succeed())
+
+			_, err = stdin.Write([]byte("line2\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(readFile(filename)).Should(Equal("line2\n"))
+
+			backups, err := filepath.Glob(filepath.Join(tmpDir, "logfilter-*.log"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backups).To(HaveLen(1))
+			Expect(readFile(backups[0])()).To(Equal("line1\n"))
+		})
+
+		It("should allow only POST requests", func() {
+			resp, err := http.Get("http://" + logFilter.DebugAddr().String() + "/outputs/rotate")
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+})
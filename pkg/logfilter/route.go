@@ -0,0 +1,160 @@
+package logfilter
+
+import (
+	"golang.org/x/xerrors"
+)
+
+const (
+	RouteModeFirst = "first"
+	RouteModeAll   = "all"
+)
+
+// ValidateRouteMode checks if the route mode is known.
+func ValidateRouteMode(mode string) error {
+	switch mode {
+	case "", RouteModeFirst, RouteModeAll:
+		return nil
+	}
+	return xerrors.Errorf("invalid route mode: %s", mode)
+}
+
+// route writes the included lines matching the condition to the outputs.
+type route struct {
+	// matcher is nil if the route matches all lines
+	matcher *lineMatcher
+	outputs []*output
+}
+
+// router selects the outputs of the included lines. It is not safe for
+// concurrent use.
+type router struct {
+	routes []*route
+	all    bool
+	// selected is reused for the outputs of each line
+	selected []*output
+}
+
+func (f *LogFilter) initRouter() error {
+	if err := ValidateRouteMode(f.config.RouteMode); err != nil {
+		return err
+	}
+
+	if len(f.config.Routes) == 0 {
+		return nil
+	}
+
+	r := &router{
+		all: f.config.RouteMode == RouteModeAll,
+	}
+
+	for i, routeConfig := range f.config.Routes {
+		rt := &route{}
+
+		switch {
+		case routeConfig.MatchRegex != "":
+			// the regex filter excludes the matching lines
+			jsonFilter, err := NewRegexJSONFilter(routeConfig.MatchRegex)
+			if err != nil {
+				return xerrors.Errorf("failed to build route matcher: %d: %w", i, err)
+			}
+			rt.matcher = &lineMatcher{jsonFilter: jsonFilter, invert: true}
+		case routeConfig.MatchTemplate != "" || routeConfig.MatchQuery != "":
+			matcher, err := newLineMatcher(routeConfig.MatchTemplate, routeConfig.MatchQuery)
+			if err != nil {
+				return xerrors.Errorf("failed to build route matcher: %d: %w", i, err)
+			}
+			rt.matcher = matcher
+		}
+
+		for _, name := range routeConfig.Outputs {
+			if name == OutputFull {
+				return xerrors.Errorf("route cannot write to the full output, it has its own filter: %d", i)
+			}
+			o := f.output(name)
+			if o == nil {
+				return xerrors.Errorf("route output not found: %d: %s", i, name)
+			}
+			rt.outputs = append(rt.outputs, o)
+		}
+
+		r.routes = append(r.routes, rt)
+	}
+
+	f.router = r
+
+	return nil
+}
+
+// route returns the outputs of the line or nil if no route matches. The
+// returned slice is valid until the next call.
+func (r *router) route(l line) []*output {
+	r.selected = r.selected[:0]
+
+	for _, rt := range r.routes {
+		if rt.matcher != nil && !rt.matcher.Match(l.event) {
+			continue
+		}
+
+		if !r.all {
+			return rt.outputs
+		}
+
+		for _, o := range rt.outputs {
+			if !containsOutput(r.selected, o) {
+				r.selected = append(r.selected, o)
+			}
+		}
+	}
+
+	return r.selected
+}
+
+func containsOutput(outputs []*output, o *output) bool {
+	for _, x := range outputs {
+		if x == o {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a router with its own copies of the matchers for a filter
+// worker.
+func (r *router) clone() *router {
+	c := &router{
+		all: r.all,
+	}
+
+	for _, rt := range r.routes {
+		ct := &route{
+			outputs: rt.outputs,
+		}
+		if rt.matcher != nil {
+			ct.matcher = &lineMatcher{
+				jsonFilter: cloneJSONFilter(rt.matcher.jsonFilter),
+				invert:     rt.matcher.invert,
+			}
+		}
+		c.routes = append(c.routes, ct)
+	}
+
+	return c
+}
+
+// writeIncluded writes the included line to the outputs of its routes or to
+// the writer of its stream if no route matches.
+func (f *LogFilter) writeIncluded(l line, outputs []*output) error {
+	if len(outputs) > 0 {
+		for _, o := range outputs {
+			if err := writeLine(o.writer, l.b); err != nil {
+				return xerrors.Errorf("output %s write failed: %w", o.name, err)
+			}
+		}
+		return nil
+	}
+
+	if err := writeLine(l.stream.writer, l.b); err != nil {
+		return xerrors.Errorf("writer write failed: %w", err)
+	}
+	return nil
+}
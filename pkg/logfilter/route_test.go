@@ -0,0 +1,124 @@
+package logfilter_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Routes", func() {
+	input := strings.Join([]string{
+		`{"Level":"Debug","Message":"d1"}`,
+		`{"Level":"Information","Message":"i1"}`,
+		`{"Level":"Error","Message":"e1"}`,
+		`{"Level":"Information","Audit":true,"Message":"a1"}`,
+		`{"Level":"Error","Audit":true,"Message":"a2"}`,
+		`not json`,
+	}, "\n") + "\n"
+
+	DescribeTable("should write the included lines to the outputs of the matching routes",
+		func(routeMode string, expectedStdout []string, expectedErrors []string, expectedAudit []string) {
+			tmpDir, err := ioutil.TempDir("", "logfilter-test-")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			config := &Config{}
+			config.MaxScanLineSize = 1024
+			config.FilterQuery = `select(.Level != "Debug")`
+			config.Outputs = Outputs{
+				{Name: "errors", Type: OutputTypeFile, Filename: filepath.Join(tmpDir, "errors.log"), MaxSizeMB: 1},
+				{Name: "audit", Type: OutputTypeFile, Filename: filepath.Join(tmpDir, "audit.log"), MaxSizeMB: 1},
+			}
+			config.Routes = Routes{
+				{MatchQuery: `select(.Level == "Error")`, Outputs: []string{"errors"}},
+				{MatchTemplate: `{{if .Audit}}true{{end}}`, Outputs: []string{"audit"}},
+				{MatchRegex: `"Message":"i1"`, Outputs: []string{"audit", OutputStdout}},
+			}
+			config.RouteMode = routeMode
+
+			output := bytes.NewBuffer(nil)
+
+			logFilter := NewLogFilter(config, strings.NewReader(input), output, Logger)
+			Expect(logFilter.Init(TestCtx)).To(Succeed())
+			defer logFilter.Close()
+
+			Expect(logFilter.Start()).To(MatchError("reading stdin: EOF"))
+
+			Expect(output.String()).To(Equal(strings.Join(expectedStdout, "\n") + "\n"))
+
+			errors, err := ioutil.ReadFile(filepath.Join(tmpDir, "errors.log"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(errors)).To(Equal(strings.Join(expectedErrors, "\n") + "\n"))
+
+			audit, err := ioutil.ReadFile(filepath.Join(tmpDir, "audit.log"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(audit)).To(Equal(strings.Join(expectedAudit, "\n") + "\n"))
+		},
+		Entry("first matching route", RouteModeFirst,
+			[]string{
+				`{"Level":"Information","Message":"i1"}`,
+				`not json`,
+			},
+			[]string{
+				`{"Level":"Error","Message":"e1"}`,
+				`{"Level":"Error","Audit":true,"Message":"a2"}`,
+			},
+			[]string{
+				`{"Level":"Information","Message":"i1"}`,
+				`{"Level":"Information","Audit":true,"Message":"a1"}`,
+			},
+		),
+		Entry("all matching routes", RouteModeAll,
+			[]string{
+				`{"Level":"Information","Message":"i1"}`,
+				`not json`,
+			},
+			[]string{
+				`{"Level":"Error","Message":"e1"}`,
+				`{"Level":"Error","Audit":true,"Message":"a2"}`,
+			},
+			[]string{
+				`{"Level":"Information","Message":"i1"}`,
+				`{"Level":"Information","Audit":true,"Message":"a1"}`,
+				`{"Level":"Error","Audit":true,"Message":"a2"}`,
+			},
+		),
+	)
+
+	It("should fail for an unknown route output", func() {
+		config := &Config{}
+		config.Routes = Routes{
+			{Outputs: []string{"missing"}},
+		}
+
+		logFilter := NewLogFilter(config, strings.NewReader(""), bytes.NewBuffer(nil), Logger)
+		defer logFilter.Close()
+
+		Expect(logFilter.Init(TestCtx)).To(MatchError("route output not found: 0: missing"))
+	})
+
+	It("should fail to decode invalid outputs and routes", func() {
+		var outputs Outputs
+		Expect(outputs.Decode(`[{"name": "errors", "type": "file", "filename": "errors.log"}]`)).To(Succeed())
+		Expect(outputs[0].MaxSizeMB).To(Equal(100))
+		Expect(outputs.Decode(`[{"type": "stderr"}]`)).To(MatchError("output name must not be empty"))
+		Expect(outputs.Decode(`[{"name": "full", "type": "stderr"}]`)).To(MatchError("output name is reserved: full"))
+		Expect(outputs.Decode(`[{"name": "a", "type": "stderr"}, {"name": "a", "type": "stderr"}]`)).To(MatchError("duplicate output name: a"))
+		Expect(outputs.Decode(`[{"name": "a", "type": "file"}]`)).To(MatchError("output filename must not be empty: a"))
+		Expect(outputs.Decode(`[{"name": "a", "type": "file", "filename": "a.log", "maxSizeMB": 10, "maxTotalSizeMB": 5}]`)).To(MatchError("output a: max total size must not be less than max size: 5 < 10"))
+		Expect(outputs.Decode(`[{"name": "a", "type": "socket"}]`)).To(MatchError("invalid output type: a: socket"))
+
+		var routes Routes
+		Expect(routes.Decode(`[{"matchQuery": ".", "outputs": ["stdout"]}]`)).To(Succeed())
+		Expect(routes.Decode(`[{"matchQuery": "."}]`)).To(MatchError("route outputs must not be empty: 0"))
+		Expect(routes.Decode(`[{"matchQuery": ".", "matchRegex": "x", "outputs": ["stdout"]}]`)).To(MatchError("route must have at most one of matchTemplate, matchQuery or matchRegex: 0"))
+	})
+})
@@ -0,0 +1,20 @@
+package logfilter
+
+import (
+	"os"
+	"syscall"
+)
+
+// defaultOutputReopenSignal is nil because Windows has no SIGUSR1.
+var defaultOutputReopenSignal os.Signal
+
+var signalsByName = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"ABRT": syscall.SIGABRT,
+	"KILL": syscall.SIGKILL,
+	"PIPE": syscall.SIGPIPE,
+	"ALRM": syscall.SIGALRM,
+	"TERM": syscall.SIGTERM,
+}
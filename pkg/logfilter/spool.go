@@ -0,0 +1,297 @@
+package logfilter
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// spoolChunkSize is the maximum size of a single read from the spool file.
+	spoolChunkSize = 64 * 1024
+
+	// spoolMarkInterval is the minimum interval between the marks used to
+	// compute the spool lag.
+	spoolMarkInterval = 100 * time.Millisecond
+)
+
+// spoolMark records the time the data at the offset was spooled.
+type spoolMark struct {
+	off  int64
+	time time.Time
+}
+
+// spool is a writer in front of a slow writer. The data is passed to the
+// writer directly while the writer keeps up. Otherwise the data is appended to
+// a size-capped spool file and replayed in order once the writer drains. The
+// file is used as a ring buffer so the space of the replayed data is reused
+// while the rest is replayed. The file is truncated every time it is fully
+// replayed. Write blocks when the data waiting to be replayed would exceed
+// maxBytes.
+type spool struct {
+	w    io.Writer
+	file *os.File
+
+	maxBytes int64
+
+	direct chan []byte
+	notify chan struct{}
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// readOff and writeOff are the offsets in the spooled data, the position
+	// in the file is the offset modulo size
+	readOff  int64
+	writeOff int64
+	// size is the size of the ring, it is bigger than maxBytes only for a
+	// single write bigger than maxBytes
+	size    int64
+	spooled int64
+	marks   []spoolMark
+	closed  bool
+	err     error
+}
+
+func newSpool(dir string, maxBytes int64, w io.Writer) (*spool, error) {
+	file, err := ioutil.TempFile(dir, "logfilter-spool-")
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create spool file: %w", err)
+	}
+
+	s := &spool{
+		w:        w,
+		file:     file,
+		maxBytes: maxBytes,
+		size:     maxBytes,
+		direct:   make(chan []byte),
+		notify:   make(chan struct{}, 1),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s, nil
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	b := make([]byte, len(p))
+	copy(b, p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.err != nil {
+			return 0, s.err
+		}
+
+		if s.writeOff == 0 {
+			select {
+			case s.direct <- b:
+				return len(p), nil
+			default:
+			}
+		}
+
+		if s.writeOff == 0 || s.writeOff-s.readOff+int64(len(b)) <= s.maxBytes {
+			break
+		}
+
+		// wait until enough spooled data is replayed
+		s.cond.Wait()
+	}
+
+	if s.writeOff == 0 && int64(len(b)) > s.maxBytes {
+		// the ring grows to fit the write until the spool is fully replayed
+		s.size = int64(len(b))
+	}
+
+	if err := ringIO(s.file.WriteAt, b, s.writeOff, s.size); err != nil {
+		return 0, xerrors.Errorf("spool write failed: %w", err)
+	}
+
+	now := time.Now()
+	if len(s.marks) == 0 || now.Sub(s.marks[len(s.marks)-1].time) >= spoolMarkInterval {
+		s.marks = append(s.marks, spoolMark{off: s.writeOff, time: now})
+	}
+
+	s.writeOff += int64(len(b))
+	s.spooled += int64(len(b))
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return len(p), nil
+}
+
+// drain writes the data to the writer until the spool is closed and empty.
+func (s *spool) drain() error {
+	buf := make([]byte, spoolChunkSize)
+
+	for {
+		s.mu.Lock()
+
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return err
+		}
+
+		if s.readOff < s.writeOff {
+			n := s.writeOff - s.readOff
+			if n > int64(len(buf)) {
+				n = int64(len(buf))
+			}
+			readOff := s.readOff
+			size := s.size
+			s.mu.Unlock()
+
+			// the spooled data is not modified until it is replayed
+			if err := ringIO(s.file.ReadAt, buf[:n], readOff, size); err != nil {
+				return s.fail(xerrors.Errorf("spool read failed: %w", err))
+			}
+			if _, err := s.w.Write(buf[:n]); err != nil {
+				return s.fail(xerrors.Errorf("writer write failed: %w", err))
+			}
+
+			s.mu.Lock()
+			s.readOff += n
+			for len(s.marks) > 1 && s.marks[1].off <= s.readOff {
+				s.marks = s.marks[1:]
+			}
+			s.cond.Broadcast()
+			s.mu.Unlock()
+
+			continue
+		}
+
+		if s.writeOff > 0 {
+			if err := s.file.Truncate(0); err != nil {
+				s.mu.Unlock()
+				return s.fail(xerrors.Errorf("spool truncate failed: %w", err))
+			}
+			s.readOff = 0
+			s.writeOff = 0
+			s.size = s.maxBytes
+			s.marks = nil
+			s.cond.Broadcast()
+		}
+
+		if s.closed {
+			s.mu.Unlock()
+			return nil
+		}
+
+		s.mu.Unlock()
+
+		select {
+		case b := <-s.direct:
+			if _, err := s.w.Write(b); err != nil {
+				return s.fail(xerrors.Errorf("writer write failed: %w", err))
+			}
+		case <-s.notify:
+		}
+	}
+}
+
+// ringIO reads or writes b at the offset in the ring of the size. The part
+// after the end of the ring wraps to the start of the file.
+func ringIO(fn func(b []byte, off int64) (int, error), b []byte, off int64, size int64) error {
+	pos := off % size
+	n := int64(len(b))
+	if pos+n > size {
+		n = size - pos
+	}
+
+	if _, err := fn(b[:n], pos); err != nil {
+		return err
+	}
+	if n < int64(len(b)) {
+		if _, err := fn(b[n:], 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *spool) fail(err error) error {
+	s.mu.Lock()
+	s.err = err
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return err
+}
+
+// close stops drain after the spooled data is replayed.
+func (s *spool) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// abort stops drain without replaying the rest of the spooled data and fails
+// the writes.
+func (s *spool) abort() {
+	s.fail(errWritesAborted)
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// remove removes the spool file.
+func (s *spool) remove() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// SpoolStatus is the state of the disk spool.
+type SpoolStatus struct {
+	Filename string `json:"filename"`
+	// Bytes is the size of the data waiting to be written.
+	Bytes int64 `json:"bytes"`
+	// FileBytes is the size of the spool file.
+	FileBytes int64 `json:"fileBytes"`
+	// MaxBytes is the maximum size of the data waiting to be written and of the
+	// spool file.
+	MaxBytes int64 `json:"maxBytes"`
+	// SpooledBytes is the total size of the data that was spooled.
+	SpooledBytes int64 `json:"spooledBytes"`
+	// LagSeconds is the age of the oldest data waiting to be written.
+	LagSeconds float64 `json:"lagSeconds"`
+}
+
+func (s *spool) status() SpoolStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fileBytes := s.writeOff
+	if fileBytes > s.size {
+		fileBytes = s.size
+	}
+
+	status := SpoolStatus{
+		Filename:     s.file.Name(),
+		Bytes:        s.writeOff - s.readOff,
+		FileBytes:    fileBytes,
+		MaxBytes:     s.maxBytes,
+		SpooledBytes: s.spooled,
+	}
+
+	if status.Bytes > 0 && len(s.marks) > 0 {
+		status.LagSeconds = time.Since(s.marks[0].time).Seconds()
+	}
+
+	return status
+}
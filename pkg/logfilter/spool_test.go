@@ -0,0 +1,206 @@
+package logfilter_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Spool", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logfilter-test-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should spool the lines while stdout is blocked and replay them in order", func() {
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.SpoolDir = tmpDir
+		config.SpoolMaxBytes = 1024 * 1024
+
+		inputReader, inputWriter := io.Pipe()
+
+		writeStarted := make(chan struct{})
+		writeRelease := make(chan struct{})
+		var writeOnce sync.Once
+
+		output := &syncBuffer{}
+		writer := funcWriter(func(b []byte) (int, error) {
+			writeOnce.Do(func() {
+				close(writeStarted)
+				<-writeRelease
+			})
+			return output.Write(b)
+		})
+
+		logFilter := NewLogFilter(config, inputReader, writer, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		expected := []string{}
+		for i := 0; i < 100; i++ {
+			l := fmt.Sprintf("line%d", i)
+			expected = append(expected, l)
+
+			_, err := inputWriter.Write([]byte(l + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+
+			if i == 0 {
+				Eventually(writeStarted).Should(BeClosed())
+			}
+		}
+
+		Eventually(func() int64 {
+			return logFilter.Status().Spool.SpooledBytes
+		}).Should(BeNumerically(">", 0))
+
+		status := logFilter.Status()
+		Expect(status.Spool.Bytes).To(BeNumerically(">", 0))
+		Expect(status.Spool.FileBytes).To(BeNumerically(">", 0))
+		Expect(status.Spool.LagSeconds).To(BeNumerically(">", 0))
+
+		files, err := ioutil.ReadDir(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+
+		inputWriter.Close()
+		close(writeRelease)
+
+		Eventually(done).Should(Receive(MatchError("reading stdin: EOF")))
+
+		Expect(output.String()).To(Equal(strings.Join(expected, "\n") + "\n"))
+
+		status = logFilter.Status()
+		Expect(status.Spool.Bytes).To(BeEquivalentTo(0))
+		Expect(status.Spool.FileBytes).To(BeEquivalentTo(0))
+
+		logFilter.Close()
+
+		files, err = ioutil.ReadDir(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+
+	It("should reuse the space of the replayed lines while the rest is replayed", func() {
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.SpoolDir = tmpDir
+		config.SpoolMaxBytes = 100 * 1024
+
+		inputReader, inputWriter := io.Pipe()
+
+		// each write takes a token, closing the channel unblocks all writes
+		tokens := make(chan struct{}, 2)
+
+		writeStarted := make(chan struct{})
+		var writeOnce sync.Once
+
+		output := &syncBuffer{}
+		writer := funcWriter(func(b []byte) (int, error) {
+			writeOnce.Do(func() {
+				close(writeStarted)
+			})
+			<-tokens
+			return output.Write(b)
+		})
+
+		logFilter := NewLogFilter(config, inputReader, writer, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		lines := 1100
+		expected := []string{}
+		for i := 0; i < lines; i++ {
+			// 100 bytes with the newline
+			expected = append(expected, fmt.Sprintf("%099d", i))
+		}
+
+		go func() {
+			defer GinkgoRecover()
+
+			for _, l := range expected {
+				_, err := inputWriter.Write([]byte(l + "\n"))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			inputWriter.Close()
+		}()
+
+		Eventually(writeStarted).Should(BeClosed())
+
+		// the spool is full
+		Eventually(func() int64 {
+			return logFilter.Status().Spool.Bytes
+		}).Should(BeNumerically(">", 99*1024))
+
+		// the first line written directly and the first chunk of the spool are
+		// written, the next chunk blocks
+		tokens <- struct{}{}
+		tokens <- struct{}{}
+
+		// all the other lines are spooled while the rest is replayed
+		Eventually(func() int64 {
+			return logFilter.Status().Spool.SpooledBytes
+		}).Should(BeEquivalentTo((lines - 1) * 100))
+		Expect(logFilter.Status().Spool.FileBytes).To(BeNumerically("<=", config.SpoolMaxBytes))
+
+		close(tokens)
+
+		Eventually(done).Should(Receive(MatchError("reading stdin: EOF")))
+
+		Expect(output.String()).To(Equal(strings.Join(expected, "\n") + "\n"))
+	})
+
+	It("should not spool the lines while stdout keeps up", func() {
+		config := &Config{}
+		config.MaxScanLineSize = 1024
+		config.SpoolDir = tmpDir
+		config.SpoolMaxBytes = 1024 * 1024
+
+		output := &syncBuffer{}
+
+		logFilter := NewLogFilter(config, strings.NewReader("line1\nline2\n"), output, Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("reading stdin: EOF"))
+
+		Expect(output.String()).To(Equal("line1\nline2\n"))
+	})
+
+	It("should fail if the spool dir does not exist", func() {
+		config := &Config{}
+		config.SpoolDir = tmpDir + "/missing"
+		config.SpoolMaxBytes = 1024
+
+		logFilter := NewLogFilter(config, strings.NewReader(""), &syncBuffer{}, Logger)
+		defer logFilter.Close()
+
+		err := logFilter.Init(TestCtx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("failed to create spool file"))
+	})
+})
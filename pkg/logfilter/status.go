@@ -0,0 +1,267 @@
+package logfilter
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const redacted = "<redacted>"
+
+// secretNameRegexp matches the names of the command arguments that probably
+// contain secrets.
+var secretNameRegexp = regexp.MustCompile(`(?i)pass|secret|token|key|auth|credential|cookie|session`)
+
+// Status is a runtime snapshot of the logfilter returned by the /status
+// endpoint.
+type Status struct {
+	StartedAt     time.Time        `json:"startedAt"`
+	UptimeSeconds float64          `json:"uptimeSeconds"`
+	Procs         []ProcStatus     `json:"procs"`
+	Streams       []StreamStatus   `json:"streams"`
+	Buffer        BufferStatus     `json:"buffer"`
+	Spool         *SpoolStatus     `json:"spool,omitempty"`
+	Filter        FilterStatus     `json:"filter"`
+	FullOutput    FullOutputStatus `json:"fullOutput"`
+	Health        []HealthProblem  `json:"health"`
+}
+
+// ProcStatus is the state of a command.
+type ProcStatus struct {
+	Name          string    `json:"name,omitempty"`
+	Cmd           []string  `json:"cmd"`
+	Env           []string  `json:"env,omitempty"`
+	Running       bool      `json:"running"`
+	PID           int       `json:"pid,omitempty"`
+	StartedAt     time.Time `json:"startedAt"`
+	UptimeSeconds float64   `json:"uptimeSeconds"`
+	Restarts      int       `json:"restarts"`
+	Exited        bool      `json:"exited"`
+	ExitCode      *int      `json:"exitCode,omitempty"`
+	ExitError     string    `json:"exitError,omitempty"`
+}
+
+// StreamStatus contains the counters of a stream.
+type StreamStatus struct {
+	Name string `json:"name"`
+	// Lines is the number of scanned lines.
+	Lines uint64 `json:"lines"`
+	// Bytes is the number of scanned bytes without the newlines.
+	Bytes uint64 `json:"bytes"`
+	// Included is the number of lines written to the output.
+	Included uint64 `json:"included"`
+	// Excluded is the number of lines excluded by the filter.
+	Excluded uint64 `json:"excluded"`
+	// Dropped is the number of lines dropped because the buffer was full.
+	Dropped uint64 `json:"dropped"`
+	// Oversized is the number of lines longer than MaxScanLineSize.
+	Oversized uint64 `json:"oversized"`
+	// LastLineAgeSeconds is the time since the last line or nil if the stream
+	// has no lines yet.
+	LastLineAgeSeconds *float64 `json:"lastLineAgeSeconds"`
+}
+
+// FilterStatus is the active filter configuration.
+type FilterStatus struct {
+	ExcludeTemplate   string                `json:"excludeTemplate,omitempty"`
+	FilterQuery       string                `json:"filterQuery,omitempty"`
+	FDExcludeTemplate string                `json:"fdExcludeTemplate,omitempty"`
+	FDFilterQuery     string                `json:"fdFilterQuery,omitempty"`
+	Procs             []ProcFilterStatus    `json:"procs,omitempty"`
+	ReadyTemplate     string                `json:"readyTemplate,omitempty"`
+	ReadyQuery        string                `json:"readyQuery,omitempty"`
+	Triggers          []TriggerFilterStatus `json:"triggers,omitempty"`
+}
+
+// ProcFilterStatus is the filter of a proc.
+type ProcFilterStatus struct {
+	Name            string `json:"name"`
+	ExcludeTemplate string `json:"excludeTemplate,omitempty"`
+	FilterQuery     string `json:"filterQuery,omitempty"`
+}
+
+// TriggerFilterStatus is the condition and the action of a trigger.
+type TriggerFilterStatus struct {
+	Name          string `json:"name"`
+	MatchTemplate string `json:"matchTemplate,omitempty"`
+	MatchQuery    string `json:"matchQuery,omitempty"`
+	Threshold     int    `json:"threshold"`
+	Action        string `json:"action"`
+}
+
+// FullOutputStatus is the state of the full output file.
+type FullOutputStatus struct {
+	Filename  string `json:"filename,omitempty"`
+	SizeBytes int64  `json:"sizeBytes"`
+	// Paused is true while the lines are skipped because of FullOutputMinFreeMB.
+	Paused bool `json:"paused"`
+	// SkippedLines is the number of lines skipped because of
+	// FullOutputMinFreeMB.
+	SkippedLines uint64 `json:"skippedLines"`
+}
+
+// Status returns a runtime snapshot of the logfilter.
+func (f *LogFilter) Status() Status {
+	now := time.Now()
+
+	status := Status{
+		StartedAt: f.startedAt,
+		Procs:     []ProcStatus{},
+		Streams:   []StreamStatus{},
+		Filter: FilterStatus{
+			ExcludeTemplate: f.config.ExcludeTemplate,
+			FilterQuery:     f.config.FilterQuery,
+			ReadyTemplate:   f.config.ReadyTemplate,
+			ReadyQuery:      f.config.ReadyQuery,
+		},
+		FullOutput: FullOutputStatus{
+			Filename: f.config.FullOutputFilename,
+		},
+		Health: f.LivenessProblems(),
+	}
+
+	if !f.startedAt.IsZero() {
+		status.UptimeSeconds = now.Sub(f.startedAt).Seconds()
+	}
+
+	if f.buffer != nil {
+		status.Buffer = f.buffer.status()
+	}
+
+	if f.spool != nil {
+		spoolStatus := f.spool.status()
+		status.Spool = &spoolStatus
+	}
+
+	if f.config.FD > 0 {
+		status.Filter.FDExcludeTemplate = f.config.FDExcludeTemplate
+		status.Filter.FDFilterQuery = f.config.FDFilterQuery
+	}
+
+	for _, p := range f.procs {
+		state := p.commander.State()
+
+		procStatus := ProcStatus{
+			Name:      p.name,
+			Cmd:       redactArgs(p.config.Cmd),
+			Env:       redactEnv(append(append([]string{}, f.config.CmdEnv...), p.config.Env...)),
+			Running:   state.Running,
+			PID:       state.PID,
+			StartedAt: state.StartedAt,
+			Restarts:  state.Restarts,
+			Exited:    state.Exited,
+			ExitError: state.ExitError,
+		}
+		if state.Running {
+			procStatus.UptimeSeconds = now.Sub(state.StartedAt).Seconds()
+		}
+		if state.Exited {
+			exitCode := state.ExitCode
+			procStatus.ExitCode = &exitCode
+		}
+
+		status.Procs = append(status.Procs, procStatus)
+
+		if p.config.ExcludeTemplate != "" || p.config.FilterQuery != "" {
+			status.Filter.Procs = append(status.Filter.Procs, ProcFilterStatus{
+				Name:            p.name,
+				ExcludeTemplate: p.config.ExcludeTemplate,
+				FilterQuery:     p.config.FilterQuery,
+			})
+		}
+	}
+
+	for _, s := range f.streams {
+		streamStatus := StreamStatus{
+			Name:      s.name,
+			Lines:     atomic.LoadUint64(&s.lines),
+			Bytes:     atomic.LoadUint64(&s.bytes),
+			Included:  atomic.LoadUint64(&s.included),
+			Excluded:  atomic.LoadUint64(&s.excluded),
+			Dropped:   atomic.LoadUint64(&s.dropped),
+			Oversized: atomic.LoadUint64(&s.oversized),
+		}
+		if last := s.lastLineTime(); !last.IsZero() {
+			age := now.Sub(last).Seconds()
+			streamStatus.LastLineAgeSeconds = &age
+		}
+
+		status.Streams = append(status.Streams, streamStatus)
+	}
+
+	for _, t := range f.triggers {
+		status.Filter.Triggers = append(status.Filter.Triggers, TriggerFilterStatus{
+			Name:          t.config.Name,
+			MatchTemplate: t.config.MatchTemplate,
+			MatchQuery:    t.config.MatchQuery,
+			Threshold:     t.config.Threshold,
+			Action:        t.config.Action,
+		})
+	}
+
+	if full := f.output(OutputFull); full != nil {
+		// the current file has the period in the name with a rotate interval
+		status.FullOutput.Filename = full.file.currentFilename()
+		if info, err := os.Stat(status.FullOutput.Filename); err == nil {
+			status.FullOutput.SizeBytes = info.Size()
+		}
+		if full.guard != nil {
+			status.FullOutput.Paused = full.guard.isPaused()
+			status.FullOutput.SkippedLines = full.guard.skipped()
+		}
+	}
+
+	return status
+}
+
+func statusHandler(statusFn func() Status) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(statusFn())
+	})
+}
+
+// redactArgs redacts the values of the arguments whose names look like they
+// contain secrets (e.g. --password=value or --token value).
+func redactArgs(args []string) []string {
+	redactedArgs := make([]string, len(args))
+	redactNext := false
+
+	for i, arg := range args {
+		switch {
+		case redactNext:
+			redactedArgs[i] = redacted
+			redactNext = false
+		case strings.HasPrefix(arg, "-") && strings.Contains(arg, "=") && secretNameRegexp.MatchString(arg[:strings.IndexByte(arg, '=')]):
+			redactedArgs[i] = arg[:strings.IndexByte(arg, '=')+1] + redacted
+		case strings.HasPrefix(arg, "-") && secretNameRegexp.MatchString(arg):
+			redactedArgs[i] = arg
+			redactNext = true
+		default:
+			redactedArgs[i] = arg
+		}
+	}
+
+	return redactedArgs
+}
+
+// redactEnv redacts the values of all environment variables.
+func redactEnv(env []string) []string {
+	redactedEnv := make([]string, len(env))
+
+	for i, kv := range env {
+		key := kv
+		if j := strings.IndexByte(kv, '='); j >= 0 {
+			key = kv[:j]
+		}
+		redactedEnv[i] = key + "=" + redacted
+	}
+
+	return redactedEnv
+}
@@ -0,0 +1,101 @@
+package logfilter_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Status", func() {
+	It("should report the runtime snapshot", func() {
+		tmpDir, err := ioutil.TempDir("", "logfilter-test-")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+
+		script := `
+			echo '{"Level":"Debug"}'
+			echo '{"Level":"Information"}'
+			echo 'error' >&2
+			exec sleep 5
+		`
+
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", script, "--api-token", "secret1", "--password=secret2"}
+		config.CmdEnv = []string{"DB_PASSWORD=secret3"}
+		config.CmdShutdownTimeout = 100 * time.Millisecond
+		config.ExcludeTemplate = `{{eq .Level "Debug"}}`
+		config.FullOutputFilename = filepath.Join(tmpDir, "logfilter.log")
+
+		logFilter := NewLogFilter(config, nil, &syncBuffer{}, Logger)
+
+		ctx, cancel := context.WithCancel(TestCtx)
+		defer cancel()
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+		defer logFilter.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		getStatus := func() Status {
+			resp, err := http.Get("http://" + logFilter.DebugAddr().String() + "/status")
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			status := Status{}
+			Expect(json.NewDecoder(resp.Body).Decode(&status)).To(Succeed())
+			return status
+		}
+
+		Eventually(func() uint64 {
+			status := getStatus()
+			lines := uint64(0)
+			for _, s := range status.Streams {
+				lines += s.Lines
+			}
+			return lines
+		}).Should(BeEquivalentTo(3))
+
+		status := getStatus()
+
+		Expect(status.UptimeSeconds).To(BeNumerically(">", 0))
+
+		Expect(status.Procs).To(HaveLen(1))
+		Expect(status.Procs[0].Cmd).To(Equal([]string{"bash", "-c", script, "--api-token", "<redacted>", "--password=<redacted>"}))
+		Expect(status.Procs[0].Env).To(Equal([]string{"DB_PASSWORD=<redacted>"}))
+		Expect(status.Procs[0].Running).To(BeTrue())
+		Expect(status.Procs[0].PID).To(BeNumerically(">", 0))
+		Expect(status.Procs[0].Restarts).To(Equal(0))
+		Expect(status.Procs[0].ExitCode).To(BeNil())
+
+		Expect(status.Streams).To(HaveLen(2))
+		Expect(status.Streams[0].Name).To(Equal("stdout"))
+		Expect(status.Streams[0].Lines).To(BeEquivalentTo(2))
+		Expect(status.Streams[0].Included).To(BeEquivalentTo(1))
+		Expect(status.Streams[0].Excluded).To(BeEquivalentTo(1))
+		Expect(status.Streams[0].LastLineAgeSeconds).NotTo(BeNil())
+		Expect(status.Streams[1].Name).To(Equal("stderr"))
+		Expect(status.Streams[1].Bytes).To(BeEquivalentTo(5))
+
+		Expect(status.Filter.ExcludeTemplate).To(Equal(config.ExcludeTemplate))
+
+		Expect(status.FullOutput.Filename).To(Equal(config.FullOutputFilename))
+		Expect(status.FullOutput.SizeBytes).To(BeNumerically(">", 0))
+
+		Expect(status.Health).To(BeEmpty())
+
+		cancel()
+		Eventually(done).Should(Receive())
+	})
+})
@@ -0,0 +1,29 @@
+package logfilter
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+// syncOutput flushes the filesystem of the output file to the disk. The file
+// is closed by lumberjack so the filesystem is synced through the directory
+// of the file instead of opening the file again by name.
+func syncOutput(filename string) error {
+	dir, err := os.Open(filepath.Dir(filename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to open output dir: %w", err)
+	}
+	defer dir.Close()
+
+	if err := unix.Syncfs(int(dir.Fd())); err != nil {
+		return xerrors.Errorf("failed to sync output file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package logfilter
+
+import (
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+// syncOutput flushes the output file to the disk.
+func syncOutput(filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to open output file: %w", err)
+	}
+	defer file.Close()
+
+	if err := file.Sync(); err != nil {
+		return xerrors.Errorf("failed to sync output file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package logfilter
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// TailLine is a line sent to the /tail subscribers.
+type TailLine struct {
+	Time     time.Time `json:"time"`
+	Stream   string    `json:"stream"`
+	Included bool      `json:"included"`
+	Line     string    `json:"line"`
+}
+
+// TailDropped is sent to a /tail subscriber after its lines were dropped
+// because it was too slow.
+type TailDropped struct {
+	Dropped uint64 `json:"dropped"`
+}
+
+type tailLine struct {
+	time     time.Time
+	stream   *stream
+	included bool
+	b        []byte
+}
+
+// tailSubscriber is a /tail client. The lines are dropped if its buffer is
+// full.
+type tailSubscriber struct {
+	// dropped is accessed atomically and must be 64-bit aligned
+	dropped uint64
+
+	streams map[string]bool
+	lines   chan tailLine
+}
+
+func (s *tailSubscriber) wants(st *stream) bool {
+	return len(s.streams) == 0 || s.streams[st.name] || s.streams[st.kind]
+}
+
+// tailHub distributes the lines to the /tail subscribers without blocking the
+// publisher.
+type tailHub struct {
+	// count is accessed atomically
+	count int32
+
+	mu          sync.RWMutex
+	subscribers map[*tailSubscriber]struct{}
+	bufferSize  int
+}
+
+func newTailHub(bufferSize int) *tailHub {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	return &tailHub{
+		subscribers: map[*tailSubscriber]struct{}{},
+		bufferSize:  bufferSize,
+	}
+}
+
+func (h *tailHub) subscribe(streams []string) *tailSubscriber {
+	s := &tailSubscriber{
+		streams: map[string]bool{},
+		lines:   make(chan tailLine, h.bufferSize),
+	}
+	for _, name := range streams {
+		s.streams[name] = true
+	}
+
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	atomic.StoreInt32(&h.count, int32(len(h.subscribers)))
+	h.mu.Unlock()
+
+	return s
+}
+
+func (h *tailHub) unsubscribe(s *tailSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, s)
+	atomic.StoreInt32(&h.count, int32(len(h.subscribers)))
+	h.mu.Unlock()
+}
+
+// publish sends the line to the subscribers. It never blocks. It returns true
+// if the line was sent to at least one subscriber.
+func (h *tailHub) publish(l line, included bool) bool {
+	if atomic.LoadInt32(&h.count) == 0 {
+		return false
+	}
+
+	tl := tailLine{
+		time:     time.Now(),
+		stream:   l.stream,
+		included: included,
+		b:        l.b,
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	sent := false
+
+	for s := range h.subscribers {
+		if !s.wants(l.stream) {
+			continue
+		}
+		select {
+		case s.lines <- tl:
+			sent = true
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+
+	return sent
+}
+
+// tailHandler streams the lines as NDJSON or as Server-Sent Events (if the
+// client accepts text/event-stream or format=sse). The query parameters are:
+// query (JQ query the lines must match), stream (comma separated stream names
+// or kinds) and included (true or false to only get the included or excluded
+// lines).
+func (f *LogFilter) tailHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		params := r.URL.Query()
+
+		var matcher *lineMatcher
+		if query := params.Get("query"); query != "" {
+			var err error
+			matcher, err = newLineMatcher("", query)
+			if err != nil {
+				http.Error(w, xerrors.Errorf("invalid query: %w", err).Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var streams []string
+		if stream := params.Get("stream"); stream != "" {
+			streams = strings.Split(stream, ",")
+		}
+
+		var included *bool
+		if includedStr := params.Get("included"); includedStr != "" {
+			v, err := strconv.ParseBool(includedStr)
+			if err != nil {
+				http.Error(w, "invalid included: "+includedStr, http.StatusBadRequest)
+				return
+			}
+			included = &v
+		}
+
+		sse := params.Get("format") == "sse" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+		if sse {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		write := func(event string, v interface{}) error {
+			b, _ := json.Marshal(v)
+			if sse {
+				b = append(append([]byte("event: "+event+"\ndata: "), b...), '\n', '\n')
+			} else {
+				b = append(b, '\n')
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+
+		subscriber := f.tail.subscribe(streams)
+		defer f.tail.unsubscribe(subscriber)
+
+		for {
+			select {
+			case tl := <-subscriber.lines:
+				if dropped := atomic.SwapUint64(&subscriber.dropped, 0); dropped > 0 {
+					if err := write("dropped", TailDropped{Dropped: dropped}); err != nil {
+						return
+					}
+				}
+
+				if included != nil && tl.included != *included {
+					continue
+				}
+				// the event of the line is still used by the writer
+				if matcher != nil && !matcher.Match(newEvent(tl.b)) {
+					continue
+				}
+
+				err := write("line", TailLine{
+					Time:     tl.time,
+					Stream:   tl.stream.name,
+					Included: tl.included,
+					Line:     string(tl.b),
+				})
+				if err != nil {
+					return
+				}
+
+			case <-r.Context().Done():
+				return
+			case <-f.ctx.Done():
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package logfilter_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Tail", func() {
+	var logFilter *LogFilter
+	var stop func()
+
+	BeforeEach(func() {
+		script := `
+			while true; do
+				echo '{"Level":"Debug","Message":"debug"}'
+				echo '{"Level":"Information","Message":"info"}'
+				echo 'error' >&2
+				sleep 0.02
+			done
+		`
+
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", script}
+		config.CmdShutdownTimeout = 100 * time.Millisecond
+		config.ExcludeTemplate = `{{eq .Level "Debug"}}`
+		config.TailBufferSize = 100
+
+		logFilter = NewLogFilter(config, nil, ioutil.Discard, Logger)
+
+		ctx, cancel := context.WithCancel(TestCtx)
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		stop = func() {
+			cancel()
+			Eventually(done).Should(Receive())
+			logFilter.Close()
+		}
+	})
+
+	AfterEach(func() {
+		stop()
+	})
+
+	tail := func(params url.Values, header http.Header) *http.Response {
+		req, err := http.NewRequest("GET", "http://"+logFilter.DebugAddr().String()+"/tail?"+params.Encode(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	It("should stream the lines matching the query and the stream as NDJSON", func() {
+		resp := tail(url.Values{
+			"query":    {`select(.Level == "Debug")`},
+			"stream":   {"stdout"},
+			"included": {"false"},
+		}, nil)
+		defer resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/x-ndjson"))
+
+		reader := bufio.NewReader(resp.Body)
+
+		for i := 0; i < 3; i++ {
+			b, err := reader.ReadBytes('\n')
+			Expect(err).NotTo(HaveOccurred())
+
+			tailLine := TailLine{}
+			Expect(json.Unmarshal(b, &tailLine)).To(Succeed())
+			Expect(tailLine.Stream).To(Equal("stdout"))
+			Expect(tailLine.Included).To(BeFalse())
+			Expect(tailLine.Line).To(Equal(`{"Level":"Debug","Message":"debug"}`))
+			Expect(tailLine.Time).NotTo(BeZero())
+		}
+	})
+
+	It("should stream the lines as Server-Sent Events", func() {
+		resp := tail(url.Values{
+			"stream": {"stderr"},
+		}, http.Header{
+			"Accept": {"text/event-stream"},
+		})
+		defer resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+		reader := bufio.NewReader(resp.Body)
+
+		event, err := reader.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(event).To(Equal("event: line\n"))
+
+		data, err := reader.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(HavePrefix("data: "))
+
+		tailLine := TailLine{}
+		Expect(json.Unmarshal([]byte(data[len("data: "):]), &tailLine)).To(Succeed())
+		Expect(tailLine.Stream).To(Equal("stderr"))
+		Expect(tailLine.Included).To(BeTrue())
+		Expect(tailLine.Line).To(Equal("error"))
+
+		empty, err := reader.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(empty).To(Equal("\n"))
+	})
+
+	It("should reject an invalid query", func() {
+		resp := tail(url.Values{
+			"query": {"select("},
+		}, nil)
+		defer resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+})
@@ -2,7 +2,6 @@ package logfilter
 
 import (
 	"bytes"
-	"encoding/json"
 	"text/template"
 
 	"golang.org/x/xerrors"
@@ -11,6 +10,10 @@ import (
 type TemplateJSONFilter struct {
 	ExcludeTpl *template.Template
 	Buf        bytes.Buffer
+
+	// fields are the top-level fields used by the template or nil if the
+	// template needs the whole document
+	fields map[string]struct{}
 }
 
 func NewTemplateJSONFilter(excludeTemplate string) (*TemplateJSONFilter, error) {
@@ -21,23 +24,39 @@ func NewTemplateJSONFilter(excludeTemplate string) (*TemplateJSONFilter, error)
 		return nil, xerrors.Errorf("failed to parse exclude template: %s: %w", excludeTemplate, err)
 	}
 
-	return &TemplateJSONFilter{
+	f := &TemplateJSONFilter{
 		ExcludeTpl: excludeTpl,
-	}, nil
+	}
+
+	if fields, ok := templateFields(excludeTpl.Tree); ok {
+		f.fields = fields
+	}
+
+	return f, nil
 }
 
 func (f *TemplateJSONFilter) IsIncluded(b []byte) (bool, error) {
-	var v interface{}
+	return f.process(newEvent(b))
+}
+
+func (f *TemplateJSONFilter) process(e *event) (bool, error) {
+	doc := e.json()
 
-	err := json.Unmarshal(b, &v)
+	var v interface{}
+	var err error
+	if f.fields != nil && doc.isObject() {
+		v, err = doc.object(f.fields)
+	} else {
+		v, err = doc.decode()
+	}
 	if err != nil {
-		return false, xerrors.Errorf("failed to parse json: %s: %w", string(b), err)
+		return false, xerrors.Errorf("failed to parse json: %s: %w", string(e.raw), err)
 	}
 
 	f.Buf.Reset()
 
 	if err := f.ExcludeTpl.Execute(&f.Buf, v); err != nil {
-		return false, xerrors.Errorf("failed to execute exclude template: %s: %w", string(b), err)
+		return false, xerrors.Errorf("failed to execute exclude template: %s: %w", string(e.raw), err)
 	}
 
 	exclude := bytes.Contains(f.Buf.Bytes(), []byte{'t', 'r', 'u', 'e'})
@@ -1,6 +1,7 @@
 package logfilter_test
 
 import (
+	"strings"
 	"testing"
 
 	. "github.com/bancek/logfilter/pkg/logfilter"
@@ -23,3 +24,22 @@ func BenchmarkTemplateJSONFilter(b *testing.B) {
 		_, _ = jsonFilter.IsIncluded(line)
 	}
 }
+
+func BenchmarkTemplateJSONFilterLargeLine(b *testing.B) {
+	line := []byte(`{"Timestamp":"2020-08-18T17:16:36.9975268+00:00","Level":"Information","MessageTemplate":"Test message","Properties":{"Items":[` +
+		strings.Repeat(`{"Id":1,"Name":"item","Tags":["a","b"]},`, 100) + `{}]}}`)
+
+	excludeTemplate := `{{with .Level}}{{eq . "Debug"}}{{end}}{{with .MessageTemplate}}{{eq . "Test message"}}{{end}}`
+
+	jsonFilter, err := NewTemplateJSONFilter(excludeTemplate)
+	if err != nil {
+		b.Error(err)
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		_, _ = jsonFilter.IsIncluded(line)
+	}
+}
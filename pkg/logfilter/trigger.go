@@ -0,0 +1,240 @@
+package logfilter
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// lineMatcher matches the lines using either a template that renders "true" or
+// a JQ query that outputs a value. Lines that fail to parse do not match.
+type lineMatcher struct {
+	jsonFilter JSONFilter
+	invert     bool
+}
+
+func newLineMatcher(matchTemplate string, matchQuery string) (*lineMatcher, error) {
+	if matchTemplate != "" {
+		// the template filter excludes the lines for which the template renders
+		// "true"
+		jsonFilter, err := NewTemplateJSONFilter(matchTemplate)
+		if err != nil {
+			return nil, err
+		}
+		return &lineMatcher{jsonFilter: jsonFilter, invert: true}, nil
+	}
+
+	jsonFilter, err := NewJQJSONFilter(matchQuery)
+	if err != nil {
+		return nil, err
+	}
+	return &lineMatcher{jsonFilter: jsonFilter}, nil
+}
+
+func (m *lineMatcher) Match(e *event) bool {
+	ok, err := filterEvent(m.jsonFilter, e)
+	if err != nil {
+		return false
+	}
+	return ok != m.invert
+}
+
+type triggerMatch struct {
+	time   time.Time
+	stream string
+	line   string
+}
+
+// trigger counts the matching lines of a Trigger rule. It is not safe for
+// concurrent use.
+type trigger struct {
+	config    Trigger
+	matcher   *lineMatcher
+	signal    os.Signal
+	proc      *proc
+	matches   []triggerMatch
+	lastFired time.Time
+}
+
+// observe records the line if it matches and returns the matches if the
+// trigger fired.
+func (t *trigger) observe(l line, now time.Time) ([]triggerMatch, bool) {
+	if !t.matcher.Match(l.event) {
+		return nil, false
+	}
+
+	if t.config.Cooldown > 0 && !t.lastFired.IsZero() && now.Sub(t.lastFired) < time.Duration(t.config.Cooldown) {
+		return nil, false
+	}
+
+	t.matches = append(t.matches, triggerMatch{
+		time:   now,
+		stream: l.stream.name,
+		line:   string(l.b),
+	})
+
+	if t.config.Window > 0 {
+		windowStart := now.Add(-time.Duration(t.config.Window))
+		i := 0
+		for i < len(t.matches) && t.matches[i].time.Before(windowStart) {
+			i++
+		}
+		t.matches = t.matches[i:]
+	}
+
+	if len(t.matches) > t.config.Threshold {
+		t.matches = t.matches[len(t.matches)-t.config.Threshold:]
+	}
+
+	if len(t.matches) < t.config.Threshold {
+		return nil, false
+	}
+
+	matches := t.matches
+	t.matches = nil
+	t.lastFired = now
+
+	return matches, true
+}
+
+func (f *LogFilter) initTriggers() error {
+	for _, triggerConfig := range f.config.Triggers {
+		matcher, err := newLineMatcher(triggerConfig.MatchTemplate, triggerConfig.MatchQuery)
+		if err != nil {
+			return xerrors.Errorf("failed to build trigger matcher: %s: %w", triggerConfig.Name, err)
+		}
+
+		t := &trigger{
+			config:  triggerConfig,
+			matcher: matcher,
+		}
+
+		switch triggerConfig.Action {
+		case TriggerActionSignal, TriggerActionRestart:
+			if len(f.procs) == 0 {
+				return xerrors.Errorf("trigger action requires a command: %s: %s", triggerConfig.Name, triggerConfig.Action)
+			}
+		}
+
+		if triggerConfig.Action == TriggerActionSignal {
+			t.signal, err = ParseSignal(triggerConfig.Signal)
+			if err != nil {
+				return xerrors.Errorf("trigger %s: %w", triggerConfig.Name, err)
+			}
+		}
+
+		if triggerConfig.Proc != "" {
+			for _, p := range f.procs {
+				if p.name == triggerConfig.Proc {
+					t.proc = p
+				}
+			}
+			if t.proc == nil {
+				return xerrors.Errorf("trigger proc not found: %s: %s", triggerConfig.Name, triggerConfig.Proc)
+			}
+		}
+
+		f.triggers = append(f.triggers, t)
+	}
+
+	return nil
+}
+
+// observeTriggers evaluates the triggers for the line. The actions are
+// performed asynchronously so they do not block the lines processing.
+func (f *LogFilter) observeTriggers(l line) {
+	if len(f.triggers) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	for _, t := range f.triggers {
+		if matches, fired := t.observe(l, now); fired {
+			f.fireTrigger(t, l, matches)
+		}
+	}
+}
+
+func (f *LogFilter) fireTrigger(t *trigger, l line, matches []triggerMatch) {
+	lines := make([]string, len(matches))
+	for i, match := range matches {
+		lines[i] = match.line
+	}
+
+	p := t.proc
+	if p == nil {
+		p = l.stream.proc
+	}
+
+	logger := f.logger.WithFields(logrus.Fields{
+		"trigger": t.config.Name,
+		"action":  t.config.Action,
+		"matches": len(matches),
+		"lines":   lines,
+		"stream":  l.stream.name,
+	})
+	if p != nil && p.name != "" {
+		logger = logger.WithField("proc", p.name)
+	}
+
+	logger.Warn("Trigger fired")
+
+	switch t.config.Action {
+	case TriggerActionHook:
+		f.hooksWg.Add(1)
+		go func() {
+			defer f.hooksWg.Done()
+			f.runTriggerHook(t, lines, logger)
+		}()
+
+	case TriggerActionSignal:
+		if p == nil {
+			logger.Warn("Trigger has no command to signal")
+			return
+		}
+		if err := p.commander.Signal(t.signal); err != nil {
+			logger.WithError(err).Warn("Trigger failed to signal the command")
+		}
+
+	case TriggerActionRestart:
+		if p == nil {
+			logger.Warn("Trigger has no command to restart")
+			return
+		}
+		if err := p.commander.Restart(); err != nil {
+			logger.WithError(err).Warn("Trigger failed to restart the command")
+		}
+
+	case TriggerActionUnhealthy:
+		f.health.SetUnhealthy("trigger/"+t.config.Name, "trigger fired: "+lines[len(lines)-1], time.Duration(t.config.UnhealthyDuration))
+	}
+}
+
+func (f *LogFilter) runTriggerHook(t *trigger, lines []string, logger *logrus.Entry) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(t.config.HookTimeout))
+	defer cancel()
+
+	input := bytes.NewBuffer(nil)
+	for _, l := range lines {
+		input.WriteString(l)
+		input.WriteByte('\n')
+	}
+
+	cmd := exec.CommandContext(ctx, t.config.Hook[0], t.config.Hook[1:]...)
+	cmd.Env = append(os.Environ(), "LOGFILTER_TRIGGER="+t.config.Name)
+	cmd.Stdin = input
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		logger.WithError(err).WithField("output", string(out)).Warn("Trigger hook failed")
+		return
+	}
+
+	logger.WithField("output", string(out)).Info("Trigger hook finished")
+}
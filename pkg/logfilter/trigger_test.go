@@ -0,0 +1,146 @@
+package logfilter_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Trigger", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logfilter-test-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should run the hook after the threshold is reached", func() {
+		hookOutput := filepath.Join(tmpDir, "hook")
+
+		script := `
+			echo '{"Message":"too many open files"}'
+			echo '{"Message":"ok"}'
+			echo '{"Message":"too many open files"}'
+			echo '{"Message":"too many open files"}'
+		`
+
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", script}
+		config.Triggers = Triggers{{
+			Name:        "fds",
+			MatchQuery:  `select(.Message == "too many open files")`,
+			Threshold:   2,
+			Window:      Duration(time.Minute),
+			Action:      TriggerActionHook,
+			Hook:        []string{"sh", "-c", `cat > "$0"; echo "$LOGFILTER_TRIGGER" >> "$0"`, hookOutput},
+			HookTimeout: Duration(5 * time.Second),
+		}}
+
+		logFilter := NewLogFilter(config, nil, bytes.NewBuffer(nil), Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("command exited"))
+
+		out, err := ioutil.ReadFile(hookOutput)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal(`{"Message":"too many open files"}` + "\n" + `{"Message":"too many open files"}` + "\n" + "fds\n"))
+	})
+
+	It("should restart the command", func() {
+		counterPath := filepath.Join(tmpDir, "counter")
+
+		script := `
+			echo x >> "$0"
+			if [ "$(wc -l < "$0")" -lt 2 ]; then
+				echo '{"Message":"connection pool exhausted"}'
+				trap 'exit 0' INT
+				while true; do sleep 0.1; done
+			fi
+		`
+
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", script, counterPath}
+		config.CmdShutdownTimeout = 5 * time.Second
+		config.Triggers = Triggers{{
+			Name:          "pool",
+			MatchTemplate: `{{eq .Message "connection pool exhausted"}}`,
+			Threshold:     1,
+			Action:        TriggerActionRestart,
+		}}
+
+		logFilter := NewLogFilter(config, nil, bytes.NewBuffer(nil), Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("command exited"))
+
+		counter, err := ioutil.ReadFile(counterPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(counter)).To(Equal("x\nx\n"))
+	})
+
+	It("should mark logfilter unhealthy", func() {
+		config := &Config{}
+		config.Triggers = Triggers{{
+			Name:          "errors",
+			MatchTemplate: `{{eq .Level "Error"}}`,
+			Threshold:     1,
+			Action:        TriggerActionUnhealthy,
+		}}
+
+		reader := strings.NewReader(`{"Level":"Information"}` + "\n" + `{"Level":"Error"}` + "\n")
+
+		logFilter := NewLogFilter(config, reader, bytes.NewBuffer(nil), Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Health().IsHealthy()).To(BeTrue())
+
+		Expect(logFilter.Start()).To(HaveOccurred())
+
+		problems := logFilter.Health().Problems()
+		Expect(problems).To(HaveLen(1))
+		Expect(problems[0].Check).To(Equal("trigger/errors"))
+		Expect(problems[0].Reason).To(Equal(`trigger fired: {"Level":"Error"}`))
+	})
+
+	It("should fail to decode invalid triggers", func() {
+		var triggers Triggers
+		Expect(triggers.Decode(`[{"name": "t", "matchQuery": ".", "action": "restart"}]`)).To(Succeed())
+		Expect(triggers[0].Threshold).To(Equal(1))
+		Expect(triggers.Decode(`[{"name": "t", "action": "restart"}]`)).To(MatchError("trigger must have either matchTemplate or matchQuery: t"))
+		Expect(triggers.Decode(`[{"name": "t", "matchQuery": ".", "action": "explode"}]`)).To(MatchError("invalid trigger action: t: explode"))
+		Expect(triggers.Decode(`[{"name": "t", "matchQuery": ".", "action": "signal", "signal": "SIGFOO"}]`)).To(MatchError("trigger t: unknown signal: SIGFOO"))
+		Expect(triggers.Decode(`[{"name": "t", "matchQuery": ".", "action": "hook"}]`)).To(MatchError("trigger hook must not be empty: t"))
+	})
+
+	It("should require a command for the restart action", func() {
+		config := &Config{}
+		config.Triggers = Triggers{{
+			Name:       "t",
+			MatchQuery: ".",
+			Threshold:  1,
+			Action:     TriggerActionRestart,
+		}}
+
+		logFilter := NewLogFilter(config, strings.NewReader(""), bytes.NewBuffer(nil), Logger)
+		defer logFilter.Close()
+
+		Expect(logFilter.Init(context.Background())).To(MatchError("trigger action requires a command: t: restart"))
+	})
+})
@@ -0,0 +1,264 @@
+package logfilter
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// watchGroup are the watched streams of a proc (or stdin). If StallStreams
+// are set each watched stream is a separate group.
+type watchGroup struct {
+	proc    *proc
+	streams []*stream
+	// name is the name of the health check
+	name string
+	// resetAt is the start of the watching, it is reset after a restart
+	resetAt   time.Time
+	stalled   bool
+	stalledAt time.Time
+}
+
+// lastLine returns the time of the last line of any of the streams.
+func (g *watchGroup) lastLine() time.Time {
+	last := time.Time{}
+	for _, s := range g.streams {
+		if t := s.lastLineTime(); t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// idle returns the duration since the last line of any of the streams or since
+// the reset.
+func (g *watchGroup) idle(now time.Time) time.Duration {
+	last := g.lastLine()
+	if g.resetAt.After(last) {
+		last = g.resetAt
+	}
+	return now.Sub(last)
+}
+
+func (f *LogFilter) initWatchdog() error {
+	if f.config.StallTimeout < 0 || f.config.HeartbeatInterval < 0 {
+		return xerrors.Errorf("stall timeout and heartbeat interval must not be negative")
+	}
+
+	if f.config.StallRestart && len(f.procs) == 0 {
+		return xerrors.Errorf("stall restart requires a command")
+	}
+
+	check := func(p *proc, name string) string {
+		if p == nil {
+			return name
+		}
+		return p.check(name)
+	}
+
+	if len(f.config.StallStreams) == 0 {
+		groups := map[*proc]*watchGroup{}
+
+		for _, s := range f.streams {
+			g, ok := groups[s.proc]
+			if !ok {
+				g = &watchGroup{
+					proc: s.proc,
+					name: check(s.proc, "stall"),
+				}
+				groups[s.proc] = g
+				f.watchGroups = append(f.watchGroups, g)
+			}
+			g.streams = append(g.streams, s)
+		}
+
+		return nil
+	}
+
+	for _, s := range f.streams {
+		for _, kind := range f.config.StallStreams {
+			if s.kind == kind {
+				f.watchGroups = append(f.watchGroups, &watchGroup{
+					proc:    s.proc,
+					streams: []*stream{s},
+					name:    check(s.proc, "stall:"+s.kind),
+				})
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// runWatchdog periodically checks the watched streams for stalls and emits the
+// heartbeat lines.
+func (f *LogFilter) runWatchdog(ctx context.Context) error {
+	now := time.Now()
+	for _, g := range f.watchGroups {
+		g.resetAt = now
+	}
+
+	var stallC <-chan time.Time
+	if f.config.StallTimeout > 0 {
+		interval := f.config.StallTimeout / 10
+		if interval < 10*time.Millisecond {
+			interval = 10 * time.Millisecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		stallC = ticker.C
+	}
+
+	var heartbeatC <-chan time.Time
+	if f.config.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(f.config.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeatC = ticker.C
+	}
+
+	for {
+		select {
+		case now := <-stallC:
+			f.checkStalls(ctx, now)
+		case now := <-heartbeatC:
+			f.emitHeartbeat(ctx, now)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (f *LogFilter) checkStalls(ctx context.Context, now time.Time) {
+	for _, g := range f.watchGroups {
+		idle := g.idle(now)
+
+		logger := f.logger.WithFields(logrus.Fields{
+			"idle":         idle,
+			"stallTimeout": f.config.StallTimeout,
+		})
+		if g.proc != nil && g.proc.name != "" {
+			logger = logger.WithField("proc", g.proc.name)
+		}
+		if len(g.streams) == 1 && len(f.config.StallStreams) > 0 {
+			logger = logger.WithField("stream", g.streams[0].name)
+		}
+
+		if g.stalled {
+			if g.lastLine().After(g.stalledAt) {
+				g.stalled = false
+				f.health.SetHealthy(g.name)
+				logger.Info("Watchdog stall recovered")
+				continue
+			}
+
+			// the restarted command is restarted again if it stalls again
+			if idle >= f.config.StallTimeout {
+				f.restartStalled(g, now, logger)
+			}
+			continue
+		}
+
+		if idle < f.config.StallTimeout {
+			continue
+		}
+
+		g.stalled = true
+		g.stalledAt = now
+
+		logger.Warn("Watchdog detected stall")
+
+		f.health.SetUnhealthy(g.name, "no lines for "+idle.Round(time.Millisecond).String(), 0)
+
+		if f.config.StallLine {
+			f.emitLine(ctx, f.watchdogLine(now, "warning", "Logfilter stall detected", g))
+		}
+
+		f.restartStalled(g, now, logger)
+	}
+}
+
+// restartStalled restarts the command of the stalled group if StallRestart is
+// set. The group is watched again from now.
+func (f *LogFilter) restartStalled(g *watchGroup, now time.Time, logger *logrus.Entry) {
+	if !f.config.StallRestart || g.proc == nil {
+		return
+	}
+
+	if err := g.proc.commander.Restart(); err != nil {
+		logger.WithError(err).Warn("Watchdog failed to restart the command")
+	} else {
+		logger.Info("Watchdog restarting the command")
+	}
+
+	g.resetAt = now
+}
+
+func (f *LogFilter) emitHeartbeat(ctx context.Context, now time.Time) {
+	for _, g := range f.watchGroups {
+		f.emitLine(ctx, f.watchdogLine(now, "info", "Logfilter heartbeat", g))
+	}
+}
+
+func (f *LogFilter) watchdogLine(now time.Time, level string, msg string, g *watchGroup) []byte {
+	streams := map[string]float64{}
+	for _, s := range g.streams {
+		last := s.lastLineTime()
+		if last.IsZero() {
+			last = g.resetAt
+		}
+		streams[s.name] = now.Sub(last).Seconds()
+	}
+
+	fields := map[string]interface{}{
+		"time":        now.Format(RFC3339Milli),
+		"level":       level,
+		"msg":         msg,
+		"service":     "logfilter",
+		"stalled":     g.stalled,
+		"idleSeconds": streams,
+	}
+	if g.proc != nil && g.proc.name != "" {
+		fields["proc"] = g.proc.name
+	}
+
+	b, _ := json.Marshal(fields)
+
+	return b
+}
+
+// emitLine writes the logfilter's own line to the writer. The line is not
+// filtered and it is not written to the full output.
+func (f *LogFilter) emitLine(ctx context.Context, b []byte) {
+	select {
+	case f.emitChan <- b:
+	case <-f.writerDone:
+	case <-ctx.Done():
+	}
+}
+
+func (s *stream) touch(now time.Time, size int) {
+	atomic.StoreInt64(&s.lastLineAt, now.UnixNano())
+	atomic.AddUint64(&s.lines, 1)
+	atomic.AddUint64(&s.bytes, uint64(size))
+}
+
+func (s *stream) count(included bool) {
+	if included {
+		atomic.AddUint64(&s.included, 1)
+	} else {
+		atomic.AddUint64(&s.excluded, 1)
+	}
+}
+
+func (s *stream) lastLineTime() time.Time {
+	lastLineAt := atomic.LoadInt64(&s.lastLineAt)
+	if lastLineAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastLineAt)
+}
@@ -0,0 +1,192 @@
+package logfilter_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bancek/logfilter/pkg/logfilter"
+)
+
+var _ = Describe("Watchdog", func() {
+	It("should detect a stall and recover", func() {
+		script := `
+			echo "first"
+			sleep 0.5
+			echo "second"
+			exec sleep 5
+		`
+
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", script}
+		config.CmdShutdownTimeout = 100 * time.Millisecond
+		config.StallTimeout = 200 * time.Millisecond
+		config.StallLine = true
+
+		writer := &syncBuffer{}
+
+		logFilter := NewLogFilter(config, nil, writer, Logger)
+
+		ctx, cancel := context.WithCancel(TestCtx)
+		defer cancel()
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+		defer logFilter.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		Eventually(func() []HealthProblem {
+			return logFilter.Health().Problems()
+		}).Should(HaveLen(1))
+		Expect(logFilter.Health().Problems()[0].Check).To(Equal("stall"))
+
+		Eventually(writer.String).Should(ContainSubstring("second"))
+		Eventually(logFilter.Health().IsHealthy).Should(BeTrue())
+
+		cancel()
+		Eventually(done).Should(Receive())
+
+		lines := strings.Split(strings.TrimSpace(writer.String()), "\n")
+		Expect(lines[0]).To(Equal("first"))
+
+		stallLine := map[string]interface{}{}
+		Expect(json.Unmarshal([]byte(lines[1]), &stallLine)).To(Succeed())
+		Expect(stallLine["msg"]).To(Equal("Logfilter stall detected"))
+		Expect(stallLine["stalled"]).To(BeTrue())
+		Expect(stallLine["idleSeconds"]).To(HaveKey("stdout"))
+
+		Expect(lines[2]).To(Equal("second"))
+	})
+
+	It("should restart a stalled command every time it stalls", func() {
+		tmpDir, err := ioutil.TempDir("", "logfilter-test-")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+
+		counterPath := filepath.Join(tmpDir, "counter")
+
+		script := `
+			echo x >> "$0"
+			if [ "$(wc -l < "$0")" -lt 3 ]; then
+				trap 'exit 0' INT
+				while true; do sleep 0.1; done
+			fi
+		`
+
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", script, counterPath}
+		config.CmdShutdownTimeout = 5 * time.Second
+		config.StallTimeout = 200 * time.Millisecond
+		config.StallRestart = true
+
+		logFilter := NewLogFilter(config, nil, bytes.NewBuffer(nil), Logger)
+		Expect(logFilter.Init(TestCtx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(MatchError("command exited"))
+
+		counter, err := ioutil.ReadFile(counterPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(counter)).To(Equal("x\nx\nx\n"))
+	})
+
+	It("should detect a stall of a stream while another stream writes lines", func() {
+		script := `
+			echo "first"
+			while true; do echo "chatty" >&2; sleep 0.02; done
+		`
+
+		config := &Config{}
+		config.Cmd = []string{"bash", "-c", script}
+		config.CmdShutdownTimeout = 100 * time.Millisecond
+		config.StallTimeout = 200 * time.Millisecond
+		config.StallStreams = []string{"stdout"}
+		config.StallLine = false
+
+		logFilter := NewLogFilter(config, nil, ioutil.Discard, Logger)
+
+		ctx, cancel := context.WithCancel(TestCtx)
+		defer cancel()
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+		defer logFilter.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- logFilter.Start()
+		}()
+
+		Eventually(func() []HealthProblem {
+			return logFilter.Health().Problems()
+		}).Should(HaveLen(1))
+		Expect(logFilter.Health().Problems()[0].Check).To(Equal("stall:stdout"))
+
+		cancel()
+		Eventually(done).Should(Receive())
+	})
+
+	It("should emit heartbeat lines", func() {
+		config := &Config{}
+		config.HeartbeatInterval = 50 * time.Millisecond
+
+		inputWait := make(chan struct{})
+		defer close(inputWait)
+
+		reader := io.MultiReader(strings.NewReader("line\n"), funcReader(func(b []byte) (int, error) {
+			<-inputWait
+			return 0, io.EOF
+		}))
+		writer := &syncBuffer{}
+
+		logFilter := NewLogFilter(config, reader, writer, Logger)
+
+		ctx, cancel := context.WithTimeout(TestCtx, 300*time.Millisecond)
+		defer cancel()
+
+		Expect(logFilter.Init(ctx)).To(Succeed())
+		defer logFilter.Close()
+
+		Expect(logFilter.Start()).To(Succeed())
+
+		lines := strings.Split(strings.TrimSpace(writer.String()), "\n")
+		Expect(len(lines)).To(BeNumerically(">=", 3))
+		Expect(lines[0]).To(Equal("line"))
+
+		heartbeat := map[string]interface{}{}
+		Expect(json.Unmarshal([]byte(lines[1]), &heartbeat)).To(Succeed())
+		Expect(heartbeat["msg"]).To(Equal("Logfilter heartbeat"))
+		Expect(heartbeat["stalled"]).To(BeFalse())
+		Expect(heartbeat["idleSeconds"]).To(HaveKey("stdin"))
+	})
+})
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}